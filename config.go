@@ -0,0 +1,581 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/adelolmo/hd-idle/hdidle"
+	"github.com/adelolmo/hd-idle/sysfs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The configuration file uses a small subset of TOML:
+
+	# comment
+	[defaults]
+	idle_time = "10m"
+	command_type = "auto"
+	power_condition = 0
+	symlink_policy = 0
+	log_file = "/var/log/hd-idle.log"
+	debug = false
+	ignore_spin_down_detection = false
+	quirks_file = "/etc/hd-idle.quirks"
+	state_file = "/var/lib/hd-idle/state.json"
+	metrics_file = ""
+	max_spindown_failures = 5
+	query_power_state = false
+	spinup_on_pending_io = false
+	resume_policy = "reset"
+
+	[device.sda]
+	idle_time = 300
+
+	[device."/dev/disk/by-id/ata-ST4000DM005-2DP166_ZGY0LBRB"]
+	idle_time = 1200
+	command_type = "ata"
+	firmware_standby = "20m"
+	apm_level = 127
+	resume_policy = "restore"
+
+	[device."sd[c-f]"]
+	idle_time = 600
+
+	[device.sdh]
+	command_type = "exec"
+	exec_spindown = "uhubctl -a off -l {hub} -p {port}"
+	exec_power_state = "hdparm -C {device}"
+
+	[rule.usb-wd]
+	transport = "usb"
+	vendor = "WD"
+	idle_time = 900
+	command_type = "ata"
+
+Device sections are keyed by a device name, a symlink or a glob pattern on the
+device name. Rule sections carry an arbitrary label and select the disks with
+the device option, which defaults to all disks. Both accept idle_time,
+command_type, power_condition, query_power_state, spinup_on_pending_io,
+firmware_standby, apm_level, resume_policy, exec_spindown, exec_spinup,
+exec_power_state and the selectors model, vendor, serial, wwid, transport,
+removable and rotational. Any option left out is taken from the defaults.
+idle_time is either a number of seconds or a duration like "10m".
+
+Device and rule sections are evaluated in the order they appear and the first
+one matching a disk wins. Devices given on the command line come first.
+*/
+
+const (
+	defaultConfigFile = "/etc/hd-idle.conf"
+	defaultQuirksFile = "/etc/hd-idle.quirks"
+	defaultStateFile  = "/var/lib/hd-idle/state.json"
+	sectionDefaults   = "defaults"
+	sectionDevice     = "device"
+	sectionRule       = "rule"
+)
+
+type fileOptions struct {
+	idle                    *time.Duration
+	commandType             *string
+	powerCondition          *uint8
+	queryPowerState         *bool
+	spinupOnPendingIo       *bool
+	firmwareStandby         *time.Duration
+	apmLevel                *uint8
+	resumePolicy            *string
+	execSpindown            *string
+	execSpinup              *string
+	execPowerState          *string
+	symlinkPolicy           *int
+	logFile                 *string
+	debug                   *bool
+	ignoreSpinDownDetection *bool
+	quirksFile              *string
+	stateFile               *string
+	metricsFile             *string
+	maxFailures             *int
+	device                  *string
+	selector                hdidle.DeviceSelector
+}
+
+type fileDevice struct {
+	kind    string
+	label   string
+	options fileOptions
+}
+
+type fileConf struct {
+	defaults fileOptions
+	devices  []fileDevice
+}
+
+// configDir returns the drop-in directory belonging to a configuration file,
+// e.g. /etc/hd-idle.d for /etc/hd-idle.conf.
+func configDir(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ".d"
+}
+
+// loadConfigFiles reads the given configuration file followed by every *.conf
+// file of its drop-in directory in lexical order. Later files override the
+// values of earlier ones. A missing file is only an error if it was required.
+func loadConfigFiles(file string, required bool) (*fileConf, error) {
+	fc := &fileConf{}
+
+	content, err := os.ReadFile(file)
+	switch {
+	case err == nil:
+		if err := fc.parse(string(content), file); err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err) || required:
+		return nil, fmt.Errorf("cannot read config file %s: %s", file, err)
+	}
+
+	dropIns, err := filepath.Glob(filepath.Join(configDir(file), "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dropIns)
+	for _, dropIn := range dropIns {
+		content, err := os.ReadFile(dropIn)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read config file %s: %s", dropIn, err)
+		}
+		if err := fc.parse(string(content), dropIn); err != nil {
+			return nil, err
+		}
+	}
+	return fc, nil
+}
+
+func (fc *fileConf) parse(content, filename string) error {
+	var section *fileOptions
+	var sectionKind string
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return fmt.Errorf("%s:%d: malformed section header %s", filename, lineNumber, line)
+			}
+			header := strings.TrimSpace(line[1 : len(line)-1])
+			kindLabel := strings.SplitN(header, ".", 2)
+			sectionKind = kindLabel[0]
+			switch {
+			case header == sectionDefaults:
+				section = &fc.defaults
+			case len(kindLabel) == 2 && (sectionKind == sectionDevice || sectionKind == sectionRule):
+				label, err := unquote(strings.TrimSpace(kindLabel[1]))
+				if err != nil || len(label) == 0 {
+					return fmt.Errorf("%s:%d: invalid %s name in section %s", filename, lineNumber, sectionKind, line)
+				}
+				section = fc.device(sectionKind, label)
+			default:
+				return fmt.Errorf("%s:%d: unknown section %s", filename, lineNumber, line)
+			}
+			continue
+		}
+
+		if section == nil {
+			return fmt.Errorf("%s:%d: option outside of a section", filename, lineNumber)
+		}
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) != 2 {
+			return fmt.Errorf("%s:%d: expected key = value", filename, lineNumber)
+		}
+		key := strings.TrimSpace(keyValue[0])
+		value := strings.TrimSpace(keyValue[1])
+		if err := section.set(key, value, sectionKind); err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// device returns the options of the given device or rule section, creating it
+// on first use. Sections with the same name in several files are merged.
+func (fc *fileConf) device(kind, label string) *fileOptions {
+	for i := range fc.devices {
+		if fc.devices[i].kind == kind && fc.devices[i].label == label {
+			return &fc.devices[i].options
+		}
+	}
+	fc.devices = append(fc.devices, fileDevice{kind: kind, label: label})
+	return &fc.devices[len(fc.devices)-1].options
+}
+
+// name returns the device name, symlink or pattern the section applies to.
+func (d fileDevice) name() string {
+	if d.kind == sectionDevice {
+		return d.label
+	}
+	if d.options.device != nil {
+		return *d.options.device
+	}
+	return "*"
+}
+
+func (o *fileOptions) set(key, value, kind string) error {
+	value, err := unquote(value)
+	if err != nil {
+		return err
+	}
+
+	if kind != sectionDefaults {
+		if handled, err := o.setSelector(key, value, kind); handled {
+			return err
+		}
+	}
+
+	switch key {
+	case "idle_time":
+		idle, err := parseIdleTime(value)
+		if err != nil {
+			return err
+		}
+		o.idle = &idle
+		return nil
+
+	case "command_type":
+		command, err := parseCommandType(value)
+		if err != nil {
+			return err
+		}
+		o.commandType = &command
+		return nil
+
+	case "power_condition":
+		powerCondition, err := parsePowerCondition(value)
+		if err != nil {
+			return err
+		}
+		o.powerCondition = &powerCondition
+		return nil
+
+	case "query_power_state":
+		query, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("wrong query_power_state %s. Must be true or false", value)
+		}
+		o.queryPowerState = &query
+		return nil
+
+	case "spinup_on_pending_io":
+		spinup, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("wrong spinup_on_pending_io %s. Must be true or false", value)
+		}
+		o.spinupOnPendingIo = &spinup
+		return nil
+
+	case "firmware_standby":
+		standby, err := parseFirmwareStandby(value)
+		if err != nil {
+			return err
+		}
+		o.firmwareStandby = &standby
+		return nil
+
+	case "apm_level":
+		level, err := parseApmLevel(value)
+		if err != nil {
+			return err
+		}
+		o.apmLevel = &level
+		return nil
+
+	case "resume_policy":
+		policy, err := parseResumePolicy(value)
+		if err != nil {
+			return err
+		}
+		o.resumePolicy = &policy
+		return nil
+
+	case "exec_spindown":
+		o.execSpindown = &value
+		return nil
+
+	case "exec_spinup":
+		o.execSpinup = &value
+		return nil
+
+	case "exec_power_state":
+		o.execPowerState = &value
+		return nil
+	}
+
+	if kind != sectionDefaults {
+		return fmt.Errorf("option %s is only allowed in the [defaults] section", key)
+	}
+
+	switch key {
+	case "symlink_policy":
+		policy, err := parseSymlinkPolicy(value)
+		if err != nil {
+			return err
+		}
+		o.symlinkPolicy = &policy
+	case "log_file":
+		o.logFile = &value
+	case "debug":
+		debug, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("wrong debug %s. Must be true or false", value)
+		}
+		o.debug = &debug
+	case "ignore_spin_down_detection":
+		ignore, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("wrong ignore_spin_down_detection %s. Must be true or false", value)
+		}
+		o.ignoreSpinDownDetection = &ignore
+	case "quirks_file":
+		if len(value) == 0 {
+			return fmt.Errorf("option quirks_file must not be empty")
+		}
+		o.quirksFile = &value
+	case "state_file":
+		o.stateFile = &value
+	case "metrics_file":
+		o.metricsFile = &value
+	case "max_spindown_failures":
+		maxFailures, err := strconv.Atoi(value)
+		if err != nil || maxFailures < 0 {
+			return fmt.Errorf("wrong max_spindown_failures %s. Must be 0 or greater", value)
+		}
+		o.maxFailures = &maxFailures
+	default:
+		return fmt.Errorf("unknown option %s", key)
+	}
+	return nil
+}
+
+// setSelector sets the options that select the disks a device or rule
+// section applies to. It reports whether the key was one of them.
+func (o *fileOptions) setSelector(key, value, kind string) (bool, error) {
+	switch key {
+	case "device":
+		if kind != sectionRule {
+			return true, fmt.Errorf("option device is only allowed in [rule.<name>] sections")
+		}
+		if len(value) == 0 {
+			return true, fmt.Errorf("option device must not be empty")
+		}
+		o.device = &value
+	case "model":
+		o.selector.Model = value
+	case "vendor":
+		o.selector.Vendor = value
+	case "serial":
+		o.selector.Serial = value
+	case "wwid":
+		o.selector.WWID = value
+	case "transport":
+		switch value {
+		case sysfs.TransportUsb, sysfs.TransportSata, sysfs.TransportSas, sysfs.TransportNvme,
+			sysfs.TransportMmc, sysfs.TransportVirtio, sysfs.TransportIeee1394, sysfs.TransportScsi:
+		default:
+			return true, fmt.Errorf("wrong transport %s. Must be one of: usb, sata, sas, nvme, mmc, virtio, ieee1394, scsi", value)
+		}
+		o.selector.Transport = value
+	case "removable":
+		removable, err := strconv.ParseBool(value)
+		if err != nil {
+			return true, fmt.Errorf("wrong removable %s. Must be true or false", value)
+		}
+		o.selector.Removable = &removable
+	case "rotational":
+		rotational, err := strconv.ParseBool(value)
+		if err != nil {
+			return true, fmt.Errorf("wrong rotational %s. Must be true or false", value)
+		}
+		o.selector.Rotational = &rotational
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// applyDefaults overrides the given defaults with the ones set in the files.
+func (fc *fileConf) applyDefaults(defaults *hdidle.DefaultConf) {
+	o := fc.defaults
+	if o.idle != nil {
+		defaults.Idle = *o.idle
+	}
+	if o.commandType != nil {
+		defaults.CommandType = *o.commandType
+	}
+	if o.powerCondition != nil {
+		defaults.PowerCondition = *o.powerCondition
+	}
+	if o.queryPowerState != nil {
+		defaults.QueryPowerState = *o.queryPowerState
+	}
+	if o.spinupOnPendingIo != nil {
+		defaults.SpinupOnPendingIo = *o.spinupOnPendingIo
+	}
+	if o.firmwareStandby != nil {
+		defaults.FirmwareStandby = o.firmwareStandby
+	}
+	if o.apmLevel != nil {
+		defaults.ApmLevel = *o.apmLevel
+	}
+	if o.resumePolicy != nil {
+		defaults.ResumePolicy = *o.resumePolicy
+	}
+	o.applyExec(&defaults.Exec)
+	if o.symlinkPolicy != nil {
+		defaults.SymlinkPolicy = *o.symlinkPolicy
+	}
+	if o.logFile != nil {
+		defaults.LogFile = *o.logFile
+	}
+	if o.debug != nil {
+		defaults.Debug = *o.debug
+	}
+	if o.ignoreSpinDownDetection != nil {
+		defaults.IgnoreSpinDownDetection = *o.ignoreSpinDownDetection
+	}
+	if o.quirksFile != nil {
+		defaults.QuirksFile = *o.quirksFile
+	}
+	if o.stateFile != nil {
+		defaults.StateFile = *o.stateFile
+	}
+	if o.metricsFile != nil {
+		defaults.MetricsFile = *o.metricsFile
+	}
+	if o.maxFailures != nil {
+		defaults.MaxFailures = *o.maxFailures
+	}
+}
+
+// applyDevices adds the devices of the files to the config. Devices already
+// configured on the command line take precedence and are left untouched.
+func (fc *fileConf) applyDevices(config *hdidle.Config) {
+	for _, device := range fc.devices {
+		name := device.name()
+		disks, err := resolveDisks(name)
+		if err != nil {
+			disks = []string{""}
+			fmt.Printf("Unable to resolve device: %s\n", err)
+		}
+		if device.options.selector.IsEmpty() && config.HasDevice(name, disks[0]) {
+			continue
+		}
+
+		deviceConf := hdidle.DeviceConf{
+			GivenName:         name,
+			Idle:              config.Defaults.Idle,
+			CommandType:       config.Defaults.CommandType,
+			PowerCondition:    config.Defaults.PowerCondition,
+			QueryPowerState:   config.Defaults.QueryPowerState,
+			SpinupOnPendingIo: config.Defaults.SpinupOnPendingIo,
+			FirmwareStandby:   config.Defaults.FirmwareStandby,
+			ApmLevel:          config.Defaults.ApmLevel,
+			ResumePolicy:      config.Defaults.ResumePolicy,
+			Exec:              config.Defaults.Exec,
+			Selector:          device.options.selector,
+		}
+		if device.options.idle != nil {
+			deviceConf.Idle = *device.options.idle
+		}
+		if device.options.commandType != nil {
+			deviceConf.CommandType = *device.options.commandType
+		}
+		if device.options.powerCondition != nil {
+			deviceConf.PowerCondition = *device.options.powerCondition
+		}
+		if device.options.queryPowerState != nil {
+			deviceConf.QueryPowerState = *device.options.queryPowerState
+		}
+		if device.options.spinupOnPendingIo != nil {
+			deviceConf.SpinupOnPendingIo = *device.options.spinupOnPendingIo
+		}
+		if device.options.firmwareStandby != nil {
+			deviceConf.FirmwareStandby = device.options.firmwareStandby
+		}
+		if device.options.apmLevel != nil {
+			deviceConf.ApmLevel = *device.options.apmLevel
+		}
+		if device.options.resumePolicy != nil {
+			deviceConf.ResumePolicy = *device.options.resumePolicy
+		}
+		device.options.applyExec(&deviceConf.Exec)
+		for _, disk := range disks {
+			deviceConf.Name = disk
+			config.Devices = append(config.Devices, deviceConf)
+			if !hdidle.IsPattern(disk) {
+				config.NameMap[disk] = name
+			}
+		}
+	}
+}
+
+// applyExec overrides the command templates set in the options.
+func (o fileOptions) applyExec(execConf *hdidle.ExecConf) {
+	if o.execSpindown != nil {
+		execConf.Spindown = *o.execSpindown
+	}
+	if o.execSpinup != nil {
+		execConf.Spinup = *o.execSpinup
+	}
+	if o.execPowerState != nil {
+		execConf.PowerState = *o.execPowerState
+	}
+}
+
+func stripComment(line string) string {
+	inQuotes := false
+	for i, c := range line {
+		switch c {
+		case '"':
+			inQuotes = !inQuotes
+		case '#':
+			if !inQuotes {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func unquote(value string) (string, error) {
+	if !strings.HasPrefix(value, "\"") {
+		return value, nil
+	}
+	s, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("malformed string %s", value)
+	}
+	return s, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"github.com/adelolmo/hd-idle/hdidle"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	content := `# hd-idle configuration
+[defaults]
+idle_time = 900
+command_type = "ata"
+log_file = "/var/log/hd-idle.log" # trailing comment
+debug = true
+max_spindown_failures = 3
+resume_policy = "verify"
+metrics_file = "/var/lib/node-exporter/hd-idle.prom"
+
+[device.sda]
+idle_time = 300
+query_power_state = true
+
+[device."/dev/disk/by-id/ata-SAMSUNG_HD103SJ"]
+command_type = "scsi"
+power_condition = 3
+firmware_standby = "20m"
+apm_level = 127
+resume_policy = "restore"
+`
+	fc := &fileConf{}
+	if err := fc.parse(content, "hd-idle.conf"); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := hdidle.DefaultConf{Idle: hdidle.DefaultIdleTime, CommandType: hdidle.SCSI}
+	fc.applyDefaults(&defaults)
+	expected := hdidle.DefaultConf{
+		Idle:         900 * time.Second,
+		CommandType:  hdidle.ATA,
+		LogFile:      "/var/log/hd-idle.log",
+		Debug:        true,
+		MaxFailures:  3,
+		ResumePolicy: hdidle.ResumeVerify,
+		MetricsFile:  "/var/lib/node-exporter/hd-idle.prom",
+	}
+	if defaults != expected {
+		t.Fatalf("Expected %v but found %v", expected, defaults)
+	}
+
+	if len(fc.devices) != 2 {
+		t.Fatalf("Expected 2 devices but found %d", len(fc.devices))
+	}
+	if fc.devices[0].name() != "sda" || *fc.devices[0].options.idle != 300*time.Second ||
+		!*fc.devices[0].options.queryPowerState {
+		t.Fatalf("Unexpected device %v", fc.devices[0])
+	}
+	if fc.devices[1].name() != "/dev/disk/by-id/ata-SAMSUNG_HD103SJ" ||
+		*fc.devices[1].options.commandType != hdidle.SCSI ||
+		*fc.devices[1].options.powerCondition != 3 ||
+		*fc.devices[1].options.firmwareStandby != 20*time.Minute ||
+		*fc.devices[1].options.apmLevel != 127 ||
+		*fc.devices[1].options.resumePolicy != hdidle.ResumeRestore {
+		t.Fatalf("Unexpected device %v", fc.devices[1])
+	}
+}
+
+func TestParseConfigFileExec(t *testing.T) {
+	content := `[defaults]
+exec_power_state = "hdparm -C {device}"
+
+[device.sdh]
+command_type = "exec"
+exec_spindown = "uhubctl -a off -l {hub} -p {port}"
+exec_spinup = "uhubctl -a on -l {hub} -p {port}"
+`
+	fc := &fileConf{}
+	if err := fc.parse(content, "hd-idle.conf"); err != nil {
+		t.Fatal(err)
+	}
+	config := &hdidle.Config{
+		Defaults: hdidle.DefaultConf{Idle: hdidle.DefaultIdleTime, CommandType: hdidle.AUTO},
+		NameMap:  map[string]string{},
+	}
+	fc.applyDefaults(&config.Defaults)
+	fc.applyDevices(config)
+
+	expected := hdidle.ExecConf{
+		Spindown:   "uhubctl -a off -l {hub} -p {port}",
+		Spinup:     "uhubctl -a on -l {hub} -p {port}",
+		PowerState: "hdparm -C {device}",
+	}
+	if len(config.Devices) != 1 || config.Devices[0].Exec != expected || config.Devices[0].CommandType != hdidle.EXEC {
+		t.Fatalf("Expected %v but found %v", expected, config.Devices)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "option outside section",
+			content: "idle_time = 300",
+			want:    "test.conf:1: option outside of a section",
+		},
+		{
+			name:    "unknown section",
+			content: "[disk]\nidle_time = 300",
+			want:    "test.conf:1: unknown section [disk]",
+		},
+		{
+			name:    "unknown option",
+			content: "[defaults]\nidle = 300",
+			want:    "test.conf:2: unknown option idle",
+		},
+		{
+			name:    "wrong command type",
+			content: "[device.sda]\ncommand_type = \"sata\"",
+			want:    "test.conf:2: wrong command_type sata. Must be one of: auto, scsi, ata, nvme, hdio, exec",
+		},
+		{
+			name:    "wrong resume policy",
+			content: "[device.sda]\nresume_policy = \"later\"",
+			want:    "test.conf:2: wrong resume_policy later. Must be one of: reset, restore, verify",
+		},
+		{
+			name:    "defaults option in device section",
+			content: "[device.sda]\ndebug = true",
+			want:    "test.conf:2: option debug is only allowed in the [defaults] section",
+		},
+		{
+			name:    "device option in device section",
+			content: "[device.sda]\ndevice = \"sdb\"",
+			want:    "test.conf:2: option device is only allowed in [rule.<name>] sections",
+		},
+		{
+			name:    "wrong transport",
+			content: "[rule.external]\ntransport = \"thunderbolt\"",
+			want:    "test.conf:2: wrong transport thunderbolt. Must be one of: usb, sata, sas, nvme, mmc, virtio, ieee1394, scsi",
+		},
+		{
+			name:    "firmware standby too long",
+			content: "[device.sda]\nfirmware_standby = \"6h\"",
+			want:    "test.conf:2: wrong firmware_standby 6h. Must not exceed 5h30m0s",
+		},
+		{
+			name:    "wrong apm level",
+			content: "[defaults]\napm_level = 0",
+			want:    "test.conf:2: wrong apm_level 0. Must be a number from 1-255",
+		},
+		{
+			name:    "negative max spindown failures",
+			content: "[defaults]\nmax_spindown_failures = -1",
+			want:    "test.conf:2: wrong max_spindown_failures -1. Must be 0 or greater",
+		},
+		{
+			name:    "missing value",
+			content: "[defaults]\nidle_time",
+			want:    "test.conf:2: expected key = value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := &fileConf{}
+			err := fc.parse(tt.content, "test.conf")
+			if err == nil {
+				t.Fatalf("Expected error %s", tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Fatalf("Expected %v but found %v", tt.want, err.Error())
+			}
+		})
+	}
+}
+
+func TestParseConfigFileRules(t *testing.T) {
+	content := `[device."sd[c-f]"]
+idle_time = "10m"
+
+[rule.usb-wd]
+transport = "usb"
+vendor = "WD"
+idle_time = 900
+command_type = "ata"
+
+[rule.sas]
+device = "/dev/sd*"
+transport = "sas"
+rotational = true
+power_condition = 3
+`
+	fc := &fileConf{}
+	if err := fc.parse(content, "hd-idle.conf"); err != nil {
+		t.Fatal(err)
+	}
+	config := &hdidle.Config{
+		Defaults: hdidle.DefaultConf{Idle: hdidle.DefaultIdleTime, CommandType: hdidle.SCSI},
+		NameMap:  map[string]string{},
+	}
+	fc.applyDevices(config)
+
+	rotational := true
+	expected := []hdidle.DeviceConf{
+		{Name: "sd[c-f]", GivenName: "sd[c-f]", Idle: 10 * time.Minute, CommandType: hdidle.SCSI},
+		{Name: "*", GivenName: "*", Idle: 900 * time.Second, CommandType: hdidle.ATA,
+			Selector: hdidle.DeviceSelector{Vendor: "WD", Transport: "usb"}},
+		{Name: "sd*", GivenName: "/dev/sd*", Idle: hdidle.DefaultIdleTime, CommandType: hdidle.SCSI, PowerCondition: 3,
+			Selector: hdidle.DeviceSelector{Transport: "sas", Rotational: &rotational}},
+	}
+	if len(config.Devices) != len(expected) {
+		t.Fatalf("Expected %d devices but found %d", len(expected), len(config.Devices))
+	}
+	for i := range expected {
+		if config.Devices[i].String() != expected[i].String() {
+			t.Fatalf("Expected %v but found %v", expected[i].String(), config.Devices[i].String())
+		}
+	}
+	if len(config.NameMap) != 0 {
+		t.Fatalf("Patterns should not be mapped to given names %v", config.NameMap)
+	}
+}
+
+func TestLoadConfigFilesWithDropIns(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hd-idle.conf")
+	writeFile(t, file, "[defaults]\nidle_time = 600\n\n[device.sda]\nidle_time = 300\n")
+	writeFile(t, filepath.Join(dir, "hd-idle.d", "20-admin.conf"), "[device.sda]\nidle_time = 1200\n")
+	writeFile(t, filepath.Join(dir, "hd-idle.d", "10-package.conf"), "[defaults]\nidle_time = 60\n\n[device.sdb]\ncommand_type = \"ata\"\n")
+
+	fc, err := loadConfigFiles(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &hdidle.Config{
+		Defaults: hdidle.DefaultConf{Idle: hdidle.DefaultIdleTime, CommandType: hdidle.SCSI},
+		NameMap:  map[string]string{},
+	}
+	fc.applyDefaults(&config.Defaults)
+	config.Devices = []hdidle.DeviceConf{{Name: "sdb", GivenName: "sdb", Idle: 5 * time.Second, CommandType: hdidle.SCSI}}
+	fc.applyDevices(config)
+
+	expected := []hdidle.DeviceConf{
+		{Name: "sdb", GivenName: "sdb", Idle: 5 * time.Second, CommandType: hdidle.SCSI},
+		{Name: "sda", GivenName: "sda", Idle: 1200 * time.Second, CommandType: hdidle.SCSI},
+	}
+	if len(config.Devices) != len(expected) {
+		t.Fatalf("Expected %d devices but found %d", len(expected), len(config.Devices))
+	}
+	for i := range expected {
+		if config.Devices[i] != expected[i] {
+			t.Fatalf("Expected %v but found %v", expected[i], config.Devices[i])
+		}
+	}
+	if config.Defaults.Idle != 60*time.Second {
+		t.Fatalf("Expected default idle of 60s but found %v", config.Defaults.Idle)
+	}
+}
+
+func TestLoadConfigFilesMissing(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hd-idle.conf")
+	if _, err := loadConfigFiles(file, false); err != nil {
+		t.Fatalf("Missing optional config file should be ignored: %s", err)
+	}
+	if _, err := loadConfigFiles(file, true); err == nil {
+		t.Fatal("Missing required config file should fail")
+	}
+}
+
+func writeFile(t *testing.T, file, content string) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
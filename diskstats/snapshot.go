@@ -21,8 +21,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -67,9 +67,10 @@ For more details refer to Documentation/admin-guide/iostats.rst
 */
 
 const (
-	deviceNameCol = 2 // field 3 - device name
-	readsCol      = 5 // field 6 - sectors read
-	writesCol     = 9 // field 10 - sectors written
+	deviceNameCol = 2  // field 3 - device name
+	readsCol      = 5  // field 6 - sectors read
+	writesCol     = 9  // field 10 - sectors written
+	inFlightCol   = 11 // field 12 - I/Os currently in progress
 )
 
 type DeviceType int
@@ -79,152 +80,247 @@ const (
 	Disk
 	Partition
 	DeviceMapper
+	// Holder is a device stacked on top of disks other than device mapper,
+	// like md RAID or bcache
+	Holder
 )
 
+const sysClassBlock = "/sys/class/block"
+
 type ReadWriteStats struct {
 	Name   string
 	Type   DeviceType
 	Reads  uint64
 	Writes uint64
+	// InFlight is the number of requests issued to the disk itself which
+	// have not completed yet
+	InFlight uint64
 }
 
-var scsiDiskRegex *regexp.Regexp
-var scsiPartitionRegex *regexp.Regexp
+var diskNameRegex *regexp.Regexp
+var partitionNameRegex *regexp.Regexp
 var deviceMapperRegex *regexp.Regexp
+var holderRegex *regexp.Regexp
+
+// diskHoldersGetterFunc returns the devices stacked directly on top of a
+// block device, as listed in /sys/class/block/<name>/holders.
+type diskHoldersGetterFunc func(string, string) ([]string, error)
 
-type diskHolderGetterFunc func(string, string) (string, error)
+// deviceClassifierFunc tells the type of a block device and, for partitions,
+// the name of the device holding it.
+type deviceClassifierFunc func(string) (DeviceType, string)
 
 func init() {
-	scsiDiskRegex = regexp.MustCompile("sd[a-z]+$")
-	scsiPartitionRegex = regexp.MustCompile("sd[a-z]+[0-9]+$")
-	deviceMapperRegex = regexp.MustCompile("dm-.*$")
+	diskNameRegex = regexp.MustCompile("^(sd[a-z]+|hd[a-z]+|vd[a-z]+|xvd[a-z]+|sr[0-9]+|mmcblk[0-9]+|nvme[0-9]+n[0-9]+)$")
+	partitionNameRegex = regexp.MustCompile("^(sd[a-z]+|hd[a-z]+|vd[a-z]+|xvd[a-z]+|mmcblk[0-9]+p|nvme[0-9]+n[0-9]+p|md[0-9]+p)[0-9]+$")
+	deviceMapperRegex = regexp.MustCompile("^dm-.*$")
+	holderRegex = regexp.MustCompile("^(md[0-9]+|md_.+|bcache[0-9]+)$")
 }
 
-func Snapshot() []ReadWriteStats {
+// Snapshot reads the statistics of every disk from /proc/diskstats, with the
+// activity of the devices stacked on top of a disk counted on the disk.
+func Snapshot() ([]ReadWriteStats, error) {
 	f, err := os.Open("/proc/diskstats")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer f.Close()
 
-	return readSnapshot(f, getDiskHolder)
+	return readSnapshot(f, getDiskHolders, sysfsClassifier(sysClassBlock))
 }
 
-func readSnapshot(r io.Reader, holderGetter diskHolderGetterFunc) []ReadWriteStats {
+// readSnapshot reads the statistics of every disk. The activity of a disk is
+// the activity of its partitions and of every device stacked on top of it,
+// following the holders all the way up: partitions, md RAID, LVM, LUKS,
+// bcache. A device spanning several disks is attributed to all of them.
+// Disks without partitions or holders keep their own statistics.
+func readSnapshot(r io.Reader, holdersGetter diskHoldersGetterFunc, classifier deviceClassifierFunc) ([]ReadWriteStats, error) {
 	diskStatsMap := make(map[string]ReadWriteStats)
-	partitionStatsMap := make(map[string]ReadWriteStats)
-	deviceMapperHolderMap := make(map[string]string)
+	deviceStatsMap := make(map[string]ReadWriteStats)
+	// devices stacked directly on top of each device, including partitions
+	upperDevicesMap := make(map[string][]string)
 
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		diskStats, err := statsForDisk(scanner.Text())
+		stats, diskName, err := statsForDisk(scanner.Text(), classifier)
 		if err != nil {
 			continue
 		}
 
-		if diskStats.Type == Disk {
-			diskStatsMap[diskStats.Name] = *diskStats
-
-			if dmName, err := holderGetter(diskStats.Name, "/sys/class/block/%s/holders/"); err == nil && dmName != "" {
-				deviceMapperHolderMap[dmName] = diskStats.Name
-			}
+		if stats.Type == Disk {
+			diskStatsMap[stats.Name] = *stats
 		} else {
-			partitionStatsMap[diskStats.Name] = *diskStats
+			deviceStatsMap[stats.Name] = *stats
+		}
+		if stats.Type == Partition {
+			upperDevicesMap[diskName] = append(upperDevicesMap[diskName], stats.Name)
+		}
+		if holders, err := holdersGetter(stats.Name, "/sys/class/block/%s/holders/"); err == nil {
+			upperDevicesMap[stats.Name] = append(upperDevicesMap[stats.Name], holders...)
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	for _, partitionStats := range partitionStatsMap {
 
-		var diskName string
-		var ok bool
+	for diskName, diskStats := range diskStatsMap {
+		upperDevices := collectUpperDevices(diskName, upperDevicesMap)
+		if len(upperDevices) == 0 {
+			continue
+		}
 
-		switch partitionStats.Type {
-		case Partition:
-			diskName = strings.TrimRight(partitionStats.Name,"0123456789")
-		case DeviceMapper:
-			if diskName, ok = deviceMapperHolderMap[partitionStats.Name]; !ok {
+		// replace disk statistics by the ones of the devices on top of it,
+		// the requests in flight are the ones queued on the disk itself
+		diskStats.Type = Unknown
+		diskStats.Reads = 0
+		diskStats.Writes = 0
+		for _, name := range upperDevices {
+			stats, ok := deviceStatsMap[name]
+			if !ok {
 				continue
 			}
-		default:
-			continue
+			diskStats.Reads += stats.Reads
+			diskStats.Writes += stats.Writes
+			if diskStats.Type == Unknown || stats.Type < diskStats.Type {
+				diskStats.Type = stats.Type
+			}
 		}
-
-		var diskStats ReadWriteStats
-		if diskStats, ok = diskStatsMap[diskName]; !ok {
+		if diskStats.Type == Unknown {
+			// none of the devices on top of the disk reports statistics
 			continue
 		}
-		if diskStats.Type == Disk {
-			// replace disk statistics by partition or holder stats
-			diskStats.Type = partitionStats.Type
-			diskStats.Writes = partitionStats.Writes
-			diskStats.Reads = partitionStats.Reads
-		} else {
-			// otherwise, accumulate stats of all partitions and holder if any
-			diskStats.Writes += partitionStats.Writes
-			diskStats.Reads += partitionStats.Reads
-		}
 		diskStatsMap[diskName] = diskStats
 	}
 
-	return toSlice(diskStatsMap)
+	return toSlice(diskStatsMap), nil
 }
 
-func getDiskHolder(diskName, pathFormat string) (string, error) {
-	/* This returns only the first holder. In practice when using LUKS, there is only one holder */
+// collectUpperDevices walks the graph of partitions and holders starting at
+// the disk and returns every device found on the way.
+func collectUpperDevices(diskName string, upperDevicesMap map[string][]string) []string {
+	var upperDevices []string
+	visited := map[string]bool{diskName: true}
+	pending := append([]string{}, upperDevicesMap[diskName]...)
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if visited[name] {
+			continue
+		}
+		visited[name] = true
+		upperDevices = append(upperDevices, name)
+		pending = append(pending, upperDevicesMap[name]...)
+	}
+	return upperDevices
+}
 
-	holdersDir := fmt.Sprintf(pathFormat, diskName)
+func getDiskHolders(deviceName, pathFormat string) ([]string, error) {
+	holdersDir := fmt.Sprintf(pathFormat, deviceName)
 	if _, err := os.Stat(holdersDir); os.IsNotExist(err) {
-		return "", err
+		return nil, err
 	}
 
 	files, err := os.ReadDir(holdersDir)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	var holders []string
 	for _, file := range files {
-		return file.Name(), nil
+		holders = append(holders, file.Name())
 	}
-	return "", nil
+	return holders, nil
 }
 
-func statsForDisk(rawStats string) (*ReadWriteStats, error) {
+// sysfsClassifier classifies block devices by what sysfs tells about them.
+// Partitions have a "partition" attribute and live in the directory of their
+// disk, e.g. /sys/devices/.../block/nvme0n1/nvme0n1p1. Disks link to the
+// device backing them, while virtual devices like loop, ram or zram don't.
+// Devices built on top of others list them in their "slaves" directory.
+// Devices missing in sysfs are classified by their name.
+func sysfsClassifier(root string) deviceClassifierFunc {
+	return func(name string) (DeviceType, string) {
+		devicePath, err := filepath.EvalSymlinks(filepath.Join(root, name))
+		if err != nil {
+			return classifyByName(name)
+		}
+		if _, err := os.Stat(filepath.Join(devicePath, "partition")); err == nil {
+			return Partition, filepath.Base(filepath.Dir(devicePath))
+		}
+		if deviceMapperRegex.MatchString(name) {
+			return DeviceMapper, ""
+		}
+		if _, err := os.Stat(filepath.Join(devicePath, "device")); err == nil {
+			return Disk, ""
+		}
+		if slaves, err := os.ReadDir(filepath.Join(devicePath, "slaves")); err == nil && len(slaves) > 0 {
+			return Holder, ""
+		}
+		if holderRegex.MatchString(name) {
+			return Holder, ""
+		}
+		return Unknown, ""
+	}
+}
+
+// classifyByName classifies the block devices of the well known drivers by
+// the naming scheme of the kernel: sd, hd, vd, xvd and sr disks get partition
+// numbers appended (sda1), mmcblk and nvme disks get a "p" in between
+// (mmcblk0p1, nvme0n1p1).
+func classifyByName(name string) (DeviceType, string) {
+	switch {
+	case diskNameRegex.MatchString(name):
+		return Disk, ""
+	case partitionNameRegex.MatchString(name):
+		diskName := strings.TrimRight(name, "0123456789")
+		if strings.HasPrefix(name, "mmcblk") || strings.HasPrefix(name, "nvme") || strings.HasPrefix(name, "md") {
+			diskName = strings.TrimSuffix(diskName, "p")
+		}
+		return Partition, diskName
+	case deviceMapperRegex.MatchString(name):
+		return DeviceMapper, ""
+	case holderRegex.MatchString(name):
+		return Holder, ""
+	}
+	return Unknown, ""
+}
+
+func statsForDisk(rawStats string, classifier deviceClassifierFunc) (*ReadWriteStats, string, error) {
 	reader := strings.NewReader(rawStats)
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		cols := strings.Fields(scanner.Text())
+		if len(cols) <= writesCol {
+			continue
+		}
 
 		name := cols[deviceNameCol]
-		deviceType := Unknown
 		reads, _ := strconv.ParseUint(cols[readsCol], 10, 64)
 		writes, _ := strconv.ParseUint(cols[writesCol], 10, 64)
-		
-
-		if scsiDiskRegex.MatchString(name) {
-			deviceType = Disk
-		} else if scsiPartitionRegex.MatchString(name) {
-			deviceType = Partition
-		} else if deviceMapperRegex.MatchString(name) {
-			deviceType = DeviceMapper
-		} else {
+		var inFlight uint64
+		if len(cols) > inFlightCol {
+			inFlight, _ = strconv.ParseUint(cols[inFlightCol], 10, 64)
+		}
+
+		deviceType, diskName := classifier(name)
+		if deviceType == Unknown {
 			continue
 		}
 
 		stats := &ReadWriteStats{
-			Name:   name,
-			Type:   deviceType,
-			Reads:  reads,
-			Writes: writes,
+			Name:     name,
+			Type:     deviceType,
+			Reads:    reads,
+			Writes:   writes,
+			InFlight: inFlight,
 		}
-		return stats, nil
+		return stats, diskName, nil
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return nil, errors.New("cannot read disk stats")
+	return nil, "", errors.New("cannot read disk stats")
 }
 
 func toSlice(rws map[string]ReadWriteStats) []ReadWriteStats {
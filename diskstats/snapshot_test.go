@@ -22,13 +22,14 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
-func mockGetDiskHolder(diskName, format string) (string, error) {
+func mockGetDiskHolders(diskName, format string) ([]string, error) {
 	if diskName == "sdf" {
-		return "dm-4", nil
+		return []string{"dm-4"}, nil
 	}
-	return "", nil
+	return nil, nil
 }
 
 func TestTakeSnapshot(t *testing.T) {
@@ -43,7 +44,7 @@ func TestTakeSnapshot(t *testing.T) {
  179       0 mmcblk0 133145 53235 6878634 3020910 1544414 1254150 48441345 240124500 0 13439150 243142800
  179       1 mmcblk0p1 80 40 1760 210 1 0 1 0 0 140 210
  179       2 mmcblk0p2 132931 53195 6874482 3020440 1544413 1254150 48441344 240124500 0 13439000 243278260
-   8       0 sda 321553 158156 37537568 5961590 50820 94361 10439592 26691430 0 3357150 32650910
+   8       0 sda 321553 158156 37537568 5961590 50820 94361 10439592 26691430 1 3357150 32650910
    8       1 sda1 321454 158156 37536344 5725790 50820 94361 10439592 26691430 0 3121370 32415240
    8      32 sdc 52147 2738 6494584 913050 28092 1251 6370936 8938800 0 506360 9852970
    8      33 sdc1 52087 2738 6493672 905390 28092 1251 6370936 8938800 0 498700 9892750
@@ -63,13 +64,17 @@ func TestTakeSnapshot(t *testing.T) {
   65     161 sdaa1 157257 937 11371536 1617417 8304860 2117223236 17004224768 98631435 0 49649104 100248853 0 0 0 0 0 0
   65     176 sdab 54244 803 1223811 596585 368 9 3008 1051 0 342387 597828 0 0 0 0 8 191`
 
-	stats := readSnapshot(strings.NewReader(s), mockGetDiskHolder)
+	stats, err := readSnapshot(strings.NewReader(s), mockGetDiskHolders, classifyByName)
+	if err != nil {
+		t.Fatal(err)
+	}
 	sort.Slice(stats, func(i, j int) bool {
 		return stats[i].Name < stats[j].Name
 	})
 
 	expected := []ReadWriteStats{
-		{Name: "sda", Type: Partition, Reads: 37536344, Writes: 10439592},
+		{Name: "mmcblk0", Type: Partition, Reads: 6876242, Writes: 48441345},
+		{Name: "sda", Type: Partition, Reads: 37536344, Writes: 10439592, InFlight: 1},
 		{Name: "sdaa", Type: Partition, Reads: 11371536, Writes: 17004224768},
 		{Name: "sdab", Type: Disk, Reads: 1223811, Writes: 3008},
 		{Name: "sdb", Type: Partition, Reads: 727475192, Writes: 404215912},
@@ -92,16 +97,159 @@ func TestTakeSnapshot(t *testing.T) {
 	}
 }
 
-func TestGetDiskHolder(t *testing.T) {
+func TestTakeSnapshotOfStackedDevices(t *testing.T) {
+	// sda1 + sdb1 -> md0 -> dm-0 (LVM) -> dm-1 (LUKS)
+	// sdc + sdd -> dm-2 (LVM spanning two PVs)
+	// sde -> bcache0 <- nvme0n1p1
+	s := `   8       0 sda 100 0 1000 0 100 0 1000 0 0 0 0
+   8       1 sda1 90 0 900 0 90 0 900 0 0 0 0
+   8      16 sdb 100 0 2000 0 100 0 2000 0 0 0 0
+   8      17 sdb1 90 0 1900 0 90 0 1900 0 0 0 0
+   9       0 md0 50 0 500 0 50 0 500 0 0 0 0
+ 253       0 dm-0 40 0 400 0 40 0 400 0 0 0 0
+ 253       1 dm-1 30 0 300 0 30 0 300 0 0 0 0
+   8      32 sdc 100 0 3000 0 100 0 3000 0 0 0 0
+   8      48 sdd 100 0 4000 0 100 0 4000 0 0 0 0
+ 253       2 dm-2 20 0 200 0 20 0 200 0 0 0 0
+   8      64 sde 100 0 5000 0 100 0 5000 0 0 0 0
+ 259       0 nvme0n1 100 0 6000 0 100 0 6000 0 0 0 0
+ 259       1 nvme0n1p1 90 0 5900 0 90 0 5900 0 0 0 0
+ 252       0 bcache0 10 0 100 0 10 0 100 0 0 0 0
+   8      80 sdf 100 0 7000 0 100 0 7000 0 0 0 0`
+
+	holders := map[string][]string{
+		"sda1":      {"md0"},
+		"sdb1":      {"md0"},
+		"md0":       {"dm-0"},
+		"dm-0":      {"dm-1"},
+		"sdc":       {"dm-2"},
+		"sdd":       {"dm-2"},
+		"sde":       {"bcache0"},
+		"nvme0n1p1": {"bcache0"},
+	}
+	holdersGetter := func(deviceName, format string) ([]string, error) {
+		return holders[deviceName], nil
+	}
+
+	stats, err := readSnapshot(strings.NewReader(s), holdersGetter, classifyByName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+
+	expected := []ReadWriteStats{
+		{Name: "nvme0n1", Type: Partition, Reads: 6000, Writes: 6000},
+		{Name: "sda", Type: Partition, Reads: 2100, Writes: 2100},
+		{Name: "sdb", Type: Partition, Reads: 3100, Writes: 3100},
+		{Name: "sdc", Type: DeviceMapper, Reads: 200, Writes: 200},
+		{Name: "sdd", Type: DeviceMapper, Reads: 200, Writes: 200},
+		{Name: "sde", Type: Holder, Reads: 100, Writes: 100},
+		{Name: "sdf", Type: Disk, Reads: 7000, Writes: 7000},
+	}
+
+	if len(expected) != len(stats) {
+		t.Fatalf("Expected %d disks but found %d: %v", len(expected), len(stats), stats)
+	}
+	for i := 0; i < len(expected); i++ {
+		if expected[i] != stats[i] {
+			t.Fatalf("Expected %v but found %v", expected[i], stats[i])
+		}
+	}
+}
+
+func TestTakeSnapshotFails(t *testing.T) {
+	r := iotest.TimeoutReader(strings.NewReader("   8       0 sda 1 0 2 0 1 0 3 0 0 0 0 0 0 0 0 0 0\n"))
+	stats, err := readSnapshot(r, mockGetDiskHolders, classifyByName)
+	if err != iotest.ErrTimeout {
+		t.Fatalf("Expected %v but found %v, %v", iotest.ErrTimeout, stats, err)
+	}
+}
+
+func TestSysfsClassifier(t *testing.T) {
+	root := t.TempDir()
+	devices := filepath.Join(root, "devices")
+	classBlock := filepath.Join(root, "class", "block")
+	blockDevices := map[string]string{
+		"nvme0n1":   "pci0000:00/0000:00:1d.0/nvme/nvme0/nvme0n1",
+		"nvme0n1p1": "pci0000:00/0000:00:1d.0/nvme/nvme0/nvme0n1/nvme0n1p1",
+		"mmcblk0":   "platform/emmc2bus/fe340000.mmc/mmc_host/mmc0/mmc0:aaaa/block/mmcblk0",
+		"mmcblk0p2": "platform/emmc2bus/fe340000.mmc/mmc_host/mmc0/mmc0:aaaa/block/mmcblk0/mmcblk0p2",
+		"sdb":       "pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdb",
+		"sdb1":      "pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdb/sdb1",
+		"dm-0":      "virtual/block/dm-0",
+		"loop0":     "virtual/block/loop0",
+		"md0":       "virtual/block/md0",
+	}
+	if err := os.MkdirAll(classBlock, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, path := range blockDevices {
+		devicePath := filepath.Join(devices, path)
+		if err := os.MkdirAll(devicePath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(devicePath, filepath.Join(classBlock, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"nvme0n1", "mmcblk0", "sdb"} {
+		if err := os.Mkdir(filepath.Join(devices, blockDevices[name], "device"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(devices, blockDevices["md0"], "slaves", "sdb1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"nvme0n1p1", "mmcblk0p2", "sdb1"} {
+		if err := os.WriteFile(filepath.Join(devices, blockDevices[name], "partition"), []byte("1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		deviceType DeviceType
+		diskName   string
+	}{
+		{"nvme0n1", Disk, ""},
+		{"nvme0n1p1", Partition, "nvme0n1"},
+		{"mmcblk0", Disk, ""},
+		{"mmcblk0p2", Partition, "mmcblk0"},
+		{"sdb", Disk, ""},
+		{"sdb1", Partition, "sdb"},
+		{"dm-0", DeviceMapper, ""},
+		{"loop0", Unknown, ""},
+		{"md0", Holder, ""},
+		{"bcache0", Holder, ""},
+		{"xvda3", Partition, "xvda"},
+	}
+	classify := sysfsClassifier(classBlock)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deviceType, diskName := classify(test.name)
+			if deviceType != test.deviceType {
+				t.Fatalf("Expected %v but found %v", test.deviceType, deviceType)
+			}
+			if diskName != test.diskName {
+				t.Fatalf("Expected %v but found %v", test.diskName, diskName)
+			}
+		})
+	}
+}
+
+func TestGetDiskHolders(t *testing.T) {
 	type wantParams struct {
 		name         string
 		errorMessage string
 	}
 	tests := []struct {
-		name       string
-		diskName   string
-		holderPath string
-		want       wantParams
+		name        string
+		diskName    string
+		holderPath  string
+		holderPath2 string
+		want        wantParams
 	}{
 		{
 			name:       "disk not found",
@@ -119,6 +267,15 @@ func TestGetDiskHolder(t *testing.T) {
 				name:         "dm-0",
 				errorMessage: "",
 			},
+		}, {
+			name:        "several holders",
+			diskName:    "sda",
+			holderPath:  "/tmp/sys/class/block/sda/holders/dm-0",
+			holderPath2: "/tmp/sys/class/block/sda/holders/md0",
+			want: wantParams{
+				name:         "dm-0,md0",
+				errorMessage: "",
+			},
 		},
 	}
 	for _, test := range tests {
@@ -127,16 +284,20 @@ func TestGetDiskHolder(t *testing.T) {
 			panic(err)
 		}
 		t.Run(test.name, func(t *testing.T) {
-			if len(test.holderPath) > 0 {
-				if err := os.MkdirAll(filepath.Dir(test.holderPath), 0770); err != nil {
+			for _, holderPath := range []string{test.holderPath, test.holderPath2} {
+				if len(holderPath) == 0 {
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(holderPath), 0770); err != nil {
 					panic(err)
 				}
-				_, err := os.Create(test.holderPath)
+				_, err := os.Create(holderPath)
 				if err != nil {
 					panic(err)
 				}
 			}
-			got, err := getDiskHolder(test.diskName, "/tmp/sys/class/block/%s/holders/")
+			holders, err := getDiskHolders(test.diskName, "/tmp/sys/class/block/%s/holders/")
+			got := strings.Join(holders, ",")
 
 			if len(test.want.errorMessage) > 0 &&
 				test.want.errorMessage != err.Error() {
@@ -156,6 +317,8 @@ func TestStatsForDisk(t *testing.T) {
 	type wantParams struct {
 		name         string
 		deviceType   DeviceType
+		diskName     string
+		inFlight     uint64
 		errorMessage string
 	}
 	tests := []struct {
@@ -171,12 +334,56 @@ func TestStatsForDisk(t *testing.T) {
 				deviceType: Disk,
 			},
 		},
+		{
+			name: "disk with requests in flight",
+			line: "8 32 sdc 52147 2738 6494584 913050 28092 1251 6370936 8938800 2 506360 9852970",
+			want: wantParams{
+				name:       "sdc",
+				deviceType: Disk,
+				inFlight:   2,
+			},
+		},
 		{
 			name: "partition type",
 			line: "8 17 sdd1 369 0 39960 1288 0 0 0 0 0 792 1288",
 			want: wantParams{
 				name:       "sdd1",
 				deviceType: Partition,
+				diskName:   "sdd",
+			},
+		},
+		{
+			name: "nvme disk type",
+			line: "259 0 nvme0n1 1023 0 63702 177 3260 1094 134050 1562 0 1848 1835 0 0 0 0 0 0",
+			want: wantParams{
+				name:       "nvme0n1",
+				deviceType: Disk,
+			},
+		},
+		{
+			name: "nvme partition type",
+			line: "259 1 nvme0n1p1 200 0 10234 33 2 0 2 0 0 56 33 0 0 0 0 0 0",
+			want: wantParams{
+				name:       "nvme0n1p1",
+				deviceType: Partition,
+				diskName:   "nvme0n1",
+			},
+		},
+		{
+			name: "mmc partition type",
+			line: "179 2 mmcblk0p2 132931 53195 6874482 3020440 1544413 1254150 48441344 240124500 0 13439000 243278260",
+			want: wantParams{
+				name:       "mmcblk0p2",
+				deviceType: Partition,
+				diskName:   "mmcblk0",
+			},
+		},
+		{
+			name: "virtio disk type",
+			line: "252 0 vda 5311 1797 526730 1843 7331 5321 357184 9227 0 7532 11070",
+			want: wantParams{
+				name:       "vda",
+				deviceType: Disk,
 			},
 		},
 		{
@@ -197,7 +404,7 @@ func TestStatsForDisk(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, gotError := statsForDisk(test.line)
+			got, gotDisk, gotError := statsForDisk(test.line, classifyByName)
 
 			if test.want.errorMessage != "" && test.want.errorMessage != gotError.Error() {
 				t.Fatalf("Expected %v but found %v", test.want.errorMessage, gotError.Error())
@@ -213,6 +420,14 @@ func TestStatsForDisk(t *testing.T) {
 			if test.want.deviceType != got.Type {
 				t.Fatalf("Expected %v but found %v", test.want.deviceType, got.Type)
 			}
+
+			if test.want.diskName != gotDisk {
+				t.Fatalf("Expected %v but found %v", test.want.diskName, gotDisk)
+			}
+
+			if test.want.inFlight != got.InFlight {
+				t.Fatalf("Expected %v but found %v", test.want.inFlight, got.InFlight)
+			}
 		})
 	}
 }
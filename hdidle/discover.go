@@ -0,0 +1,58 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package hdidle
+
+import (
+	"github.com/adelolmo/hd-idle/diskstats"
+	"github.com/adelolmo/hd-idle/sysfs"
+)
+
+// readDiskstats reads the activity of the disks. Tests replace it.
+var readDiskstats = diskstats.Snapshot
+
+// Disk is a disk of the system.
+type Disk struct {
+	Name       string
+	Attributes sysfs.Attributes
+	// CommandType is the command type auto picks for the disk, empty if
+	// hd-idle cannot spin it down
+	CommandType string
+}
+
+// Discover returns the disks listed in /proc/diskstats. Partitions and the
+// devices stacked on top of the disks, like RAID and device mapper devices,
+// are left out.
+func Discover() ([]Disk, error) {
+	snapshot, err := readDiskstats()
+	if err != nil {
+		return nil, err
+	}
+	var disks []Disk
+	for _, stats := range snapshot {
+		attributes, err := diskAttributes(stats.Name)
+		if err != nil {
+			/* the disk went away meanwhile */
+			continue
+		}
+		disks = append(disks, Disk{
+			Name:        stats.Name,
+			Attributes:  attributes,
+			CommandType: CommandTypeFor(stats.Name, AUTO),
+		})
+	}
+	return disks, nil
+}
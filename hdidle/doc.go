@@ -0,0 +1,36 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package hdidle spins down idle hard disks. It holds what the hd-idle
+// daemon is built on, so that other daemons can embed it instead of running
+// hd-idle next to them:
+//
+//   - Discover lists the disks of the system and the command type which spins
+//     each of them down, and io.Disks resolves the names hd-idle accepts,
+//     like symlinks and LABEL=, to the disks they are stored on.
+//   - diskstats.Snapshot reads the activity of the disks, with the activity
+//     of partitions, RAID and device mapper devices counted on their disks.
+//   - SpindownDisk, SpinupDisk and QueryPowerState send the commands of a
+//     command type to a disk, see also the sgio and nvme packages.
+//   - Monitor spins down the disks once idle for longer than their idle
+//     time, and tells what it does to a callback or an event channel.
+//
+// The API of this package and of the packages it refers to follows semantic
+// versioning: the releases of hd-idle are tagged vMAJOR.MINOR.PATCH, and
+// exported identifiers are only removed or changed incompatibly with a new
+// major version. The command line and the configuration files of hd-idle
+// are not part of it.
+package hdidle
@@ -0,0 +1,118 @@
+package hdidle_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adelolmo/hd-idle/diskstats"
+	"github.com/adelolmo/hd-idle/hdidle"
+	"github.com/adelolmo/hd-idle/sgio"
+	"log"
+	"time"
+)
+
+// manualClock only moves when told to. It has no CLOCK_BOOTTIME, so a
+// suspend is taken for a gap between two steps above the skew time.
+type manualClock struct {
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	return c.now
+}
+
+func (c *manualClock) Uptime() (time.Duration, time.Duration, error) {
+	return 0, 0, errors.New("not supported")
+}
+
+// noopExecutor pretends every command succeeds.
+type noopExecutor struct{}
+
+func (noopExecutor) Spindown(ds hdidle.DiskStats, debug bool) (string, error) {
+	return ds.CommandType, nil
+}
+
+func (noopExecutor) Spinup(ds hdidle.DiskStats, debug bool) error {
+	return nil
+}
+
+func (noopExecutor) PowerState(ds hdidle.DiskStats, debug bool) (sgio.PowerState, error) {
+	return sgio.PowerStateStandby, nil
+}
+
+func (noopExecutor) ApplyFirmwareSettings(ds hdidle.DiskStats, debug bool) error {
+	return nil
+}
+
+func ExampleNewMonitor() {
+	config := &hdidle.Config{
+		Defaults: hdidle.DefaultConf{Idle: 10 * time.Minute, CommandType: hdidle.SCSI},
+		NameMap:  map[string]string{},
+		SkewTime: time.Hour,
+	}
+	clock := &manualClock{now: time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC)}
+	monitor := hdidle.NewMonitor(config, hdidle.MonitorOptions{
+		Clock: clock,
+		Snapshots: func() ([]diskstats.ReadWriteStats, error) {
+			return []diskstats.ReadWriteStats{{Name: "sdx", Reads: 100, Writes: 200}}, nil
+		},
+		Executor: noopExecutor{},
+		Sink: func(event hdidle.Event) {
+			fmt.Printf("%s %s: %s\n", event.Time.Format("15:04"), event.Kind, event.Message)
+		},
+	})
+
+	monitor.Step()
+	clock.now = clock.now.Add(5 * time.Minute)
+	monitor.Step()
+	clock.now = clock.now.Add(6 * time.Minute)
+	monitor.Step()
+	// Output:
+	// 10:11 spindown: sdx spindown
+}
+
+func ExampleMonitor_Events() {
+	config := &hdidle.Config{
+		Defaults: hdidle.DefaultConf{Idle: hdidle.DefaultIdleTime, CommandType: hdidle.AUTO},
+		NameMap:  map[string]string{},
+		SkewTime: 3 * time.Minute,
+	}
+	monitor := hdidle.NewMonitor(config, hdidle.MonitorOptions{})
+	defer monitor.Close()
+	go func() {
+		for event := range monitor.Events() {
+			if event.Kind == hdidle.EventSpindown || event.Kind == hdidle.EventSpinup {
+				log.Printf("%s: %s", event.Disk, event.Kind)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := monitor.Step(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func ExampleDiscover() {
+	disks, err := hdidle.Discover()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, disk := range disks {
+		fmt.Printf("%s %s %s\n", disk.Name, disk.Attributes.Model, disk.CommandType)
+	}
+}
+
+func ExampleSpindownDisk() {
+	state, err := hdidle.QueryPowerState("/dev/sdb", hdidle.ATA, hdidle.ExecConf{}, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if state != sgio.PowerStateStandby {
+		if err := hdidle.SpindownDisk("/dev/sdb", hdidle.ATA, 0, hdidle.ExecConf{}, false); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
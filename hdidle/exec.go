@@ -0,0 +1,172 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package hdidle
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/adelolmo/hd-idle/sgio"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ExecConf holds the command templates of the exec command type. The
+// templates are split on white space and run without a shell. {device},
+// {name}, {hub} and {port} are replaced by the device path, the disk name and
+// the USB hub and port the disk is attached to, e.g. "2-1" and "4" for a disk
+// on port 4 of the hub on port 1 of bus 2.
+type ExecConf struct {
+	Spindown   string
+	Spinup     string
+	PowerState string
+}
+
+// execTimeout is how long a command runs before it is killed. Tests replace it.
+var execTimeout = 30 * time.Second
+
+// execWaitDelay is how long a command killed on timeout gets to release its
+// output, which a child it forked may still hold.
+const execWaitDelay = 5 * time.Second
+
+// spindownExecDisk runs the spin down command of the disk.
+func spindownExecDisk(device string, conf ExecConf) error {
+	if len(conf.Spindown) == 0 {
+		return fmt.Errorf("no exec_spindown command")
+	}
+	_, err := runExec(conf.Spindown, device)
+	return err
+}
+
+// spinupExecDisk runs the spin up command of the disk.
+func spinupExecDisk(device string, conf ExecConf) error {
+	if len(conf.Spinup) == 0 {
+		return fmt.Errorf("no exec_spinup command")
+	}
+	_, err := runExec(conf.Spinup, device)
+	return err
+}
+
+// execPowerState runs the power state command of the disk and reads the
+// state from its output, which has to name it like "hdparm -C" does.
+func execPowerState(device string, conf ExecConf) (sgio.PowerState, error) {
+	if len(conf.PowerState) == 0 {
+		return sgio.PowerStateUnknown, fmt.Errorf("no exec_power_state command")
+	}
+	output, err := runExec(conf.PowerState, device)
+	if err != nil {
+		return sgio.PowerStateUnknown, err
+	}
+	state := parseExecPowerState(output)
+	if state == sgio.PowerStateUnknown {
+		return state, fmt.Errorf("no power state in output of %s: %s", conf.PowerState, strings.TrimSpace(output))
+	}
+	return state, nil
+}
+
+// parseExecPowerState finds the power state in the output of a command:
+// standby or sleeping, active (which covers "active/idle") or idle.
+func parseExecPowerState(output string) sgio.PowerState {
+	output = strings.ToLower(output)
+	switch {
+	case strings.Contains(output, "standby") || strings.Contains(output, "sleeping"):
+		return sgio.PowerStateStandby
+	case strings.Contains(output, "active"):
+		return sgio.PowerStateActive
+	case strings.Contains(output, "idle"):
+		return sgio.PowerStateIdle
+	}
+	return sgio.PowerStateUnknown
+}
+
+// runExec runs the command template for the device and returns its standard
+// output. Failures carry the exit status and the standard error.
+func runExec(template, device string) (string, error) {
+	args := expandExec(template, device)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	/* the children of the command are killed with it on timeout */
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("%s failed: %s", args[0], err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timeout := time.NewTimer(execTimeout)
+	defer timeout.Stop()
+	var err error
+	select {
+	case err = <-done:
+	case <-timeout.C:
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		/* Wait returns once the output is released, don't hang if it never is */
+		select {
+		case <-done:
+		case <-time.After(execWaitDelay):
+		}
+		return "", fmt.Errorf("%s timed out after %v", args[0], execTimeout)
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); len(message) > 0 {
+			return "", fmt.Errorf("%s failed: %s\n%s", args[0], err, message)
+		}
+		return "", fmt.Errorf("%s failed: %s", args[0], err)
+	}
+	return stdout.String(), nil
+}
+
+// expandExec splits the template into arguments and replaces the
+// placeholders in each of them.
+func expandExec(template, device string) []string {
+	name := device
+	if path, err := filepath.EvalSymlinks(device); err == nil {
+		name = path
+	}
+	name = filepath.Base(name)
+	var hub, port string
+	if attributes, err := diskAttributes(name); err == nil {
+		hub, port = splitUsbPort(attributes.UsbPort)
+	}
+
+	replacer := strings.NewReplacer("{device}", device, "{name}", name, "{hub}", hub, "{port}", port)
+	args := strings.Fields(template)
+	for i := range args {
+		args[i] = replacer.Replace(args[i])
+	}
+	return args
+}
+
+// splitUsbPort splits a USB device name into the hub and the port of the hub
+// the device is attached to: "2-1.4" is port 4 of hub "2-1", "2-1" port 1
+// of the root hub of bus 2.
+func splitUsbPort(usbPort string) (string, string) {
+	if i := strings.LastIndexAny(usbPort, ".-"); i >= 0 {
+		return usbPort[:i], usbPort[i+1:]
+	}
+	return "", ""
+}
@@ -0,0 +1,113 @@
+package hdidle
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/sgio"
+	"github.com/adelolmo/hd-idle/sysfs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExecPowerState(t *testing.T) {
+	tests := []struct {
+		output string
+		want   sgio.PowerState
+	}{
+		{"\n/dev/sdc:\n drive state is:  standby\n", sgio.PowerStateStandby},
+		{"\n/dev/sdc:\n drive state is:  active/idle\n", sgio.PowerStateActive},
+		{"\n/dev/sdc:\n drive state is:  sleeping\n", sgio.PowerStateStandby},
+		{"IDLE\n", sgio.PowerStateIdle},
+		{"unknown\n", sgio.PowerStateUnknown},
+	}
+	for _, tt := range tests {
+		if got := parseExecPowerState(tt.output); got != tt.want {
+			t.Errorf("parseExecPowerState(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestExpandExec(t *testing.T) {
+	defer func(original func(string) (sysfs.Attributes, error)) { diskAttributes = original }(diskAttributes)
+	diskAttributes = func(diskName string) (sysfs.Attributes, error) {
+		if diskName != "sdzz" {
+			return sysfs.Attributes{}, fmt.Errorf("cannot find block device %s", diskName)
+		}
+		return sysfs.Attributes{Name: diskName, Transport: sysfs.TransportUsb, UsbPort: "2-1.4"}, nil
+	}
+
+	expected := []string{"uhubctl", "-a", "off", "-l", "2-1", "-p", "4", "--name=sdzz", "/dev/sdzz"}
+	if args := expandExec("uhubctl -a off -l {hub} -p {port}  --name={name} {device}", "/dev/sdzz"); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Expected %v but found %v", expected, args)
+	}
+	expected = []string{"hdparm", "-y", "/dev/sdyy", "", ""}
+	if args := expandExec("hdparm -y {device} {hub} {port}", "/dev/sdyy"); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Expected %v but found %v", expected, args)
+	}
+}
+
+func TestSplitUsbPort(t *testing.T) {
+	tests := []struct {
+		usbPort, hub, port string
+	}{
+		{"2-1.4", "2-1", "4"},
+		{"2-1.4.3", "2-1.4", "3"},
+		{"2-1", "2", "1"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if hub, port := splitUsbPort(tt.usbPort); hub != tt.hub || port != tt.port {
+			t.Errorf("splitUsbPort(%s) = %s, %s, want %s, %s", tt.usbPort, hub, port, tt.hub, tt.port)
+		}
+	}
+}
+
+func TestRunExec(t *testing.T) {
+	output, err := runExec("echo drive state is: standby", "/dev/sdzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "drive state is: standby\n" {
+		t.Fatalf("Unexpected output %q", output)
+	}
+
+	_, err = runExec("ls /nonexistent/{name}", "/dev/sdzz")
+	if err == nil || !strings.HasPrefix(err.Error(), "ls failed: exit status") || !strings.Contains(err.Error(), "sdzz") {
+		t.Fatalf("Expected the exit status and stderr in the error but found %v", err)
+	}
+}
+
+func TestRunExecTimeout(t *testing.T) {
+	defer func(original time.Duration) { execTimeout = original }(execTimeout)
+	execTimeout = 100 * time.Millisecond
+	/* the child holds the output of the command */
+	script := filepath.Join(t.TempDir(), "spindown.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nsleep 60 &\nsleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := runExec(script, "/dev/sdzz")
+	if expected := script + " timed out after 100ms"; err == nil || err.Error() != expected {
+		t.Fatalf("Expected %v but found %v", expected, err)
+	}
+	if elapsed := time.Since(start); elapsed >= execWaitDelay {
+		t.Fatalf("Expected the command and its child to be killed but it took %v", elapsed)
+	}
+}
+
+func TestExecPowerState(t *testing.T) {
+	state, err := execPowerState("/dev/sdzz", ExecConf{PowerState: "echo active/idle"})
+	if err != nil || state != sgio.PowerStateActive {
+		t.Fatalf("Expected active but found %v, %v", state, err)
+	}
+	if _, err := execPowerState("/dev/sdzz", ExecConf{PowerState: "echo"}); err == nil {
+		t.Fatal("Expected an error for output without power state")
+	}
+	if _, err := execPowerState("/dev/sdzz", ExecConf{}); err == nil {
+		t.Fatal("Expected an error without power state command")
+	}
+}
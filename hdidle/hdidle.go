@@ -0,0 +1,988 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package hdidle
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/io"
+	"github.com/adelolmo/hd-idle/nvme"
+	"github.com/adelolmo/hd-idle/sgio"
+	"github.com/adelolmo/hd-idle/sysfs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	SCSI       = "scsi"
+	ATA        = "ata"
+	AUTO       = "auto"
+	NVME       = "nvme"
+	HDIO       = "hdio"
+	EXEC       = "exec"
+	dateFormat = "2006-01-02T15:04:05"
+
+	// DefaultIdleTime is the idle time of the disks not configured otherwise
+	DefaultIdleTime = 600 * time.Second
+
+	// resume policies, what is done with a disk which was spun down when the
+	// system was suspended or hibernated
+	ResumeReset   = "reset"
+	ResumeRestore = "restore"
+	ResumeVerify  = "verify"
+)
+
+type DefaultConf struct {
+	Idle                    time.Duration
+	CommandType             string
+	PowerCondition          uint8
+	Debug                   bool
+	LogFile                 string
+	SymlinkPolicy           int
+	IgnoreSpinDownDetection bool
+	QueryPowerState         bool
+	SpinupOnPendingIo       bool
+	FirmwareStandby         *time.Duration
+	ApmLevel                uint8
+	ResumePolicy            string
+	Exec                    ExecConf
+	QuirksFile              string
+	// StateFile keeps the state of the disks across restarts, empty
+	// doesn't keep it
+	StateFile string
+	// MetricsFile is written with the metrics of the disks in the text
+	// format of Prometheus when they change, empty doesn't write it
+	MetricsFile string
+	// MaxFailures is the number of spin downs failing in a row after which
+	// spin down is suspended for the disk, 0 never suspends it
+	MaxFailures int
+}
+
+type DeviceConf struct {
+	Name              string
+	GivenName         string
+	Idle              time.Duration
+	CommandType       string
+	PowerCondition    uint8
+	QueryPowerState   bool
+	SpinupOnPendingIo bool
+	// FirmwareStandby is the standby timer programmed into the drive, nil
+	// leaves the drive as it is
+	FirmwareStandby *time.Duration
+	// ApmLevel is the APM level programmed into the drive, 0 leaves the
+	// drive as it is
+	ApmLevel uint8
+	// ResumePolicy is ResumeReset, ResumeRestore or ResumeVerify, empty is
+	// ResumeReset
+	ResumePolicy string
+	Exec         ExecConf
+	Selector     DeviceSelector
+}
+
+// DeviceSelector restricts a device configuration to the disks whose sysfs
+// attributes match. Model, Vendor, Serial, WWID and Transport are glob
+// patterns. Empty fields match any disk.
+type DeviceSelector struct {
+	Model      string
+	Vendor     string
+	Serial     string
+	WWID       string
+	Transport  string
+	Removable  *bool
+	Rotational *bool
+}
+
+// diskAttributes reads the sysfs attributes of a disk. Tests replace it.
+var diskAttributes = func(diskName string) (sysfs.Attributes, error) {
+	return sysfs.ReadAttributes(sysfs.ClassBlock, diskName)
+}
+
+// usbBridge looks up the USB bridge of a disk in the quirk tables. Tests
+// replace it.
+var usbBridge = sgio.UsbBridge
+
+// sgDevice tells whether a disk supports SG_IO. Tests replace it.
+var sgDevice = sgio.IsSgDevice
+
+// resolveDisks returns the disks a device name is stored on. Tests replace it.
+var resolveDisks = io.Disks
+
+type Config struct {
+	Devices  []DeviceConf
+	Defaults DefaultConf
+	// SkewTime is the wall clock gap between two polls taken for a suspend
+	// where the boot clock cannot be read, three poll intervals if zero
+	SkewTime time.Duration
+	NameMap  map[string]string
+}
+
+func (c *Config) resolveDeviceGivenName(name string) string {
+	if givenName, ok := c.NameMap[name]; ok {
+		return givenName
+	}
+	return name
+}
+
+// Validate checks the configuration as a whole, once all the options have
+// been applied.
+func (c *Config) Validate() error {
+	if c.Defaults.CommandType == EXEC && len(c.Defaults.Exec.Spindown) == 0 {
+		return fmt.Errorf("command type exec requires exec_spindown")
+	}
+	names := map[string]string{}
+	for _, device := range c.Devices {
+		if device.CommandType == EXEC && len(device.Exec.Spindown) == 0 {
+			return fmt.Errorf("command type exec of device %s requires exec_spindown", device.GivenName)
+		}
+		if len(device.Name) == 0 || IsPattern(device.Name) || !device.Selector.IsEmpty() {
+			continue
+		}
+		if other, ok := names[device.Name]; ok {
+			return fmt.Errorf("devices %s and %s refer to the same disk %s", other, device.GivenName, device.Name)
+		}
+		names[device.Name] = device.GivenName
+	}
+	return nil
+}
+
+// HasDevice tells whether the device with the given name is already
+// configured, by its given name or for the disk.
+func (c *Config) HasDevice(givenName, name string) bool {
+	for _, device := range c.Devices {
+		if device.GivenName == givenName || (len(name) > 0 && !IsPattern(name) && device.Name == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchDevice returns the index of the first device configuration matching
+// the disk, or -1 if the disk falls back to the defaults. Devices are
+// evaluated in order, so the ones given on the command line take precedence
+// over the ones from the configuration files.
+func (c *Config) MatchDevice(diskName string) int {
+	var attributes *sysfs.Attributes
+	unreadable := false
+	for i, device := range c.Devices {
+		if matched, _ := filepath.Match(device.Name, diskName); !matched {
+			continue
+		}
+		if device.Selector.IsEmpty() {
+			return i
+		}
+		if attributes == nil {
+			if unreadable {
+				continue
+			}
+			a, err := diskAttributes(diskName)
+			if err != nil {
+				/* the selector cannot match, a later rule without one may */
+				unreadable = true
+				continue
+			}
+			attributes = &a
+		}
+		if device.Selector.matches(*attributes) {
+			return i
+		}
+	}
+	return -1
+}
+
+// IsEmpty tells whether the selector matches any disk.
+func (s DeviceSelector) IsEmpty() bool {
+	return s == DeviceSelector{}
+}
+
+func (s DeviceSelector) matches(a sysfs.Attributes) bool {
+	return matchesPattern(s.Model, a.Model) &&
+		matchesPattern(s.Vendor, a.Vendor) &&
+		matchesPattern(s.Serial, a.Serial) &&
+		matchesPattern(s.WWID, a.WWID) &&
+		matchesPattern(s.Transport, a.Transport) &&
+		(s.Removable == nil || *s.Removable == a.Removable) &&
+		(s.Rotational == nil || *s.Rotational == a.Rotational)
+}
+
+func matchesPattern(pattern, value string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	matched, _ := filepath.Match(pattern, value)
+	return matched
+}
+
+// IsPattern tells whether a device name is a glob pattern like sd[c-f].
+func IsPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+type DiskStats struct {
+	Name      string
+	GivenName string
+	// Identity tells the disk apart from another one showing up under the
+	// same name, see sysfs.Attributes.Identity
+	Identity    string
+	IdleTime    time.Duration
+	CommandType string
+	// AutoCommandType is set when CommandType was detected rather than
+	// configured, and may still be switched if the disk rejects it
+	AutoCommandType   bool
+	PowerCondition    uint8
+	QueryPowerState   bool
+	SpinupOnPendingIo bool
+	FirmwareStandby   *time.Duration
+	ApmLevel          uint8
+	ResumePolicy      string
+	Exec              ExecConf
+	Reads             uint64
+	Writes            uint64
+	InFlight          uint64
+	SpinDownAt        time.Time
+	SpinUpAt          time.Time
+	LastIoAt          time.Time
+	LastSpunDownAt    time.Time
+	PowerCheckAt      time.Time
+	SpunDown          bool
+	// CommandInProgress is set while a spin down command runs in a worker,
+	// so that it is not sent again until it completes
+	CommandInProgress bool
+	CommandStartedAt  time.Time
+	// Failures counts the spin downs which failed in a row, TotalFailures
+	// all of them
+	Failures      int
+	TotalFailures int
+	LastError     string
+	LastErrorAt   time.Time
+	// RetryAt is when a failed spin down is sent again
+	RetryAt time.Time
+	// Suspended is set when spin down was given up for the disk after
+	// MaxFailures failures in a row
+	Suspended bool
+	// firmwarePending is set when the firmware settings are to be applied
+	// once the disk spins up
+	firmwarePending bool
+	// hungCommand is closed once a command runCommand gave up waiting for
+	// completes
+	hungCommand chan struct{}
+}
+
+// Step polls the activity of the disks once, spins down the ones idle for
+// longer than their idle time and takes the results of the spin downs
+// completed since the previous step. If the activity cannot be read, Step
+// returns the error and does nothing else.
+func (m *Monitor) Step() error {
+	actualSnapshot, err := m.snapshots()
+	if err != nil {
+		return fmt.Errorf("cannot read disk activity: %w", err)
+	}
+
+	m.now = m.clock.Now()
+	if m.suspendedFor = m.timeSuspended(); m.suspendedFor > 0 {
+		m.emit(EventResume, "", "resumed after being suspended for %v", m.suspendedFor.Round(time.Second))
+	}
+	m.collectSpindowns()
+	m.resolveSymlinks()
+	for _, stats := range actualSnapshot {
+		d := &DiskStats{
+			Name:     stats.Name,
+			Reads:    stats.Reads,
+			Writes:   stats.Writes,
+			InFlight: stats.InFlight,
+		}
+		m.updateState(*d)
+	}
+	m.dropMissingDisks(actualSnapshot)
+	m.saveMetrics()
+	m.lastNow = m.now
+	return nil
+}
+
+func (m *Monitor) resolveSymlinks() {
+	if m.config.Defaults.SymlinkPolicy == 0 {
+		return
+	}
+	m.resolveDevices(func(device DeviceConf) bool {
+		return len(device.Name) == 0
+	})
+}
+
+// resolveDevices resolves the given names of the devices accepted again and
+// updates the ones whose disks changed, with a copy of the device
+// configuration for every disk it is stored on.
+func (m *Monitor) resolveDevices(accept func(device DeviceConf) bool) {
+	var devices []DeviceConf
+	for i := 0; i < len(m.config.Devices); {
+		device := m.config.Devices[i]
+		/* the copies of a device stored on several disks follow each other */
+		copies := i + 1
+		for copies < len(m.config.Devices) && m.config.Devices[copies].GivenName == device.GivenName {
+			copies++
+		}
+		group := m.config.Devices[i:copies]
+		i = copies
+		if !accept(device) {
+			devices = append(devices, group...)
+			continue
+		}
+		disks, err := resolveDisks(device.GivenName)
+		if err != nil {
+			m.debugf("Cannot resolve device: %s", err)
+		}
+		if err != nil || sameDisks(group, disks) {
+			devices = append(devices, group...)
+			continue
+		}
+		for _, old := range group {
+			if m.config.NameMap[old.Name] == device.GivenName {
+				delete(m.config.NameMap, old.Name)
+			}
+		}
+		for _, disk := range disks {
+			device.Name = disk
+			devices = append(devices, device)
+			if !IsPattern(disk) {
+				m.config.NameMap[disk] = device.GivenName
+			}
+		}
+		logToFile(m.config.Defaults.LogFile,
+			fmt.Sprintf("symlink %s resolved to %s", device.GivenName, strings.Join(disks, ", ")))
+	}
+	m.config.Devices = devices
+}
+
+func sameDisks(devices []DeviceConf, disks []string) bool {
+	if len(devices) != len(disks) {
+		return false
+	}
+	for i := range devices {
+		if devices[i].Name != disks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Monitor) updateState(tmp DiskStats) {
+	dsi := m.diskIndex(tmp.Name)
+	if dsi < 0 {
+		m.disks = append(m.disks, m.initDevice(tmp))
+		return
+	}
+
+	if m.suspendedFor > 0 {
+		m.resumeDisk(dsi, tmp)
+	}
+
+	ds := m.disks[dsi]
+	if tmp.Reads < ds.Reads || tmp.Writes < ds.Writes {
+		if diskIdentity(tmp.Name) != ds.Identity {
+			/* the counters started over, another disk took the name */
+			m.emit(EventInfo, ds.Name, "%s is another disk now", m.config.resolveDeviceGivenName(ds.Name))
+			m.disks[dsi] = m.initDevice(tmp)
+			return
+		}
+		/* a partition or holder went away and its activity with it */
+		m.debugf("disk=%s counters dropped, taking them as the new baseline", ds.Name)
+		m.disks[dsi].Reads = tmp.Reads
+		m.disks[dsi].Writes = tmp.Writes
+		ds = m.disks[dsi]
+	}
+	if ds.Writes == tmp.Writes && ds.Reads == tmp.Reads {
+		if ds.SpunDown && !ds.CommandInProgress && ds.SpinupOnPendingIo && tmp.InFlight > 0 {
+			/* requests are waiting for a disk which doesn't start on its own */
+			m.spinupPendingDisk(dsi, tmp.InFlight)
+			ds = m.disks[dsi]
+		}
+		if ds.CommandInProgress {
+			m.reportStuckCommand(ds)
+		} else if ds.QueryPowerState && m.now.Sub(ds.PowerCheckAt) >= powerCheckInterval(ds) {
+			m.syncPowerState(dsi)
+			ds = m.disks[dsi]
+		}
+		if !ds.CommandInProgress && (!ds.SpunDown || m.config.Defaults.IgnoreSpinDownDetection) {
+
+			idleDuration := m.now.Sub(ds.LastIoAt)
+			timeSinceLastSpunDown := m.now.Sub(ds.LastSpunDownAt)
+
+			if ds.IdleTime != 0 && len(ds.CommandType) > 0 && !ds.Suspended && !m.now.Before(ds.RetryAt) &&
+				!m.disks[dsi].commandHung() &&
+				idleDuration > ds.IdleTime && timeSinceLastSpunDown > ds.IdleTime &&
+				/* the command runs in a worker, finishSpindown takes its result */
+				m.submitSpindown(ds) {
+				if ds.SpunDown && m.config.Defaults.IgnoreSpinDownDetection {
+					m.emit(EventSpindown, ds.Name, "%s spindown (ignoring prior spin down state)",
+						m.config.resolveDeviceGivenName(ds.Name))
+				} else {
+					m.emit(EventSpindown, ds.Name, "%s spindown",
+						m.config.resolveDeviceGivenName(ds.Name))
+				}
+				if ds.CommandType == EXEC {
+					m.debugf("disk=%s running %s", ds.Name, ds.Exec.Spindown)
+				}
+				m.disks[dsi].CommandInProgress = true
+				m.disks[dsi].CommandStartedAt = m.now
+			}
+		}
+
+	} else {
+		/* disk had some activity */
+		if ds.SpunDown {
+			/* disk was spun down, thus it has just spun up */
+			m.emit(EventSpinup, ds.Name, "%s spinup", m.config.resolveDeviceGivenName(ds.Name))
+			m.logSpinup(ds)
+			m.disks[dsi].SpinUpAt = m.now
+		}
+		m.disks[dsi].Reads = tmp.Reads
+		m.disks[dsi].Writes = tmp.Writes
+		m.disks[dsi].LastIoAt = m.now
+		m.spunUp(dsi)
+	}
+
+	if m.config.Defaults.Debug {
+		ds = m.disks[dsi]
+		idleDuration := m.now.Sub(ds.LastIoAt)
+		m.debugf("disk=%s command=%s method=%s spunDown=%t inProgress=%t failures=%d suspended=%t "+
+			"reads=%d writes=%d idleTime=%v idleDuration=%v "+
+			"spindown=%s spinup=%s lastIO=%s lastSpunDown=%s",
+			ds.Name, ds.CommandType, commandMethod(ds), ds.SpunDown, ds.CommandInProgress, ds.Failures, ds.Suspended,
+			ds.Reads, ds.Writes, ds.IdleTime.Seconds(), math.RoundToEven(idleDuration.Seconds()),
+			ds.SpinDownAt.Format(dateFormat), ds.SpinUpAt.Format(dateFormat), ds.LastIoAt.Format(dateFormat),
+			ds.LastSpunDownAt.Format(dateFormat))
+	}
+}
+
+// spinupPendingDisk starts a spun down disk with requests pending. Disks like
+// SAS disks stopped with power condition 0 don't start on access, so their
+// requests stay in flight while reads and writes don't advance. The spin up is
+// logged as usual once the requests complete.
+func (m *Monitor) spinupPendingDisk(dsi int, inFlight uint64) {
+	ds := m.disks[dsi]
+	m.emit(EventInfo, ds.Name, "%s starting, %d requests pending", m.config.resolveDeviceGivenName(ds.Name), inFlight)
+	err := m.runCommand(&m.disks[dsi], func() error {
+		return m.executor.Spinup(ds, m.config.Defaults.Debug)
+	})
+	if err != nil {
+		m.emit(EventInfo, ds.Name, "%s", err)
+	}
+	m.disks[dsi].LastIoAt = m.now
+}
+
+// syncPowerState corrects the spun down state of the disk with the power state
+// reported by the drive. Drives are woken up by activity which never shows up
+// in /proc/diskstats, e.g. SMART queries, and spun down by their own timers.
+func (m *Monitor) syncPowerState(dsi int) {
+	ds := m.disks[dsi]
+	m.disks[dsi].PowerCheckAt = m.now
+	state, err := m.queryPowerState(&m.disks[dsi])
+	if err != nil {
+		m.debugf("cannot query power state of disk %s: %s", ds.Name, err)
+		return
+	}
+	spunDown := isSpunDown(state, ds.CommandType, ds.PowerCondition)
+	switch {
+	case ds.SpunDown && !spunDown && state != sgio.PowerStateUnknown:
+		m.emit(EventSpinup, ds.Name, "%s spinup, drive reports %s", m.config.resolveDeviceGivenName(ds.Name), state)
+		m.logSpinup(ds)
+		m.disks[dsi].SpinUpAt = m.now
+		m.disks[dsi].LastIoAt = m.now
+		m.spunUp(dsi)
+	case !ds.SpunDown && spunDown:
+		m.emit(EventSpindown, ds.Name, "%s spindown, drive reports %s", m.config.resolveDeviceGivenName(ds.Name), state)
+		m.disks[dsi].SpinDownAt = m.now
+		m.disks[dsi].SpunDown = true
+	}
+}
+
+// powerCheckInterval is how often the power state of a disk is re-synced.
+func powerCheckInterval(ds DiskStats) time.Duration {
+	if ds.IdleTime == 0 {
+		return DefaultIdleTime
+	}
+	return ds.IdleTime
+}
+
+// isSpunDown tells whether the drive reached the power state hd-idle sends it
+// to. SCSI disks told to go idle (power conditions 2 and 0xa) report idle.
+func isSpunDown(state sgio.PowerState, command string, powerCondition uint8) bool {
+	if state == sgio.PowerStateStandby {
+		return true
+	}
+	return state == sgio.PowerStateIdle && command == SCSI && (powerCondition == 2 || powerCondition == 0xa)
+}
+
+func (m *Monitor) diskIndex(diskName string) int {
+	for i, stats := range m.disks {
+		if stats.Name == diskName {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Monitor) initDevice(stats DiskStats) DiskStats {
+	idle := m.config.Defaults.Idle
+	command := m.config.Defaults.CommandType
+	powerCondition := m.config.Defaults.PowerCondition
+	queryPowerState := m.config.Defaults.QueryPowerState
+	spinupOnPendingIo := m.config.Defaults.SpinupOnPendingIo
+	firmwareStandby := m.config.Defaults.FirmwareStandby
+	apmLevel := m.config.Defaults.ApmLevel
+	resumePolicy := m.config.Defaults.ResumePolicy
+	execConf := m.config.Defaults.Exec
+	deviceConf := m.config.DeviceConfig(stats.Name)
+	if deviceConf != nil {
+		idle = deviceConf.Idle
+		command = deviceConf.CommandType
+		powerCondition = deviceConf.PowerCondition
+		queryPowerState = deviceConf.QueryPowerState
+		spinupOnPendingIo = deviceConf.SpinupOnPendingIo
+		firmwareStandby = deviceConf.FirmwareStandby
+		apmLevel = deviceConf.ApmLevel
+		resumePolicy = deviceConf.ResumePolicy
+		execConf = deviceConf.Exec
+	}
+	autoCommand := command == AUTO
+	command = CommandTypeFor(stats.Name, command)
+	if len(command) == 0 {
+		m.debugf("disk=%s spindown not supported", stats.Name)
+	}
+	if autoCommand && len(command) > 0 {
+		m.debugf("disk=%s detected command type %s", stats.Name, command)
+	}
+
+	ds := DiskStats{
+		Name:              stats.Name,
+		Identity:          diskIdentity(stats.Name),
+		LastIoAt:          m.now,
+		SpinUpAt:          m.now,
+		SpunDown:          false,
+		Writes:            stats.Writes,
+		Reads:             stats.Reads,
+		IdleTime:          idle,
+		CommandType:       command,
+		AutoCommandType:   autoCommand && len(command) > 0,
+		PowerCondition:    powerCondition,
+		QueryPowerState:   queryPowerState && len(command) > 0,
+		SpinupOnPendingIo: spinupOnPendingIo && len(command) > 0,
+		FirmwareStandby:   firmwareStandby,
+		ApmLevel:          apmLevel,
+		ResumePolicy:      resumePolicy,
+		Exec:              execConf,
+	}
+	ds = m.restoreDisk(ds)
+	if previous, ok := m.departed[ds.Identity]; ok && len(ds.Identity) > 0 {
+		/* the disk was removed, or dropped on a poll, and is back */
+		delete(m.departed, ds.Identity)
+		ds = takeOverState(ds, previous)
+		m.debugf("disk=%s state of %s taken over", ds.Name, previous.Name)
+	}
+	m.applyFirmwareSettings(&ds)
+	if ds.QueryPowerState {
+		/* the disk may already be asleep when hd-idle starts */
+		ds.PowerCheckAt = m.now
+		state, err := m.queryPowerState(&ds)
+		if err != nil {
+			m.debugf("cannot query power state of disk %s: %s", ds.Name, err)
+		}
+		if err == nil && isSpunDown(state, ds.CommandType, ds.PowerCondition) {
+			ds.SpinDownAt = m.now
+			ds.SpunDown = true
+		}
+	}
+	return ds
+}
+
+// reconfigureDisks applies the device configuration to the disks already being
+// monitored. Timers and spin down state are kept as they are.
+func (m *Monitor) reconfigureDisks() {
+	for i := range m.disks {
+		deviceConf := m.config.DeviceConfig(m.disks[i].Name)
+		m.disks[i].IdleTime = deviceConf.Idle
+		if deviceConf.CommandType != AUTO || !m.disks[i].AutoCommandType {
+			/* a detected command type is kept, the disk may have rejected the other one */
+			m.disks[i].CommandType = CommandTypeFor(m.disks[i].Name, deviceConf.CommandType)
+			m.disks[i].AutoCommandType = deviceConf.CommandType == AUTO && len(m.disks[i].CommandType) > 0
+		}
+		/* a reload resumes the disks whose spin down was suspended */
+		m.disks[i].Failures = 0
+		m.disks[i].RetryAt = time.Time{}
+		m.disks[i].Suspended = false
+		m.disks[i].PowerCondition = deviceConf.PowerCondition
+		m.disks[i].Exec = deviceConf.Exec
+		m.disks[i].ResumePolicy = deviceConf.ResumePolicy
+		m.disks[i].QueryPowerState = deviceConf.QueryPowerState && len(m.disks[i].CommandType) > 0
+		m.disks[i].SpinupOnPendingIo = deviceConf.SpinupOnPendingIo && len(m.disks[i].CommandType) > 0
+		if !sameDuration(m.disks[i].FirmwareStandby, deviceConf.FirmwareStandby) ||
+			m.disks[i].ApmLevel != deviceConf.ApmLevel {
+			m.disks[i].FirmwareStandby = deviceConf.FirmwareStandby
+			m.disks[i].ApmLevel = deviceConf.ApmLevel
+			m.applyFirmwareSettings(&m.disks[i])
+		}
+	}
+}
+
+func sameDuration(a, b *time.Duration) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// applyFirmwareSettings programs the standby timer and the APM level of the
+// drive, see Executor.ApplyFirmwareSettings. Programming the drive spins it
+// up, so a disk spun down is programmed once it spins up, see spunUp.
+func (m *Monitor) applyFirmwareSettings(ds *DiskStats) {
+	if ds.SpunDown {
+		ds.firmwarePending = true
+		return
+	}
+	ds.firmwarePending = false
+	settings := *ds
+	err := m.runCommand(ds, func() error {
+		return m.executor.ApplyFirmwareSettings(settings, m.config.Defaults.Debug)
+	})
+	if err != nil {
+		m.emit(EventInfo, ds.Name, "%s", err)
+	}
+}
+
+// spunUp marks the disk as spun up and applies the firmware settings left
+// pending while it was spun down.
+func (m *Monitor) spunUp(dsi int) {
+	m.disks[dsi].SpunDown = false
+	if m.disks[dsi].firmwarePending {
+		m.applyFirmwareSettings(&m.disks[dsi])
+	}
+}
+
+// CommandTypeFor returns the command type used to spin down the disk, or an
+// empty string if hd-idle has no backend able to spin it down. Any disk can be
+// handled by an external command. Only the disks
+// driven by the SCSI layer (sd, sr) understand the SG_IO commands, only the
+// disks of the old IDE drivers (hd) and libata the HDIO ioctls, and only
+// NVMe namespaces the NVMe admin commands, which are never picked by auto.
+func CommandTypeFor(diskName, commandType string) string {
+	if commandType == EXEC {
+		/* the external command knows how to handle the disk */
+		return EXEC
+	}
+	if strings.HasPrefix(diskName, "nvme") {
+		if commandType == NVME {
+			return NVME
+		}
+		return ""
+	}
+	if strings.HasPrefix(diskName, "hd") {
+		switch commandType {
+		case AUTO, HDIO:
+			return HDIO
+		case ATA:
+			return ATA
+		}
+		return ""
+	}
+	if strings.HasPrefix(diskName, "sd") || strings.HasPrefix(diskName, "sr") {
+		switch commandType {
+		case AUTO:
+			return detectCommandType(diskName)
+		case NVME:
+			return ""
+		}
+		return commandType
+	}
+	return ""
+}
+
+// detectCommandType picks the command type from the way the disk is attached.
+// Disks without SG_IO only understand the HDIO ioctls. Disks behind libata
+// understand ATA PASS-THROUGH, as do disks behind a USB bridge known to pass
+// ATA commands through or driven by uas, which bridges only implement with
+// SAT. Everything else, like SAS disks and usb-storage bridges, gets START
+// STOP UNIT.
+func detectCommandType(diskName string) string {
+	if sg, err := sgDevice(fmt.Sprintf("/dev/%s", diskName)); err == nil && !sg {
+		return HDIO
+	}
+	attributes, err := diskAttributes(diskName)
+	if err != nil {
+		return SCSI
+	}
+	switch attributes.Transport {
+	case sysfs.TransportSata:
+		return ATA
+	case sysfs.TransportUsb:
+		if bridge, ok := usbBridge(fmt.Sprintf("/dev/%s", diskName), false); ok {
+			if bridge.Method == sgio.ScsiStartStop {
+				return SCSI
+			}
+			return ATA
+		}
+		if attributes.UsbDriver == "uas" {
+			return ATA
+		}
+	}
+	return SCSI
+}
+
+// DeviceConfig returns the configuration of the disk, the one of the first
+// device matching it or the defaults.
+func (c *Config) DeviceConfig(diskName string) *DeviceConf {
+	if i := c.MatchDevice(diskName); i >= 0 {
+		device := c.Devices[i]
+		return &device
+	}
+	return &DeviceConf{
+		Name:              diskName,
+		CommandType:       c.Defaults.CommandType,
+		PowerCondition:    c.Defaults.PowerCondition,
+		QueryPowerState:   c.Defaults.QueryPowerState,
+		SpinupOnPendingIo: c.Defaults.SpinupOnPendingIo,
+		FirmwareStandby:   c.Defaults.FirmwareStandby,
+		ApmLevel:          c.Defaults.ApmLevel,
+		ResumePolicy:      c.Defaults.ResumePolicy,
+		Exec:              c.Defaults.Exec,
+		Idle:              c.Defaults.Idle,
+	}
+}
+
+// SpindownDisk spins down the device with the command type and power
+// condition.
+func SpindownDisk(device, command string, powerCondition uint8, execConf ExecConf, debug bool) error {
+	switch command {
+	case SCSI:
+		if err := sgio.StartStopScsiDevice(device, powerCondition); err != nil {
+			return fmt.Errorf("cannot spindown scsi disk %s: %w", device, err)
+		}
+		return nil
+	case ATA:
+		if err := sgio.StopAtaDevice(device, debug); err != nil {
+			return fmt.Errorf("cannot spindown ata disk %s: %w", device, err)
+		}
+		return nil
+	case NVME:
+		if err := nvme.StopDevice(device, debug); err != nil {
+			return fmt.Errorf("cannot spindown nvme disk %s: %w", device, err)
+		}
+		return nil
+	case HDIO:
+		if err := sgio.StopHdioDevice(device, debug); err != nil {
+			return fmt.Errorf("cannot spindown hdio disk %s: %w", device, err)
+		}
+		return nil
+	case EXEC:
+		if err := spindownExecDisk(device, execConf); err != nil {
+			return fmt.Errorf("cannot spindown exec disk %s: %w", device, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// SpindownDetectedDisk spins down a disk with the detected command type. If
+// the disk rejects the command, the other command type is tried. It returns
+// the command type which spun the disk down, or the detected one if the disk
+// did not spin down.
+func SpindownDetectedDisk(device, command string, powerCondition uint8, debug bool) (string, error) {
+	err := SpindownDisk(device, command, powerCondition, ExecConf{}, debug)
+	if err == nil || sgio.Classify(err) != sgio.ErrorClassUnsupported {
+		return command, err
+	}
+	other := ATA
+	if command == ATA {
+		other = SCSI
+	}
+	if err := SpindownDisk(device, other, powerCondition, ExecConf{}, debug); err != nil {
+		return command, err
+	}
+	return other, nil
+}
+
+// commandMethod returns how the spin down command reaches the disk: the ATA
+// transport negotiated with the disk, if any, or the command type itself.
+func commandMethod(ds DiskStats) string {
+	if ds.CommandType == ATA {
+		if method := sgio.MethodName(fmt.Sprintf("/dev/%s", ds.Name)); len(method) > 0 {
+			return method
+		}
+	}
+	return ds.CommandType
+}
+
+// SpinupDisk spins up the device with the command type.
+func SpinupDisk(device, command string, execConf ExecConf, debug bool) error {
+	switch command {
+	case SCSI:
+		if err := sgio.StartScsiDevice(device); err != nil {
+			return fmt.Errorf("cannot spinup scsi disk %s: %w", device, err)
+		}
+		return nil
+	case ATA:
+		if err := sgio.StartAtaDevice(device, debug); err != nil {
+			return fmt.Errorf("cannot spinup ata disk %s: %w", device, err)
+		}
+		return nil
+	case NVME:
+		if err := nvme.StartDevice(device, debug); err != nil {
+			return fmt.Errorf("cannot spinup nvme disk %s: %w", device, err)
+		}
+		return nil
+	case HDIO:
+		if err := sgio.StartHdioDevice(device, debug); err != nil {
+			return fmt.Errorf("cannot spinup hdio disk %s: %w", device, err)
+		}
+		return nil
+	case EXEC:
+		if err := spinupExecDisk(device, execConf); err != nil {
+			return fmt.Errorf("cannot spinup exec disk %s: %w", device, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// QueryPowerState asks the drive for its power state without waking it up.
+func QueryPowerState(device, command string, execConf ExecConf, debug bool) (sgio.PowerState, error) {
+	switch command {
+	case SCSI:
+		return sgio.ScsiPowerState(device, debug)
+	case ATA:
+		return sgio.AtaPowerState(device, debug)
+	case NVME:
+		return nvme.PowerState(device, debug)
+	case HDIO:
+		return sgio.HdioPowerState(device, debug)
+	case EXEC:
+		return execPowerState(device, execConf)
+	}
+	return sgio.PowerStateUnknown, fmt.Errorf("cannot query power state of %s: unsupported command type %s", device, command)
+}
+
+// Status returns a line with the state of every disk being monitored,
+// including the spin down failures.
+func (m *Monitor) Status() []string {
+	var lines []string
+	for _, ds := range m.disks {
+		lines = append(lines, m.diskStatus(ds))
+	}
+	return lines
+}
+
+func (m *Monitor) diskStatus(ds DiskStats) string {
+	text := fmt.Sprintf("disk=%s command=%s method=%s spunDown=%t inProgress=%t idle=%v failures=%d totalFailures=%d suspended=%t",
+		m.config.resolveDeviceGivenName(ds.Name), ds.CommandType, commandMethod(ds), ds.SpunDown, ds.CommandInProgress,
+		m.now.Sub(ds.LastIoAt).Round(time.Second), ds.Failures, ds.TotalFailures, ds.Suspended)
+	if ds.Failures > 0 && !ds.Suspended {
+		text += fmt.Sprintf(" retryAt=%s", ds.RetryAt.Format(dateFormat))
+	}
+	if len(ds.LastError) > 0 {
+		text += fmt.Sprintf(" lastErrorAt=%s lastError=%q", ds.LastErrorAt.Format(dateFormat), ds.LastError)
+	}
+	return text
+}
+
+func (m *Monitor) logSpinup(ds DiskStats) {
+	text := fmt.Sprintf("date: %s, time: %s, disk: %s, running: %d, stopped: %d",
+		m.now.Format("2006-01-02"), m.now.Format("15:04:05"), m.config.resolveDeviceGivenName(ds.Name),
+		int(ds.SpinDownAt.Sub(ds.SpinUpAt).Seconds()), int(m.now.Sub(ds.SpinDownAt).Seconds()))
+	logToFile(m.config.Defaults.LogFile, text)
+}
+
+func (m *Monitor) logSpinupAfterSleep(name string) {
+	text := fmt.Sprintf("date: %s, time: %s, disk: %s, suspended: %d, assuming disk spun up after resume",
+		m.now.Format("2006-01-02"), m.now.Format("15:04:05"), name, int(m.suspendedFor.Seconds()))
+	logToFile(m.config.Defaults.LogFile, text)
+}
+
+func logToFile(file, text string) {
+	if len(file) == 0 {
+		return
+	}
+
+	cacheFile, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatalf("Cannot open file %s. Error: %s", file, err)
+	}
+	if _, err = cacheFile.WriteString(text + "\n"); err != nil {
+		log.Fatalf("Cannot write into file %s. Error: %s", file, err)
+	}
+	err = cacheFile.Close()
+	if err != nil {
+		log.Fatalf("Cannot close file %s. Error: %s", file, err)
+	}
+}
+
+func (c *Config) String() string {
+	var devices string
+	for _, device := range c.Devices {
+		devices += "{" + device.String() + "}"
+	}
+	return fmt.Sprintf("symlinkPolicy=%d, defaultIdle=%v, defaultCommand=%s, defaultPowerCondition=%v, defaultQueryPowerState=%t, defaultSpinupOnPendingIo=%t, debug=%t, logFile=%s, devices=%s, ignoreSpinDownDetection=%t, maxSpindownFailures=%d",
+		c.Defaults.SymlinkPolicy, c.Defaults.Idle.Seconds(), c.Defaults.CommandType, c.Defaults.PowerCondition, c.Defaults.QueryPowerState, c.Defaults.SpinupOnPendingIo, c.Defaults.Debug, c.Defaults.LogFile, devices, c.Defaults.IgnoreSpinDownDetection, c.Defaults.MaxFailures)
+}
+
+func (dc *DeviceConf) String() string {
+	text := fmt.Sprintf("name=%s, givenName=%s, idle=%v, commandType=%s, powerCondition=%v, queryPowerState=%t, spinupOnPendingIo=%t",
+		dc.Name, dc.GivenName, dc.Idle.Seconds(), dc.CommandType, dc.PowerCondition, dc.QueryPowerState, dc.SpinupOnPendingIo)
+	if !dc.Selector.IsEmpty() {
+		text += ", " + dc.Selector.String()
+	}
+	if dc.FirmwareStandby != nil {
+		text += fmt.Sprintf(", firmwareStandby=%v", dc.FirmwareStandby.Seconds())
+	}
+	if dc.ApmLevel != 0 {
+		text += fmt.Sprintf(", apmLevel=%d", dc.ApmLevel)
+	}
+	if len(dc.ResumePolicy) > 0 {
+		text += fmt.Sprintf(", resumePolicy=%s", dc.ResumePolicy)
+	}
+	if len(dc.Exec.Spindown) > 0 {
+		text += fmt.Sprintf(", execSpindown=%s", dc.Exec.Spindown)
+	}
+	if len(dc.Exec.Spinup) > 0 {
+		text += fmt.Sprintf(", execSpinup=%s", dc.Exec.Spinup)
+	}
+	if len(dc.Exec.PowerState) > 0 {
+		text += fmt.Sprintf(", execPowerState=%s", dc.Exec.PowerState)
+	}
+	return text
+}
+
+func (s DeviceSelector) String() string {
+	var selectors []string
+	for _, selector := range []struct{ key, value string }{
+		{"model", s.Model},
+		{"vendor", s.Vendor},
+		{"serial", s.Serial},
+		{"wwid", s.WWID},
+		{"transport", s.Transport},
+	} {
+		if len(selector.value) > 0 {
+			selectors = append(selectors, fmt.Sprintf("%s=%s", selector.key, selector.value))
+		}
+	}
+	if s.Removable != nil {
+		selectors = append(selectors, fmt.Sprintf("removable=%t", *s.Removable))
+	}
+	if s.Rotational != nil {
+		selectors = append(selectors, fmt.Sprintf("rotational=%t", *s.Rotational))
+	}
+	return strings.Join(selectors, ", ")
+}
@@ -0,0 +1,330 @@
+package hdidle
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/diskstats"
+	"github.com/adelolmo/hd-idle/sgio"
+	"github.com/adelolmo/hd-idle/sysfs"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReconfigureDisksKeepsState(t *testing.T) {
+	spunDownAt := testStart.Add(-time.Hour)
+	tm := newTestMonitor(&Config{NameMap: map[string]string{}}, DiskStats{
+		Name:           "sda",
+		IdleTime:       600 * time.Second,
+		CommandType:    SCSI,
+		Reads:          100,
+		Writes:         200,
+		LastIoAt:       spunDownAt,
+		SpinDownAt:     spunDownAt,
+		LastSpunDownAt: spunDownAt,
+		SpunDown:       true,
+	})
+
+	config := &Config{
+		Devices:  []DeviceConf{{Name: "sda", GivenName: "sda", Idle: 300 * time.Second, CommandType: ATA, PowerCondition: 3}},
+		Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI},
+		NameMap:  map[string]string{},
+	}
+	tm.Reconfigure(config)
+
+	ds := tm.disks[0]
+	if ds.IdleTime != 300*time.Second || ds.CommandType != ATA || ds.PowerCondition != 3 {
+		t.Fatalf("Expected new device configuration but found %v", ds)
+	}
+	if !ds.SpunDown || ds.LastIoAt != spunDownAt || ds.SpinDownAt != spunDownAt || ds.Reads != 100 || ds.Writes != 200 {
+		t.Fatalf("Expected state to be kept but found %v", ds)
+	}
+}
+
+func TestMatchDevice(t *testing.T) {
+	attributes := map[string]sysfs.Attributes{
+		"sda": {Name: "sda", Vendor: "ATA", Model: "ST4000DM005-2DP1", Transport: sysfs.TransportSata, Rotational: true},
+		"sdb": {Name: "sdb", Vendor: "WD", Model: "My Book 25EE", Transport: sysfs.TransportUsb, Rotational: true},
+		"sdc": {Name: "sdc", Vendor: "Seagate", Model: "Expansion", Transport: sysfs.TransportUsb, Rotational: true},
+		"sdd": {Name: "sdd", Vendor: "WD", Model: "Elements 25A3", Transport: sysfs.TransportUsb, Rotational: true},
+		"sdg": {Name: "sdg", Vendor: "ATA", Model: "Samsung SSD 860", Transport: sysfs.TransportSata},
+	}
+	defer func(original func(string) (sysfs.Attributes, error)) { diskAttributes = original }(diskAttributes)
+	diskAttributes = func(diskName string) (sysfs.Attributes, error) {
+		a, ok := attributes[diskName]
+		if !ok {
+			return sysfs.Attributes{}, fmt.Errorf("cannot find block device %s", diskName)
+		}
+		return a, nil
+	}
+
+	notRotational := false
+	config := &Config{
+		Devices: []DeviceConf{
+			{Name: "sdd", GivenName: "sdd", Idle: 60 * time.Second},
+			{Name: "*", GivenName: "*", Idle: 900 * time.Second, CommandType: ATA,
+				Selector: DeviceSelector{Vendor: "WD", Transport: sysfs.TransportUsb}},
+			{Name: "sd[c-f]", GivenName: "sd[c-f]", Idle: 300 * time.Second},
+			{Name: "*", GivenName: "*", Idle: 0, Selector: DeviceSelector{Rotational: &notRotational}},
+		},
+		Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI},
+	}
+
+	tests := []struct {
+		disk string
+		want int
+	}{
+		{"sda", -1},
+		{"sdb", 1},
+		{"sdc", 2},
+		{"sdd", 0},
+		{"sdg", 3},
+		{"sde", 2},
+		{"sdz", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.disk, func(t *testing.T) {
+			if got := config.MatchDevice(tt.disk); got != tt.want {
+				t.Fatalf("MatchDevice(%s) = %d, want %d", tt.disk, got, tt.want)
+			}
+		})
+	}
+
+	if dc := config.DeviceConfig("sdb"); dc.Idle != 900*time.Second || dc.CommandType != ATA {
+		t.Fatalf("Unexpected device config for sdb %v", dc)
+	}
+	if dc := config.DeviceConfig("sda"); dc.Idle != DefaultIdleTime || dc.CommandType != SCSI {
+		t.Fatalf("Unexpected device config for sda %v", dc)
+	}
+}
+
+func TestCommandTypeFor(t *testing.T) {
+	tests := []struct {
+		disk string
+		want string
+	}{
+		{"sda", ATA},
+		{"sdaa", ATA},
+		{"sr0", ATA},
+		{"nvme0n1", ""},
+		{"mmcblk0", ""},
+		{"vda", ""},
+		{"xvda", ""},
+	}
+	for _, tt := range tests {
+		if got := CommandTypeFor(tt.disk, ATA); got != tt.want {
+			t.Fatalf("CommandTypeFor(%s) = %s, want %s", tt.disk, got, tt.want)
+		}
+	}
+}
+
+func TestInitDeviceQueriesPowerState(t *testing.T) {
+	config := &Config{
+		Devices:  []DeviceConf{{Name: "sdb", GivenName: "sdb", Idle: time.Minute, CommandType: ATA}},
+		Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI, QueryPowerState: true},
+		NameMap:  map[string]string{},
+	}
+	tm := newTestMonitor(config)
+	tm.executor.state = sgio.PowerStateStandby
+
+	ds := tm.initDevice(DiskStats{Name: "sda"})
+	if !ds.SpunDown || !ds.QueryPowerState {
+		t.Fatalf("Expected sda to start spun down but found %v", ds)
+	}
+	ds = tm.initDevice(DiskStats{Name: "sdb"})
+	if ds.SpunDown || ds.QueryPowerState {
+		t.Fatalf("Expected sdb to start spinning but found %v", ds)
+	}
+	ds = tm.initDevice(DiskStats{Name: "nvme0n1"})
+	if ds.SpunDown || ds.QueryPowerState {
+		t.Fatalf("Expected nvme0n1 not to be queried but found %v", ds)
+	}
+	if sent := tm.executor.sent(); !reflect.DeepEqual(sent, []string{"powerstate sda"}) {
+		t.Fatalf("Expected only sda to be queried but found %v", sent)
+	}
+}
+
+func TestSyncPowerState(t *testing.T) {
+	config := &Config{
+		Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI},
+		NameMap:  map[string]string{},
+	}
+	tests := []struct {
+		name         string
+		spunDown     bool
+		state        sgio.PowerState
+		err          error
+		wantSpunDown bool
+		wantIo       bool
+	}{
+		{name: "woken up unnoticed", spunDown: true, state: sgio.PowerStateActive, wantSpunDown: false, wantIo: true},
+		{name: "still asleep", spunDown: true, state: sgio.PowerStateStandby, wantSpunDown: true},
+		{name: "spun down by the drive", spunDown: false, state: sgio.PowerStateStandby, wantSpunDown: true},
+		{name: "spinning", spunDown: false, state: sgio.PowerStateIdle, wantSpunDown: false},
+		{name: "unknown state", spunDown: true, state: sgio.PowerStateUnknown, wantSpunDown: true},
+		{name: "query failed", spunDown: true, err: fmt.Errorf("no sense"), wantSpunDown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lastIoAt := testStart.Add(-time.Hour)
+			tm := newTestMonitor(config, DiskStats{
+				Name:            "sda",
+				IdleTime:        600 * time.Second,
+				CommandType:     ATA,
+				QueryPowerState: true,
+				LastIoAt:        lastIoAt,
+				SpunDown:        tt.spunDown,
+			})
+			tm.executor.state, tm.executor.stateErr = tt.state, tt.err
+
+			tm.syncPowerState(0)
+
+			ds := tm.disks[0]
+			if ds.SpunDown != tt.wantSpunDown {
+				t.Fatalf("Expected spunDown=%t but found %t", tt.wantSpunDown, ds.SpunDown)
+			}
+			if (ds.LastIoAt != lastIoAt) != tt.wantIo {
+				t.Fatalf("Unexpected last I/O %v", ds.LastIoAt)
+			}
+			if ds.PowerCheckAt != testStart {
+				t.Fatalf("Expected power check at %v but found %v", testStart, ds.PowerCheckAt)
+			}
+		})
+	}
+}
+
+func TestIsSpunDown(t *testing.T) {
+	tests := []struct {
+		state          sgio.PowerState
+		command        string
+		powerCondition uint8
+		want           bool
+	}{
+		{sgio.PowerStateStandby, ATA, 0, true},
+		{sgio.PowerStateIdle, ATA, 0, false},
+		{sgio.PowerStateActive, SCSI, 0, false},
+		{sgio.PowerStateIdle, SCSI, 0, false},
+		{sgio.PowerStateIdle, SCSI, 2, true},
+		{sgio.PowerStateStandby, SCSI, 3, true},
+		{sgio.PowerStateUnknown, SCSI, 3, false},
+	}
+	for _, tt := range tests {
+		if got := isSpunDown(tt.state, tt.command, tt.powerCondition); got != tt.want {
+			t.Errorf("isSpunDown(%v, %s, %d) = %t, want %t", tt.state, tt.command, tt.powerCondition, got, tt.want)
+		}
+	}
+}
+
+func TestDetectCommandType(t *testing.T) {
+	attributes := map[string]sysfs.Attributes{
+		"sda": {Name: "sda", Transport: sysfs.TransportSata},
+		"sdb": {Name: "sdb", Transport: sysfs.TransportSas},
+		"sdc": {Name: "sdc", Transport: sysfs.TransportUsb, UsbDriver: "uas"},
+		"sdd": {Name: "sdd", Transport: sysfs.TransportUsb, UsbDriver: "usb-storage"},
+		"sde": {Name: "sde", Transport: sysfs.TransportUsb, UsbDriver: "usb-storage"},
+		"sdf": {Name: "sdf", Transport: sysfs.TransportUsb, UsbDriver: "uas"},
+		"sdg": {Name: "sdg", Transport: sysfs.TransportSata},
+	}
+	bridges := map[string]sgio.Quirk{
+		"/dev/sde": {Name: "JMicron JMS578", Method: sgio.Sat12},
+		"/dev/sdf": {Name: "Realtek RTL9201", Method: sgio.ScsiStartStop},
+	}
+	defer func(original func(string) (sysfs.Attributes, error)) { diskAttributes = original }(diskAttributes)
+	diskAttributes = func(diskName string) (sysfs.Attributes, error) {
+		a, ok := attributes[diskName]
+		if !ok {
+			return sysfs.Attributes{}, fmt.Errorf("cannot find block device %s", diskName)
+		}
+		return a, nil
+	}
+	defer func(original func(string, bool) (sgio.Quirk, bool)) { usbBridge = original }(usbBridge)
+	usbBridge = func(device string, debug bool) (sgio.Quirk, bool) {
+		q, ok := bridges[device]
+		return q, ok
+	}
+	defer func(original func(string) (bool, error)) { sgDevice = original }(sgDevice)
+	sgDevice = func(device string) (bool, error) {
+		if device == "/dev/sdz" {
+			return false, fmt.Errorf("no such file or directory")
+		}
+		return device != "/dev/sdg", nil
+	}
+
+	tests := []struct {
+		disk string
+		want string
+	}{
+		{"sda", ATA},
+		{"sdb", SCSI},
+		{"sdc", ATA},
+		{"sdd", SCSI},
+		{"sde", ATA},
+		{"sdf", SCSI},
+		{"sdg", HDIO},
+		{"sdz", SCSI},
+	}
+	for _, tt := range tests {
+		if got := CommandTypeFor(tt.disk, AUTO); got != tt.want {
+			t.Errorf("CommandTypeFor(%s, auto) = %s, want %s", tt.disk, got, tt.want)
+		}
+	}
+	if got := CommandTypeFor("nvme0n1", AUTO); got != "" {
+		t.Errorf("Expected no command type for nvme0n1 but found %s", got)
+	}
+}
+
+func TestCommandTypeForNvmeAndIde(t *testing.T) {
+	tests := []struct {
+		disk    string
+		command string
+		want    string
+	}{
+		{"nvme0n1", NVME, NVME},
+		{"nvme0n1", SCSI, ""},
+		{"nvme0n1", AUTO, ""},
+		{"sda", NVME, ""},
+		{"sda", ATA, ATA},
+		{"mmcblk0", NVME, ""},
+		{"hda", AUTO, HDIO},
+		{"hda", HDIO, HDIO},
+		{"hda", ATA, ATA},
+		{"hda", SCSI, ""},
+	}
+	for _, tt := range tests {
+		if got := CommandTypeFor(tt.disk, tt.command); got != tt.want {
+			t.Errorf("CommandTypeFor(%s, %s) = %s, want %s", tt.disk, tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	defer func(original func() ([]diskstats.ReadWriteStats, error)) { readDiskstats = original }(readDiskstats)
+	readDiskstats = func() ([]diskstats.ReadWriteStats, error) {
+		return []diskstats.ReadWriteStats{{Name: "sda"}, {Name: "sdb"}, {Name: "nvme0n1"}}, nil
+	}
+	attributes := map[string]sysfs.Attributes{
+		"sda":     {Name: "sda", Transport: sysfs.TransportSata},
+		"nvme0n1": {Name: "nvme0n1", Transport: sysfs.TransportNvme},
+	}
+	defer func(original func(string) (sysfs.Attributes, error)) { diskAttributes = original }(diskAttributes)
+	diskAttributes = func(diskName string) (sysfs.Attributes, error) {
+		a, ok := attributes[diskName]
+		if !ok {
+			return sysfs.Attributes{}, fmt.Errorf("cannot find block device %s", diskName)
+		}
+		return a, nil
+	}
+	defer func(original func(string) (bool, error)) { sgDevice = original }(sgDevice)
+	sgDevice = func(device string) (bool, error) { return true, nil }
+
+	disks, err := Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Disk{
+		{Name: "sda", Attributes: attributes["sda"], CommandType: ATA},
+		{Name: "nvme0n1", Attributes: attributes["nvme0n1"]},
+	}
+	if !reflect.DeepEqual(disks, expected) {
+		t.Fatalf("Expected %+v but found %+v", expected, disks)
+	}
+}
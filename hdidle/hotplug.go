@@ -0,0 +1,151 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package hdidle
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/diskstats"
+	"github.com/adelolmo/hd-idle/sgio"
+	"github.com/adelolmo/hd-idle/uevent"
+	"strings"
+)
+
+// HandleEvent updates the monitored disks on a uevent of the kernel.
+func (m *Monitor) HandleEvent(event uevent.Event) {
+	m.now = m.clock.Now()
+	m.debugf("disk=%s event=%s", event.DevName, event.Action)
+	switch event.Action {
+	case uevent.ActionRemove:
+		m.removeDisk(event.DevName)
+	case uevent.ActionAdd:
+		/* the disk may be one named by a symlink, which pointed elsewhere so far */
+		m.reresolveSymlinks()
+		m.addDisk(event.DevName)
+	case uevent.ActionChange:
+		m.addDisk(event.DevName)
+	}
+}
+
+// addDisk starts monitoring a disk right away instead of on the next poll. A
+// disk already monitored under the name is started over if it is another
+// disk now. A disk monitored before, under another name or until it was
+// removed, keeps its state, see initDevice.
+func (m *Monitor) addDisk(name string) {
+	identity := diskIdentity(name)
+	dsi := m.diskIndex(name)
+	if dsi >= 0 && (len(identity) == 0 || m.disks[dsi].Identity == identity) {
+		return
+	}
+	snapshot, err := m.snapshots()
+	if err != nil {
+		m.emit(EventInfo, name, "Cannot read disk activity, %s is picked up on the next poll: %s", name, err)
+		return
+	}
+	if len(identity) > 0 {
+		for i := len(m.disks) - 1; i >= 0; i-- {
+			if ds := m.disks[i]; ds.Name != name && ds.Identity == identity {
+				m.emit(EventInfo, name, "%s is now %s", m.config.resolveDeviceGivenName(ds.Name), name)
+				m.removeDiskAt(i)
+			}
+		}
+	}
+	/* the transport was negotiated with the disk which had the name before */
+	sgio.Forget(fmt.Sprintf("/dev/%s", name))
+
+	stats := DiskStats{Name: name}
+	for _, s := range snapshot {
+		if s.Name == name {
+			stats.Reads, stats.Writes, stats.InFlight = s.Reads, s.Writes, s.InFlight
+		}
+	}
+	ds := m.initDevice(stats)
+	if dsi = m.diskIndex(name); dsi >= 0 {
+		m.emit(EventInfo, name, "%s is another disk now", m.config.resolveDeviceGivenName(name))
+		m.disks[dsi] = ds
+		return
+	}
+	m.emit(EventDiskAdded, name, "%s added", m.config.resolveDeviceGivenName(name))
+	m.disks = append(m.disks, ds)
+}
+
+// takeOverState keeps the spin down failures and the detected command type
+// of a disk showing up again. The kernel reads the disk when it shows up, so
+// it is taken as spun up and used now, as initDevice set it.
+func takeOverState(ds, previous DiskStats) DiskStats {
+	if ds.AutoCommandType && previous.AutoCommandType {
+		ds.CommandType = previous.CommandType
+	}
+	ds.LastSpunDownAt = previous.LastSpunDownAt
+	ds.Failures = previous.Failures
+	ds.TotalFailures = previous.TotalFailures
+	ds.LastError = previous.LastError
+	ds.LastErrorAt = previous.LastErrorAt
+	ds.RetryAt = previous.RetryAt
+	ds.Suspended = previous.Suspended
+	return ds
+}
+
+// removeDisk drops a disk which went away.
+func (m *Monitor) removeDisk(name string) {
+	if dsi := m.diskIndex(name); dsi >= 0 {
+		m.emit(EventDiskRemoved, name, "%s removed", m.config.resolveDeviceGivenName(name))
+		m.removeDiskAt(dsi)
+	}
+}
+
+// removeDiskAt stops monitoring a disk. Its state is kept by identity, for
+// when it shows up again.
+func (m *Monitor) removeDiskAt(dsi int) {
+	ds := m.disks[dsi]
+	if len(ds.Identity) > 0 {
+		m.departed[ds.Identity] = ds
+	}
+	sgio.Forget(fmt.Sprintf("/dev/%s", ds.Name))
+	m.disks = append(m.disks[:dsi], m.disks[dsi+1:]...)
+}
+
+// dropMissingDisks drops the state of the disks missing in the snapshot, which
+// were removed while no uevents were received.
+func (m *Monitor) dropMissingDisks(snapshot []diskstats.ReadWriteStats) {
+	present := make(map[string]bool, len(snapshot))
+	for _, stats := range snapshot {
+		present[stats.Name] = true
+	}
+	for i := len(m.disks) - 1; i >= 0; i-- {
+		if !present[m.disks[i].Name] {
+			m.removeDisk(m.disks[i].Name)
+		}
+	}
+}
+
+// reresolveSymlinks resolves the symlinks of the configured devices again,
+// whatever the symlink policy, as they may point to another disk by now.
+func (m *Monitor) reresolveSymlinks() {
+	m.resolveDevices(func(device DeviceConf) bool {
+		return (strings.HasPrefix(device.GivenName, "/") || strings.Contains(device.GivenName, "=")) &&
+			!IsPattern(device.GivenName)
+	})
+}
+
+// diskIdentity returns the identity of the disk, see sysfs.Attributes.Identity.
+func diskIdentity(name string) string {
+	attributes, err := diskAttributes(name)
+	if err != nil {
+		return ""
+	}
+	return attributes.Identity()
+}
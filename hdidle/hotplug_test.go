@@ -0,0 +1,166 @@
+package hdidle
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/diskstats"
+	"github.com/adelolmo/hd-idle/sysfs"
+	"github.com/adelolmo/hd-idle/uevent"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHandleDiskEvent(t *testing.T) {
+	defer func(original func(string) (sysfs.Attributes, error)) { diskAttributes = original }(diskAttributes)
+
+	serials := map[string]string{"sdzy": "AAA", "sdzz": "BBB"}
+	diskAttributes = func(diskName string) (sysfs.Attributes, error) {
+		serial, ok := serials[diskName]
+		if !ok {
+			return sysfs.Attributes{}, fmt.Errorf("cannot find block device %s", diskName)
+		}
+		return sysfs.Attributes{Name: diskName, Model: "My Book", Serial: serial}, nil
+	}
+	config := &Config{
+		Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI},
+		NameMap:  map[string]string{},
+	}
+	tm := newTestMonitor(config)
+	tm.snapshot = []diskstats.ReadWriteStats{{Name: "sdzy", Reads: 10, Writes: 20}, {Name: "sdzz", Reads: 30, Writes: 40}}
+
+	tm.HandleEvent(uevent.Event{Action: uevent.ActionAdd, DevName: "sdzy"})
+	if len(tm.disks) != 1 || tm.disks[0].Identity != "My Book AAA" || tm.disks[0].Reads != 10 {
+		t.Fatalf("Expected sdzy to be monitored but found %+v", tm.disks)
+	}
+
+	/* sdzy re-enumerates as sdzz */
+	tm.disks[0].TotalFailures = 2
+	serials["sdzz"] = "AAA"
+	tm.HandleEvent(uevent.Event{Action: uevent.ActionAdd, DevName: "sdzz"})
+	if len(tm.disks) != 1 || tm.disks[0].Name != "sdzz" || tm.disks[0].Reads != 30 || tm.disks[0].TotalFailures != 2 {
+		t.Fatalf("Expected only sdzz to be monitored with the state of sdzy but found %+v", tm.disks)
+	}
+
+	/* another disk takes the name sdzz */
+	tm.disks[0].SpunDown = true
+	serials["sdzz"] = "CCC"
+	tm.HandleEvent(uevent.Event{Action: uevent.ActionChange, DevName: "sdzz"})
+	if len(tm.disks) != 1 || tm.disks[0].Identity != "My Book CCC" || tm.disks[0].SpunDown {
+		t.Fatalf("Expected sdzz to be started over but found %+v", tm.disks)
+	}
+
+	/* the same disk again keeps its state */
+	tm.disks[0].SpunDown = true
+	tm.HandleEvent(uevent.Event{Action: uevent.ActionChange, DevName: "sdzz"})
+	if !tm.disks[0].SpunDown {
+		t.Fatalf("Expected sdzz to keep its state but found %+v", tm.disks[0])
+	}
+
+	tm.disks[0].Suspended, tm.disks[0].TotalFailures = true, 3
+	tm.HandleEvent(uevent.Event{Action: uevent.ActionRemove, DevName: "sdzz"})
+	if len(tm.disks) != 0 {
+		t.Fatalf("Expected no disk to be monitored but found %+v", tm.disks)
+	}
+
+	/* the disk removed comes back under another name */
+	serials["sdzy"] = "CCC"
+	tm.HandleEvent(uevent.Event{Action: uevent.ActionAdd, DevName: "sdzy"})
+	if len(tm.disks) != 1 || !tm.disks[0].Suspended || tm.disks[0].TotalFailures != 3 || tm.disks[0].SpunDown {
+		t.Fatalf("Expected sdzy to take over the state of sdzz but found %+v", tm.disks)
+	}
+	if len(tm.departed) != 0 {
+		t.Fatalf("Expected no disk to be departed but found %v", tm.departed)
+	}
+}
+
+func TestDropMissingDisks(t *testing.T) {
+	tm := newTestMonitor(&Config{NameMap: map[string]string{}}, DiskStats{Name: "sdzx"}, DiskStats{Name: "sdzy"}, DiskStats{Name: "sdzz"})
+	tm.dropMissingDisks([]diskstats.ReadWriteStats{{Name: "sdzy"}})
+	if len(tm.disks) != 1 || tm.disks[0].Name != "sdzy" {
+		t.Fatalf("Expected only sdzy but found %+v", tm.disks)
+	}
+}
+
+func TestDroppedDiskComesBack(t *testing.T) {
+	defer func(original func(string) (sysfs.Attributes, error)) { diskAttributes = original }(diskAttributes)
+	diskAttributes = func(diskName string) (sysfs.Attributes, error) {
+		return sysfs.Attributes{Name: diskName, Model: "My Book", Serial: "AAA"}, nil
+	}
+	config := &Config{Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI}, NameMap: map[string]string{}}
+	tm := newTestMonitor(config, DiskStats{Name: "sdzz", Identity: "My Book AAA", CommandType: SCSI,
+		TotalFailures: 3, Suspended: true})
+
+	tm.dropMissingDisks(nil)
+	tm.snapshot = []diskstats.ReadWriteStats{{Name: "sdzy", Reads: 10, Writes: 20}}
+	if err := tm.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tm.disks) != 1 || tm.disks[0].Name != "sdzy" || !tm.disks[0].Suspended || tm.disks[0].TotalFailures != 3 {
+		t.Fatalf("Expected sdzy to take over the state of sdzz but found %+v", tm.disks)
+	}
+}
+
+func TestReresolveSymlinks(t *testing.T) {
+	defer func(original func(string) ([]string, error)) { resolveDisks = original }(resolveDisks)
+	link := "/dev/disk/by-id/usb-WD_My_Book"
+	targets := map[string][]string{link: {"sdzz"}, "/dev/md127": {"sdzw", "sdzv"}}
+	resolveDisks = func(name string) ([]string, error) {
+		disks, ok := targets[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot resolve %s", name)
+		}
+		return disks, nil
+	}
+	config := &Config{
+		Devices: []DeviceConf{
+			{Name: "sdzy", GivenName: link},
+			{Name: "sdzw", GivenName: "/dev/md127", Idle: time.Minute},
+			{Name: "sdzx", GivenName: "sdzx"},
+		},
+		NameMap: map[string]string{"sdzy": link, "sdzw": "/dev/md127", "sdzx": "sdzx"},
+	}
+
+	newTestMonitor(config).reresolveSymlinks()
+
+	var names []string
+	for _, device := range config.Devices {
+		names = append(names, device.Name)
+	}
+	if expected := []string{"sdzz", "sdzw", "sdzv", "sdzx"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected %v but found %v", expected, names)
+	}
+	if config.Devices[2].Idle != time.Minute {
+		t.Fatalf("Expected sdzv to be configured like sdzw but found %+v", config.Devices[2])
+	}
+	if _, ok := config.NameMap["sdzy"]; ok || config.NameMap["sdzz"] != link || config.NameMap["sdzv"] != "/dev/md127" {
+		t.Fatalf("Expected sdzz to map to %s but found %v", link, config.NameMap)
+	}
+}
+
+func TestCountersDrop(t *testing.T) {
+	defer func(original func(string) (sysfs.Attributes, error)) { diskAttributes = original }(diskAttributes)
+	serial := "AAA"
+	diskAttributes = func(diskName string) (sysfs.Attributes, error) {
+		return sysfs.Attributes{Name: diskName, Model: "My Book", Serial: serial}, nil
+	}
+	config := &Config{Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI}, NameMap: map[string]string{}}
+	spunDownAt := testStart.Add(-time.Hour)
+	tm := newTestMonitor(config, DiskStats{Name: "sdzz", Identity: "My Book AAA", CommandType: SCSI,
+		IdleTime: DefaultIdleTime, Reads: 100, Writes: 200, SpunDown: true, SpinDownAt: spunDownAt,
+		LastIoAt: spunDownAt, LastSpunDownAt: spunDownAt})
+
+	/* a LUKS volume on the disk is closed */
+	tm.updateState(DiskStats{Name: "sdzz", Reads: 60, Writes: 150})
+	if ds := tm.disks[0]; !ds.SpunDown || ds.Reads != 60 || ds.Writes != 150 || !ds.LastIoAt.Equal(spunDownAt) {
+		t.Fatalf("Expected the counters to be a new baseline but found %+v", ds)
+	}
+	if sent := tm.executor.sent(); len(sent) != 0 {
+		t.Fatalf("Expected no command but found %v", sent)
+	}
+
+	serial = "BBB"
+	tm.updateState(DiskStats{Name: "sdzz", Reads: 10, Writes: 20})
+	if ds := tm.disks[0]; ds.SpunDown || ds.Identity != "My Book BBB" || ds.Reads != 10 {
+		t.Fatalf("Expected sdzz to be started over but found %+v", ds)
+	}
+}
@@ -0,0 +1,89 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package hdidle
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// WriteMetrics writes the spin down state and the spin down failures of the
+// disks in the text format of Prometheus.
+func (m *Monitor) WriteMetrics(w io.Writer) error {
+	metrics := []struct {
+		name, kind, help string
+		value            func(ds DiskStats) float64
+	}{
+		{"hd_idle_disk_spun_down", "gauge", "Whether the disk is spun down.",
+			func(ds DiskStats) float64 { return boolMetric(ds.SpunDown) }},
+		{"hd_idle_spindown_failures", "gauge", "Spin downs of the disk which failed in a row.",
+			func(ds DiskStats) float64 { return float64(ds.Failures) }},
+		{"hd_idle_spindown_failures_total", "counter", "Spin downs of the disk which failed.",
+			func(ds DiskStats) float64 { return float64(ds.TotalFailures) }},
+		{"hd_idle_spindown_suspended", "gauge", "Whether spin down is suspended for the disk after failing.",
+			func(ds DiskStats) float64 { return boolMetric(ds.Suspended) }},
+		{"hd_idle_spindown_last_error_timestamp_seconds", "gauge", "When the last spin down of the disk failed.",
+			func(ds DiskStats) float64 {
+				if ds.LastErrorAt.IsZero() {
+					return 0
+				}
+				return float64(ds.LastErrorAt.Unix())
+			}},
+	}
+	var b bytes.Buffer
+	for _, metric := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, ds := range m.disks {
+			fmt.Fprintf(&b, "%s{disk=%q,name=%q} %g\n",
+				metric.name, ds.Name, m.config.resolveDeviceGivenName(ds.Name), metric.value(ds))
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// saveMetrics writes the metrics file if the metrics changed since it was
+// last written. Like the state file, it is not written while a disk it is
+// stored on is spun down.
+func (m *Monitor) saveMetrics() {
+	file := m.config.Defaults.MetricsFile
+	if len(file) == 0 {
+		return
+	}
+	var metrics bytes.Buffer
+	_ = m.WriteMetrics(&metrics)
+	if bytes.Equal(metrics.Bytes(), m.lastMetrics) {
+		return
+	}
+	if disk, asleep := m.stateDiskAsleep(file); asleep {
+		m.debugf("disk=%s holding the metrics file is spun down, not writing the metrics", disk)
+		return
+	}
+	if err := writeFileAtomic(file, metrics.Bytes()); err != nil {
+		m.emit(EventInfo, "", "Cannot write metrics to %s: %s", file, err)
+		return
+	}
+	m.lastMetrics = metrics.Bytes()
+}
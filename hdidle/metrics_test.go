@@ -0,0 +1,41 @@
+package hdidle
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveMetrics(t *testing.T) {
+	stubState(t, "boot-1", nil)
+	file := filepath.Join(t.TempDir(), "hd-idle.prom")
+	config := &Config{Defaults: DefaultConf{MetricsFile: file}, NameMap: map[string]string{"sdzz": "/dev/disk/by-id/usb-WD"}}
+	tm := newTestMonitor(config, DiskStats{Name: "sdzz", SpunDown: true, TotalFailures: 3, LastErrorAt: testStart})
+
+	tm.saveMetrics()
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# TYPE hd_idle_spindown_failures_total counter\n",
+		`hd_idle_disk_spun_down{disk="sdzz",name="/dev/disk/by-id/usb-WD"} 1` + "\n",
+		`hd_idle_spindown_failures_total{disk="sdzz",name="/dev/disk/by-id/usb-WD"} 3` + "\n",
+		`hd_idle_spindown_suspended{disk="sdzz",name="/dev/disk/by-id/usb-WD"} 0` + "\n",
+		`hd_idle_spindown_last_error_timestamp_seconds{disk="sdzz",name="/dev/disk/by-id/usb-WD"} 1.7093736e+09` + "\n",
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Fatalf("Expected %q in %s", expected, content)
+		}
+	}
+
+	/* unchanged metrics are not written again */
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	tm.saveMetrics()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("Expected the metrics not to be written again but found %v", err)
+	}
+}
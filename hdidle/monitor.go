@@ -0,0 +1,263 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package hdidle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adelolmo/hd-idle/diskstats"
+	"github.com/adelolmo/hd-idle/nvme"
+	"github.com/adelolmo/hd-idle/sgio"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock tells the monitor the time. Uptime returns CLOCK_MONOTONIC, which
+// stops while the system is suspended, and CLOCK_BOOTTIME, which keeps
+// counting, see timeSuspended.
+type Clock interface {
+	Now() time.Time
+	Uptime() (monotonic, boottime time.Duration, err error)
+}
+
+// SnapshotSource reads the activity of the disks, like diskstats.Snapshot.
+type SnapshotSource func() ([]diskstats.ReadWriteStats, error)
+
+// Executor sends the commands to the disks. Spindown returns the command
+// type which spun the disk down, which differs from the one of the disk if
+// the disk rejected a detected command type. The commands run in their own
+// goroutines, so that a disk hanging one doesn't block the monitor, and the
+// methods must be safe for concurrent use.
+type Executor interface {
+	Spindown(ds DiskStats, debug bool) (string, error)
+	Spinup(ds DiskStats, debug bool) error
+	PowerState(ds DiskStats, debug bool) (sgio.PowerState, error)
+	ApplyFirmwareSettings(ds DiskStats, debug bool) error
+}
+
+type EventKind string
+
+const (
+	EventSpindown       EventKind = "spindown"
+	EventSpinup         EventKind = "spinup"
+	EventSpindownFailed EventKind = "spindown-failed"
+	EventDiskAdded      EventKind = "disk-added"
+	EventDiskRemoved    EventKind = "disk-removed"
+	EventResume         EventKind = "resume"
+	EventInfo           EventKind = "info"
+	EventDebug          EventKind = "debug"
+)
+
+// Event is something the monitor did or noticed. Disk is the kernel name of
+// the disk, if the event is about one, and Message the line hd-idle prints.
+type Event struct {
+	Time    time.Time
+	Kind    EventKind
+	Disk    string
+	Message string
+}
+
+// EventSink receives the events of the monitor. It is called from Step and
+// the other methods of the monitor, so it must not block.
+type EventSink func(Event)
+
+// MonitorOptions holds the dependencies of a monitor. The ones left out talk
+// to the system: the system clocks, /proc/diskstats and the disks.
+type MonitorOptions struct {
+	Clock     Clock
+	Snapshots SnapshotSource
+	Executor  Executor
+	// Sink receives the events, if nil they are sent to the channel returned
+	// by Events and dropped while it is full
+	Sink EventSink
+}
+
+// eventBuffer is the number of events kept for the channel returned by
+// Events until they are received.
+const eventBuffer = 64
+
+// Monitor spins down the disks which were idle for longer than their idle
+// time. It polls the activity of the disks on every Step and is not safe for
+// concurrent use.
+type Monitor struct {
+	config    *Config
+	clock     Clock
+	snapshots SnapshotSource
+	executor  Executor
+	sink      EventSink
+	events    chan Event
+
+	disks   []DiskStats
+	now     time.Time
+	lastNow time.Time
+	// suspendedFor is the time the system was suspended for since the
+	// previous step, zero if it wasn't
+	suspendedFor time.Duration
+	lastClocks   clocks
+
+	// restored holds the state loaded on start, until the disks show up
+	restored map[string]savedDisk
+	// departed holds the state of the disks removed, by identity, until they
+	// show up again
+	departed map[string]DiskStats
+	// lastSavedState tells whether the state changed since it was last written
+	lastSavedState []byte
+	// lastMetrics tells whether the metrics changed since they were last written
+	lastMetrics []byte
+
+	spindownOnce    sync.Once
+	spindownJobs    chan spindownJob
+	spindownResults chan spindownResult
+	// closed is closed by Close, once the workers were started
+	closed chan struct{}
+}
+
+// NewMonitor returns a monitor of the disks with the configuration.
+func NewMonitor(config *Config, options MonitorOptions) *Monitor {
+	m := &Monitor{
+		config:    config,
+		clock:     options.Clock,
+		snapshots: options.Snapshots,
+		executor:  options.Executor,
+		sink:      options.Sink,
+		departed:  map[string]DiskStats{},
+	}
+	if m.clock == nil {
+		m.clock = systemClock{}
+	}
+	if m.snapshots == nil {
+		m.snapshots = diskstats.Snapshot
+	}
+	if m.executor == nil {
+		m.executor = systemExecutor{}
+	}
+	if m.sink == nil {
+		m.events = make(chan Event, eventBuffer)
+		m.sink = func(event Event) {
+			select {
+			case m.events <- event:
+			default:
+			}
+		}
+	}
+	m.now = m.clock.Now()
+	m.lastNow = m.now
+	return m
+}
+
+// Events returns the channel the events are sent to, nil if the monitor was
+// given a sink.
+func (m *Monitor) Events() <-chan Event {
+	return m.events
+}
+
+// State returns a copy of the state of the disks being monitored.
+func (m *Monitor) State() []DiskStats {
+	return append([]DiskStats(nil), m.disks...)
+}
+
+// Reconfigure applies a new configuration to the disks already being
+// monitored, see reconfigureDisks.
+func (m *Monitor) Reconfigure(config *Config) {
+	m.config = config
+	m.reconfigureDisks()
+}
+
+func (m *Monitor) emit(kind EventKind, disk, format string, args ...interface{}) {
+	m.sink(Event{Time: m.now, Kind: kind, Disk: disk, Message: fmt.Sprintf(format, args...)})
+}
+
+func (m *Monitor) debugf(format string, args ...interface{}) {
+	if m.config.Defaults.Debug {
+		m.emit(EventDebug, "", format, args...)
+	}
+}
+
+// systemClock reads the clocks of the system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Uptime() (time.Duration, time.Duration, error) {
+	monotonic, err := clockGettime(clockMonotonic)
+	if err != nil {
+		return 0, 0, err
+	}
+	boottime, err := clockGettime(clockBoottime)
+	if err != nil {
+		return 0, 0, err
+	}
+	return monotonic, boottime, nil
+}
+
+// systemExecutor sends the commands of the command type of the disk.
+type systemExecutor struct{}
+
+func (systemExecutor) Spindown(ds DiskStats, debug bool) (string, error) {
+	device := fmt.Sprintf("/dev/%s", ds.Name)
+	if ds.AutoCommandType {
+		return SpindownDetectedDisk(device, ds.CommandType, ds.PowerCondition, debug)
+	}
+	return ds.CommandType, SpindownDisk(device, ds.CommandType, ds.PowerCondition, ds.Exec, debug)
+}
+
+func (systemExecutor) Spinup(ds DiskStats, debug bool) error {
+	return SpinupDisk(fmt.Sprintf("/dev/%s", ds.Name), ds.CommandType, ds.Exec, debug)
+}
+
+func (systemExecutor) PowerState(ds DiskStats, debug bool) (sgio.PowerState, error) {
+	return QueryPowerState(fmt.Sprintf("/dev/%s", ds.Name), ds.CommandType, ds.Exec, debug)
+}
+
+// ApplyFirmwareSettings programs the standby timer and the APM level of the
+// drive, so that it spins down on its own even if hd-idle is not running.
+// Programming the standby timer of an ATA drive spins it up.
+func (systemExecutor) ApplyFirmwareSettings(ds DiskStats, debug bool) error {
+	if len(ds.CommandType) == 0 {
+		return nil
+	}
+	device := fmt.Sprintf("/dev/%s", ds.Name)
+	var failures []string
+	if ds.FirmwareStandby != nil {
+		var err error
+		switch ds.CommandType {
+		case SCSI:
+			err = sgio.SetScsiStandbyTimer(device, *ds.FirmwareStandby, debug)
+		case ATA, HDIO:
+			err = sgio.SetAtaStandbyTimer(device, *ds.FirmwareStandby, debug)
+		case NVME:
+			err = nvme.SetApst(device, *ds.FirmwareStandby, debug)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("cannot set firmware standby of disk %s: %s", device, err))
+		}
+	}
+	if ds.ApmLevel != 0 {
+		if ds.CommandType != ATA && ds.CommandType != HDIO {
+			failures = append(failures, fmt.Sprintf("cannot set apm level of disk %s: requires command type ata or hdio", device))
+		} else if err := sgio.SetAtaApm(device, ds.ApmLevel, debug); err != nil {
+			failures = append(failures, fmt.Sprintf("cannot set apm level of disk %s: %s", device, err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package hdidle
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/diskstats"
+	"github.com/adelolmo/hd-idle/sgio"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC)
+
+// fakeClock only moves when told to.
+type fakeClock struct {
+	now       time.Time
+	monotonic time.Duration
+	boottime  time.Duration
+	err       error
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Uptime() (time.Duration, time.Duration, error) {
+	return c.monotonic, c.boottime, c.err
+}
+
+// advance moves the clock on, the system being suspended for part of it.
+func (c *fakeClock) advance(d, suspended time.Duration) {
+	c.now = c.now.Add(d)
+	c.boottime += d
+	c.monotonic += d - suspended
+}
+
+// fakeExecutor records the commands instead of sending them to the disks.
+type fakeExecutor struct {
+	mu       sync.Mutex
+	commands []string
+	// block holds the spin downs until it is closed, if set
+	block chan struct{}
+	// stateBlock holds the power state queries until it is closed, if set
+	stateBlock  chan struct{}
+	spindownErr error
+	state       sgio.PowerState
+	stateErr    error
+}
+
+func (e *fakeExecutor) record(command string, ds DiskStats) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commands = append(e.commands, command+" "+ds.Name)
+}
+
+func (e *fakeExecutor) sent() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.commands...)
+}
+
+func (e *fakeExecutor) Spindown(ds DiskStats, debug bool) (string, error) {
+	e.record("spindown", ds)
+	if e.block != nil {
+		<-e.block
+	}
+	return ds.CommandType, e.spindownErr
+}
+
+func (e *fakeExecutor) Spinup(ds DiskStats, debug bool) error {
+	e.record("spinup", ds)
+	return nil
+}
+
+func (e *fakeExecutor) PowerState(ds DiskStats, debug bool) (sgio.PowerState, error) {
+	e.record("powerstate", ds)
+	if e.stateBlock != nil {
+		<-e.stateBlock
+	}
+	return e.state, e.stateErr
+}
+
+func (e *fakeExecutor) ApplyFirmwareSettings(ds DiskStats, debug bool) error {
+	if ds.FirmwareStandby != nil || ds.ApmLevel != 0 {
+		e.record("firmware", ds)
+	}
+	return nil
+}
+
+// testMonitor is a monitor of fake disks, whose activity is set in snapshot.
+type testMonitor struct {
+	*Monitor
+	clock    *fakeClock
+	executor *fakeExecutor
+	events   []Event
+	snapshot []diskstats.ReadWriteStats
+}
+
+func newTestMonitor(config *Config, disks ...DiskStats) *testMonitor {
+	tm := &testMonitor{
+		clock:    &fakeClock{now: testStart, monotonic: time.Hour, boottime: time.Hour},
+		executor: &fakeExecutor{},
+	}
+	tm.Monitor = NewMonitor(config, MonitorOptions{
+		Clock:     tm.clock,
+		Snapshots: func() ([]diskstats.ReadWriteStats, error) { return tm.snapshot, nil },
+		Executor:  tm.executor,
+		Sink:      func(event Event) { tm.events = append(tm.events, event) },
+	})
+	tm.disks = disks
+	return tm
+}
+
+// waitSpindowns takes the results of the spin downs sent to the workers.
+func (tm *testMonitor) waitSpindowns(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		inProgress := false
+		for _, ds := range tm.disks {
+			inProgress = inProgress || ds.CommandInProgress
+		}
+		if !inProgress {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the spin downs to complete but found %+v", tm.disks)
+		}
+		time.Sleep(time.Millisecond)
+		tm.collectSpindowns()
+	}
+}
+
+func (tm *testMonitor) eventKinds() []EventKind {
+	var kinds []EventKind
+	for _, event := range tm.events {
+		kinds = append(kinds, event.Kind)
+	}
+	return kinds
+}
+
+func TestStepSpindown(t *testing.T) {
+	tests := []struct {
+		name         string
+		command      string
+		idle         time.Duration
+		reads        uint64
+		retryAt      time.Duration
+		spindownErr  error
+		wantSent     []string
+		wantSpunDown bool
+		wantEvents   []EventKind
+	}{
+		{name: "idle for longer than the idle time", command: SCSI, idle: 11 * time.Minute,
+			wantSent: []string{"spindown sdzz"}, wantSpunDown: true, wantEvents: []EventKind{EventSpindown}},
+		{name: "idle for less than the idle time", command: SCSI, idle: 9 * time.Minute},
+		{name: "disk in use", command: SCSI, idle: 11 * time.Minute, reads: 1},
+		{name: "no command type", idle: 11 * time.Minute},
+		{name: "retry pending", command: SCSI, idle: 11 * time.Minute, retryAt: time.Minute},
+		{name: "spindown failed", command: SCSI, idle: 11 * time.Minute, spindownErr: fmt.Errorf("cannot spindown"),
+			wantSent:   []string{"spindown sdzz"},
+			wantEvents: []EventKind{EventSpindown, EventSpindownFailed, EventInfo}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				Defaults: DefaultConf{Idle: 10 * time.Minute, CommandType: tt.command},
+				NameMap:  map[string]string{},
+				SkewTime: time.Hour,
+			}
+			tm := newTestMonitor(config)
+			tm.executor.spindownErr = tt.spindownErr
+			tm.snapshot = []diskstats.ReadWriteStats{{Name: "sdzz", Reads: 100, Writes: 200}}
+			tm.Step()
+			tm.disks[0].RetryAt = testStart.Add(tt.idle + tt.retryAt)
+
+			tm.clock.advance(tt.idle, 0)
+			tm.snapshot[0].Reads += tt.reads
+			tm.Step()
+			tm.waitSpindowns(t)
+
+			ds := tm.State()[0]
+			if sent := tm.executor.sent(); !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Fatalf("Expected %v but found %v", tt.wantSent, sent)
+			}
+			if ds.SpunDown != tt.wantSpunDown {
+				t.Fatalf("Expected spunDown=%t but found %+v", tt.wantSpunDown, ds)
+			}
+			if kinds := tm.eventKinds(); !reflect.DeepEqual(kinds, tt.wantEvents) {
+				t.Fatalf("Expected %v but found %v", tt.wantEvents, kinds)
+			}
+		})
+	}
+}
+
+func TestStepSpinup(t *testing.T) {
+	spunDownAt := testStart.Add(-time.Hour)
+	tests := []struct {
+		name              string
+		reads             uint64
+		inFlight          uint64
+		queryPowerState   bool
+		spinupOnPendingIo bool
+		state             sgio.PowerState
+		wantSent          []string
+		wantSpunDown      bool
+		wantEvents        []EventKind
+	}{
+		{name: "disk in use", reads: 1, wantEvents: []EventKind{EventSpinup}},
+		{name: "disk idle", wantSpunDown: true},
+		{name: "drive reports active", queryPowerState: true, state: sgio.PowerStateActive,
+			wantSent: []string{"powerstate sdzz"}, wantEvents: []EventKind{EventSpinup}},
+		{name: "drive reports standby", queryPowerState: true, state: sgio.PowerStateStandby,
+			wantSent: []string{"powerstate sdzz"}, wantSpunDown: true},
+		{name: "requests pending", inFlight: 1, spinupOnPendingIo: true,
+			wantSent: []string{"spinup sdzz"}, wantSpunDown: true, wantEvents: []EventKind{EventInfo}},
+		{name: "requests pending without spin up", inFlight: 1, wantSpunDown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				Defaults: DefaultConf{Idle: 10 * time.Minute, CommandType: SCSI},
+				NameMap:  map[string]string{},
+				SkewTime: time.Hour,
+			}
+			tm := newTestMonitor(config, DiskStats{
+				Name:              "sdzz",
+				IdleTime:          10 * time.Minute,
+				CommandType:       SCSI,
+				QueryPowerState:   tt.queryPowerState,
+				SpinupOnPendingIo: tt.spinupOnPendingIo,
+				Reads:             100,
+				Writes:            200,
+				LastIoAt:          spunDownAt,
+				SpinDownAt:        spunDownAt,
+				LastSpunDownAt:    spunDownAt,
+				SpunDown:          true,
+			})
+			tm.executor.state = tt.state
+			tm.snapshot = []diskstats.ReadWriteStats{{Name: "sdzz", Reads: 100 + tt.reads, Writes: 200, InFlight: tt.inFlight}}
+
+			tm.Step()
+
+			ds := tm.State()[0]
+			if sent := tm.executor.sent(); !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Fatalf("Expected %v but found %v", tt.wantSent, sent)
+			}
+			if ds.SpunDown != tt.wantSpunDown {
+				t.Fatalf("Expected spunDown=%t but found %+v", tt.wantSpunDown, ds)
+			}
+			if !ds.SpunDown && (ds.SpinUpAt != testStart || ds.LastIoAt != testStart) {
+				t.Fatalf("Expected the disk to spin up at %v but found %+v", testStart, ds)
+			}
+			if kinds := tm.eventKinds(); !reflect.DeepEqual(kinds, tt.wantEvents) {
+				t.Fatalf("Expected %v but found %v", tt.wantEvents, kinds)
+			}
+		})
+	}
+}
+
+func TestStepAfterSuspend(t *testing.T) {
+	spunDownAt := testStart.Add(-time.Hour)
+	tests := []struct {
+		name         string
+		policy       string
+		clockErr     error
+		elapsed      time.Duration
+		suspended    time.Duration
+		wantSent     []string
+		wantSpunDown bool
+		wantEvents   []EventKind
+	}{
+		{name: "no suspend", elapsed: time.Minute, wantSpunDown: true},
+		{name: "suspended", elapsed: 2 * time.Hour, suspended: 2*time.Hour - time.Minute,
+			wantEvents: []EventKind{EventResume}},
+		{name: "suspended, restore", policy: ResumeRestore, elapsed: 2 * time.Hour, suspended: 2*time.Hour - time.Minute,
+			wantSent: []string{"spindown sdzz"}, wantSpunDown: true, wantEvents: []EventKind{EventResume, EventSpindown}},
+		{name: "no boot clock, gap above the skew time", clockErr: fmt.Errorf("invalid argument"),
+			elapsed: 2 * time.Hour, wantEvents: []EventKind{EventResume}},
+		{name: "no boot clock, gap below the skew time", clockErr: fmt.Errorf("invalid argument"),
+			elapsed: 30 * time.Minute, wantSpunDown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				Defaults: DefaultConf{Idle: 10 * time.Minute, CommandType: SCSI},
+				NameMap:  map[string]string{},
+				SkewTime: time.Hour,
+			}
+			tm := newTestMonitor(config, DiskStats{
+				Name:           "sdzz",
+				IdleTime:       10 * time.Minute,
+				CommandType:    SCSI,
+				ResumePolicy:   tt.policy,
+				Reads:          100,
+				Writes:         200,
+				LastIoAt:       spunDownAt,
+				SpinDownAt:     spunDownAt,
+				LastSpunDownAt: spunDownAt,
+				SpunDown:       true,
+			})
+			tm.snapshot = []diskstats.ReadWriteStats{{Name: "sdzz", Reads: 100, Writes: 200}}
+			tm.Step()
+
+			tm.clock.err = tt.clockErr
+			tm.clock.advance(tt.elapsed, tt.suspended)
+			tm.Step()
+			tm.waitSpindowns(t)
+
+			ds := tm.State()[0]
+			if sent := tm.executor.sent(); !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Fatalf("Expected %v but found %v", tt.wantSent, sent)
+			}
+			if ds.SpunDown != tt.wantSpunDown {
+				t.Fatalf("Expected spunDown=%t but found %+v", tt.wantSpunDown, ds)
+			}
+			if kinds := tm.eventKinds(); !reflect.DeepEqual(kinds, tt.wantEvents) {
+				t.Fatalf("Expected %v but found %v", tt.wantEvents, kinds)
+			}
+		})
+	}
+}
+
+func TestStepSnapshotFails(t *testing.T) {
+	m := NewMonitor(&Config{NameMap: map[string]string{}}, MonitorOptions{
+		Clock: &fakeClock{now: testStart},
+		Snapshots: func() ([]diskstats.ReadWriteStats, error) {
+			return nil, fmt.Errorf("no diskstats")
+		},
+		Executor: &fakeExecutor{},
+	})
+	m.disks = []DiskStats{{Name: "sdzz"}}
+	err := m.Step()
+	if err == nil || err.Error() != "cannot read disk activity: no diskstats" {
+		t.Fatalf("Expected cannot read disk activity but found %v", err)
+	}
+	if len(m.disks) != 1 {
+		t.Fatalf("Expected the disks to be kept but found %+v", m.disks)
+	}
+}
+
+func TestMonitorEvents(t *testing.T) {
+	m := NewMonitor(&Config{NameMap: map[string]string{}}, MonitorOptions{Clock: &fakeClock{now: testStart}})
+	for i := 0; i <= eventBuffer; i++ {
+		/* the events nobody receives are dropped instead of blocking the monitor */
+		m.emit(EventInfo, "sdzz", "event %d", i)
+	}
+	event := <-m.Events()
+	if expected := (Event{Time: testStart, Kind: EventInfo, Disk: "sdzz", Message: "event 0"}); event != expected {
+		t.Fatalf("Expected %+v but found %+v", expected, event)
+	}
+	if len(m.Events()) != eventBuffer-1 {
+		t.Fatalf("Expected %d events but found %d", eventBuffer-1, len(m.Events()))
+	}
+}
+
+func TestStateIsACopy(t *testing.T) {
+	tm := newTestMonitor(&Config{NameMap: map[string]string{}}, DiskStats{Name: "sdzz"})
+	tm.State()[0].SpunDown = true
+	if tm.disks[0].SpunDown {
+		t.Fatal("Expected the state of the monitor to be left as it is")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tm := newTestMonitor(&Config{NameMap: map[string]string{}}, DiskStats{Name: "sdzz", CommandType: SCSI, LastIoAt: testStart})
+	expected := []string{"disk=sdzz command=scsi method=scsi spunDown=false inProgress=false idle=0s failures=0 totalFailures=0 suspended=false"}
+	if status := tm.Status(); !reflect.DeepEqual(status, expected) {
+		t.Fatalf("Expected %v but found %v", expected, status)
+	}
+}
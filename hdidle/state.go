@@ -0,0 +1,247 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package hdidle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/adelolmo/hd-idle/io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stateVersion is raised when the format of the state file changes, state
+// of another version is discarded.
+const stateVersion = 1
+
+// StateSaveInterval is how often the state is saved while running, if it
+// changed.
+const StateSaveInterval = 10 * time.Minute
+
+// savedState is the content of the state file. The disk counters start over
+// on boot, so state saved before another boot is discarded.
+type savedState struct {
+	Version int         `json:"version"`
+	BootID  string      `json:"bootId"`
+	Disks   []savedDisk `json:"disks"`
+}
+
+// savedDisk is the state of a disk kept across restarts, keyed by the
+// identity of the disk, see sysfs.Attributes.Identity.
+type savedDisk struct {
+	Identity       string    `json:"identity"`
+	Name           string    `json:"name"`
+	Reads          uint64    `json:"reads"`
+	Writes         uint64    `json:"writes"`
+	SpunDown       bool      `json:"spunDown"`
+	LastIoAt       time.Time `json:"lastIoAt"`
+	SpinDownAt     time.Time `json:"spinDownAt"`
+	SpinUpAt       time.Time `json:"spinUpAt"`
+	LastSpunDownAt time.Time `json:"lastSpunDownAt"`
+	TotalFailures  int       `json:"totalFailures"`
+	LastError      string    `json:"lastError,omitempty"`
+	LastErrorAt    time.Time `json:"lastErrorAt"`
+}
+
+// bootID identifies the current boot of the system. Tests replace it.
+var bootID = func() string {
+	id, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+// fileDisks returns the disks a file is stored on. Tests replace it.
+var fileDisks = io.FileDisks
+
+// LoadState reads the state saved by a previous run into the state file. A
+// missing or invalid file starts with a fresh state.
+func (m *Monitor) LoadState() {
+	m.restored = nil
+	file := m.config.Defaults.StateFile
+	if len(file) == 0 {
+		return
+	}
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return
+	}
+	var state savedState
+	if err == nil {
+		err = json.Unmarshal(content, &state)
+	}
+	if err != nil {
+		m.emit(EventInfo, "", "Cannot read state file %s, starting with a fresh state: %s", file, err)
+		return
+	}
+	if state.Version != stateVersion || state.BootID != bootID() {
+		m.debugf("state file %s is from another version or boot, discarding it", file)
+		return
+	}
+	m.restored = make(map[string]savedDisk, len(state.Disks))
+	for _, disk := range state.Disks {
+		m.restored[disk.Identity] = disk
+	}
+	m.lastSavedState = stateKey(state)
+}
+
+// restoreDisk takes the timers and the spin down state of a disk showing up
+// for the first time from the state loaded on start. The state is discarded
+// if the disk was used in between, as its counters changed.
+func (m *Monitor) restoreDisk(ds DiskStats) DiskStats {
+	saved, ok := m.restored[ds.Identity]
+	if len(ds.Identity) == 0 || !ok {
+		return ds
+	}
+	delete(m.restored, ds.Identity)
+	if saved.Reads != ds.Reads || saved.Writes != ds.Writes {
+		m.debugf("disk=%s used since the state was saved, discarding it", ds.Name)
+		return ds
+	}
+	ds.SpunDown = saved.SpunDown
+	ds.LastIoAt = saved.LastIoAt
+	ds.SpinDownAt = saved.SpinDownAt
+	ds.SpinUpAt = saved.SpinUpAt
+	ds.LastSpunDownAt = saved.LastSpunDownAt
+	ds.TotalFailures = saved.TotalFailures
+	ds.LastError = saved.LastError
+	ds.LastErrorAt = saved.LastErrorAt
+	m.debugf("disk=%s state restored, spunDown=%t lastIO=%s",
+		ds.Name, ds.SpunDown, ds.LastIoAt.Format(dateFormat))
+	return ds
+}
+
+// SaveState writes the state of the disks if it changed since it was last
+// written, or whatever changed if final, on shutdown. The state is not
+// written while a disk the file is stored on is spun down, so that saving it
+// doesn't wake the disk up. Skipping the final save is reported.
+func (m *Monitor) SaveState(final bool) {
+	file := m.config.Defaults.StateFile
+	if len(file) == 0 {
+		return
+	}
+	state := m.currentState()
+	key := stateKey(state)
+	if !final && bytes.Equal(key, m.lastSavedState) {
+		return
+	}
+	if disk, asleep := m.stateDiskAsleep(file); asleep {
+		if final {
+			m.emit(EventInfo, disk, "%s holding the state file %s is spun down, the state is not saved", disk, file)
+		} else {
+			m.debugf("disk=%s holding the state file is spun down, not saving the state", disk)
+		}
+		return
+	}
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(file, append(content, '\n'))
+	}
+	if err != nil {
+		m.emit(EventInfo, "", "Cannot save state to %s: %s", file, err)
+		return
+	}
+	m.lastSavedState = key
+}
+
+func (m *Monitor) currentState() savedState {
+	state := savedState{Version: stateVersion, BootID: bootID(), Disks: []savedDisk{}}
+	for _, ds := range m.disks {
+		if len(ds.Identity) == 0 {
+			/* another disk may show up under the name after a restart */
+			continue
+		}
+		state.Disks = append(state.Disks, savedDisk{
+			Identity:       ds.Identity,
+			Name:           ds.Name,
+			Reads:          ds.Reads,
+			Writes:         ds.Writes,
+			SpunDown:       ds.SpunDown,
+			LastIoAt:       ds.LastIoAt,
+			SpinDownAt:     ds.SpinDownAt,
+			SpinUpAt:       ds.SpinUpAt,
+			LastSpunDownAt: ds.LastSpunDownAt,
+			TotalFailures:  ds.TotalFailures,
+			LastError:      ds.LastError,
+			LastErrorAt:    ds.LastErrorAt,
+		})
+	}
+	return state
+}
+
+// stateKey is what tells whether the state changed. The counters and the
+// last I/O of disks in use change all the time, and are left out: their
+// state is discarded on restart anyway, and writing it would keep the disk
+// of the state file busy.
+func stateKey(state savedState) []byte {
+	var key bytes.Buffer
+	for _, disk := range state.Disks {
+		fmt.Fprintf(&key, "%s %t %d %d %d %d %s\n", disk.Identity, disk.SpunDown, disk.SpinDownAt.Unix(),
+			disk.SpinUpAt.Unix(), disk.LastSpunDownAt.Unix(), disk.TotalFailures, disk.LastError)
+	}
+	return key.Bytes()
+}
+
+// stateDiskAsleep tells whether a disk holding the file, or the directory it
+// goes into, is spun down.
+func (m *Monitor) stateDiskAsleep(file string) (string, bool) {
+	dir := filepath.Dir(file)
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	disks, err := fileDisks(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, disk := range disks {
+		if dsi := m.diskIndex(disk); dsi >= 0 && m.disks[dsi].SpunDown {
+			return disk, true
+		}
+	}
+	return "", false
+}
+
+// writeFileAtomic replaces the file with the content, so that it is never
+// left half written, not even by a power loss.
+func writeFileAtomic(file string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
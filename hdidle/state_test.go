@@ -0,0 +1,144 @@
+package hdidle
+
+import (
+	"github.com/adelolmo/hd-idle/sysfs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func stubState(t *testing.T, boot string, disks []string) {
+	originalBootID, originalFileDisks := bootID, fileDisks
+	t.Cleanup(func() {
+		bootID, fileDisks = originalBootID, originalFileDisks
+	})
+	bootID = func() string { return boot }
+	fileDisks = func(path string) ([]string, error) { return disks, nil }
+}
+
+func TestSaveAndRestoreState(t *testing.T) {
+	stubState(t, "boot-1", nil)
+	file := filepath.Join(t.TempDir(), "hd-idle", "state.json")
+	config := &Config{Defaults: DefaultConf{StateFile: file}, NameMap: map[string]string{}}
+	spunDownAt := time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC)
+	tm := newTestMonitor(config,
+		DiskStats{Name: "sdzx", Identity: "naa.5000c500a3d1d419", Reads: 10, Writes: 20, SpunDown: true,
+			LastIoAt: spunDownAt.Add(-time.Hour), SpinDownAt: spunDownAt, LastSpunDownAt: spunDownAt, TotalFailures: 2},
+		DiskStats{Name: "sdzy", Identity: "My Book AAA", Reads: 30, Writes: 40, LastIoAt: spunDownAt},
+		DiskStats{Name: "sdzz", Reads: 50, Writes: 60, SpunDown: true},
+	)
+	tm.SaveState(true)
+
+	tm = newTestMonitor(config)
+	tm.LoadState()
+	if len(tm.restored) != 2 {
+		t.Fatalf("Expected 2 disks with an identity but found %v", tm.restored)
+	}
+
+	tests := []struct {
+		name     string
+		ds       DiskStats
+		restored bool
+	}{
+		{name: "unused", ds: DiskStats{Name: "sdzw", Identity: "naa.5000c500a3d1d419", Reads: 10, Writes: 20}, restored: true},
+		{name: "used meanwhile", ds: DiskStats{Name: "sdzy", Identity: "My Book AAA", Reads: 31, Writes: 40}},
+		{name: "unknown", ds: DiskStats{Name: "sdzz", Identity: "My Book BBB", Reads: 50, Writes: 60}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := tm.restoreDisk(tt.ds)
+			restored := ds.SpunDown && ds.SpinDownAt.Equal(spunDownAt) && ds.LastIoAt.Equal(spunDownAt.Add(-time.Hour)) &&
+				ds.TotalFailures == 2
+			if restored != tt.restored {
+				t.Fatalf("Expected restored=%t but found %+v", tt.restored, ds)
+			}
+		})
+	}
+	if len(tm.restored) != 0 {
+		t.Fatalf("Expected the restored state to be used up but found %v", tm.restored)
+	}
+}
+
+func TestLoadStateOfAnotherBoot(t *testing.T) {
+	stubState(t, "boot-1", nil)
+	file := filepath.Join(t.TempDir(), "state.json")
+	config := &Config{Defaults: DefaultConf{StateFile: file}}
+	tm := newTestMonitor(config, DiskStats{Name: "sdzz", Identity: "My Book AAA", SpunDown: true})
+	tm.SaveState(true)
+
+	bootID = func() string { return "boot-2" }
+	tm.LoadState()
+	if len(tm.restored) != 0 {
+		t.Fatalf("Expected the state of another boot to be discarded but found %v", tm.restored)
+	}
+
+	if err := os.WriteFile(file, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tm.LoadState()
+	if len(tm.restored) != 0 {
+		t.Fatalf("Expected an invalid state to be discarded but found %v", tm.restored)
+	}
+}
+
+func TestSaveStateOnlyWhenChanged(t *testing.T) {
+	stubState(t, "boot-1", []string{"sdzz"})
+	file := filepath.Join(t.TempDir(), "state.json")
+	config := &Config{Defaults: DefaultConf{StateFile: file}}
+	tm := newTestMonitor(config, DiskStats{Name: "sdzz", Identity: "My Book AAA", Reads: 1})
+	saved := func() string {
+		content, _ := os.ReadFile(file)
+		return string(content)
+	}
+
+	tm.SaveState(false)
+	if !strings.Contains(saved(), `"reads": 1`) {
+		t.Fatalf("Expected the state to be saved but found %q", saved())
+	}
+
+	/* the disk in use is not worth writing the file for */
+	tm.disks[0].Reads = 2
+	tm.SaveState(false)
+	if !strings.Contains(saved(), `"reads": 1`) {
+		t.Fatalf("Expected the state to be left as it is but found %q", saved())
+	}
+
+	/* the disk holding the file is not woken up */
+	tm.disks[0].SpunDown = true
+	tm.SaveState(true)
+	if !strings.Contains(saved(), `"reads": 1`) {
+		t.Fatalf("Expected the state not to be written to a spun down disk but found %q", saved())
+	}
+	if kinds := tm.eventKinds(); len(kinds) != 1 || kinds[0] != EventInfo {
+		t.Fatalf("Expected the skipped save to be reported but found %v", tm.events)
+	}
+
+	tm.disks[0].SpunDown = false
+	tm.SaveState(true)
+	if !strings.Contains(saved(), `"reads": 2`) {
+		t.Fatalf("Expected the state to be saved on shutdown but found %q", saved())
+	}
+}
+
+func TestRestoredDiskFirmwareSettings(t *testing.T) {
+	defer func(original func(string) (sysfs.Attributes, error)) { diskAttributes = original }(diskAttributes)
+	diskAttributes = func(diskName string) (sysfs.Attributes, error) {
+		return sysfs.Attributes{Name: diskName, Model: "My Book", Serial: "AAA"}, nil
+	}
+	config := &Config{Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI, ApmLevel: 127}, NameMap: map[string]string{}}
+	tm := newTestMonitor(config)
+	tm.restored = map[string]savedDisk{"My Book AAA": {Identity: "My Book AAA", Name: "sdzz", Reads: 10, Writes: 20, SpunDown: true}}
+
+	/* programming the drive would spin it up */
+	tm.disks = append(tm.disks, tm.initDevice(DiskStats{Name: "sdzz", Reads: 10, Writes: 20}))
+	if sent := tm.executor.sent(); len(sent) != 0 || !tm.disks[0].SpunDown {
+		t.Fatalf("Expected the disk to be left spun down but found %v %+v", sent, tm.disks[0])
+	}
+
+	tm.updateState(DiskStats{Name: "sdzz", Reads: 11, Writes: 20})
+	if sent := tm.executor.sent(); len(sent) != 1 || sent[0] != "firmware sdzz" {
+		t.Fatalf("Expected the firmware settings to be applied on spin up but found %v", sent)
+	}
+}
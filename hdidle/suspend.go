@@ -0,0 +1,127 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package hdidle
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	clockMonotonic = 1
+	clockBoottime  = 7
+
+	// minSuspendTime is the time the system must have been suspended for to
+	// assume the disks lost power. Both clocks are not read at the same
+	// instant, so they drift apart a little on every loop.
+	minSuspendTime = time.Second
+
+	// defaultSkewTime is taken for a configuration without a skew time:
+	// three times the poll interval of the default idle time, as hd-idle
+	// sets it.
+	defaultSkewTime = 3 * DefaultIdleTime / 10
+)
+
+// clocks is a reading of CLOCK_MONOTONIC, which stops while the system is
+// suspended, and of CLOCK_BOOTTIME, which keeps counting. Neither of them is
+// stepped by NTP or changes with the time zone.
+type clocks struct {
+	monotonic time.Duration
+	boottime  time.Duration
+}
+
+func clockGettime(clock int) (time.Duration, error) {
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, uintptr(clock), uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return time.Duration(ts.Nano()), nil
+}
+
+// timeSuspended returns how long the system was suspended since the previous
+// call: the time CLOCK_BOOTTIME advanced by and CLOCK_MONOTONIC didn't. On
+// kernels without CLOCK_BOOTTIME a wall clock gap between two loops above
+// the skew time, or defaultSkewTime if none is set, is taken for a suspend
+// instead, as it may as well be.
+func (m *Monitor) timeSuspended() time.Duration {
+	monotonic, boottime, err := m.clock.Uptime()
+	if err != nil {
+		skewTime := m.config.SkewTime
+		if skewTime <= 0 {
+			skewTime = defaultSkewTime
+		}
+		/* Round(0) strips the monotonic reading, which stops while suspended */
+		if gap := m.now.Round(0).Sub(m.lastNow.Round(0)); gap > skewTime {
+			return gap
+		}
+		return 0
+	}
+	current := clocks{monotonic: monotonic, boottime: boottime}
+	previous := m.lastClocks
+	m.lastClocks = current
+	if previous == (clocks{}) {
+		return 0
+	}
+	suspended := (current.boottime - previous.boottime) - (current.monotonic - previous.monotonic)
+	if suspended < minSuspendTime {
+		return 0
+	}
+	return suspended
+}
+
+// resumeDisk updates the state of a disk after the system was suspended or
+// hibernated. The disk may have been powered off and spun up on resume, so it
+// is taken as spinning with its idle time started over. If it was spun down
+// before and saw no I/O since, the resume policy ResumeRestore sends it the
+// spin down command right away, and ResumeVerify asks the drive first and
+// only sends it if the drive is not in standby.
+func (m *Monitor) resumeDisk(dsi int, tmp DiskStats) {
+	ds := m.disks[dsi]
+	name := m.config.resolveDeviceGivenName(ds.Name)
+	restore := (ds.ResumePolicy == ResumeRestore || ds.ResumePolicy == ResumeVerify) &&
+		ds.SpunDown && tmp.Reads == ds.Reads && tmp.Writes == ds.Writes &&
+		ds.IdleTime != 0 && len(ds.CommandType) > 0 && !ds.Suspended && !ds.CommandInProgress &&
+		!m.now.Before(ds.RetryAt)
+	if restore && ds.ResumePolicy == ResumeVerify {
+		m.disks[dsi].PowerCheckAt = m.now
+		state, err := m.queryPowerState(&m.disks[dsi])
+		if err != nil {
+			m.debugf("cannot query power state of disk %s: %s", ds.Name, err)
+		}
+		if err == nil && isSpunDown(state, ds.CommandType, ds.PowerCondition) {
+			/* the disk slept through the suspend and kept its settings */
+			m.emit(EventInfo, ds.Name, "%s still spun down after resume, drive reports %s", name, state)
+			return
+		}
+	}
+
+	/* reset spin status and timers */
+	m.disks[dsi].SpinUpAt = m.now
+	m.disks[dsi].LastIoAt = m.now
+	m.disks[dsi].SpunDown = false
+	m.logSpinupAfterSleep(ds.Name)
+	/* the drive may have lost its settings while powered off */
+	m.applyFirmwareSettings(&m.disks[dsi])
+
+	if restore && m.submitSpindown(m.disks[dsi]) {
+		m.emit(EventSpindown, ds.Name, "%s spindown after resume", name)
+		m.disks[dsi].CommandInProgress = true
+		m.disks[dsi].CommandStartedAt = m.now
+	}
+}
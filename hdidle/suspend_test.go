@@ -0,0 +1,184 @@
+package hdidle
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/sgio"
+	"testing"
+	"time"
+)
+
+func TestTimeSuspended(t *testing.T) {
+	tm := newTestMonitor(&Config{})
+	tests := []struct {
+		name     string
+		clocks   clocks
+		err      error
+		skewTime time.Duration
+		wallGap  time.Duration
+		want     time.Duration
+	}{
+		{
+			name:   "first reading",
+			clocks: clocks{monotonic: time.Hour, boottime: 2 * time.Hour},
+		},
+		{
+			name:   "no suspend",
+			clocks: clocks{monotonic: time.Hour + time.Minute, boottime: 2*time.Hour + time.Minute},
+		},
+		{
+			name:    "clock stepped by NTP",
+			clocks:  clocks{monotonic: time.Hour + 2*time.Minute, boottime: 2*time.Hour + 2*time.Minute},
+			wallGap: 3 * time.Hour,
+		},
+		{
+			name:   "drift between the readings",
+			clocks: clocks{monotonic: time.Hour + 3*time.Minute, boottime: 2*time.Hour + 3*time.Minute + time.Millisecond},
+		},
+		{
+			name:   "short suspend",
+			clocks: clocks{monotonic: time.Hour + 4*time.Minute, boottime: 2*time.Hour + 4*time.Minute + 5*time.Second},
+			want:   5*time.Second - time.Millisecond,
+		},
+		{
+			name:   "long suspend",
+			clocks: clocks{monotonic: time.Hour + 5*time.Minute, boottime: 5*time.Hour + 5*time.Minute + 5*time.Second},
+			want:   3 * time.Hour,
+		},
+		{
+			name:     "no boot clock, wall clock gap",
+			err:      fmt.Errorf("invalid argument"),
+			skewTime: time.Minute,
+			wallGap:  10 * time.Minute,
+			want:     10 * time.Minute,
+		},
+		{
+			name:     "no boot clock, no gap",
+			err:      fmt.Errorf("invalid argument"),
+			skewTime: time.Minute,
+			wallGap:  10 * time.Second,
+		},
+		{
+			name:    "no boot clock, no skew time, poll gap",
+			err:     fmt.Errorf("invalid argument"),
+			wallGap: time.Minute,
+		},
+		{
+			name:    "no boot clock, no skew time, wall clock gap",
+			err:     fmt.Errorf("invalid argument"),
+			wallGap: 10 * time.Minute,
+			want:    10 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm.clock.monotonic, tm.clock.boottime, tm.clock.err = tt.clocks.monotonic, tt.clocks.boottime, tt.err
+			tm.config.SkewTime = tt.skewTime
+			tm.lastNow = tm.now.Add(-tt.wallGap)
+			if got := tm.timeSuspended(); got != tt.want {
+				t.Fatalf("Expected %v but found %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUpdateStateAfterSuspend(t *testing.T) {
+	config := &Config{
+		Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI},
+		NameMap:  map[string]string{},
+	}
+	spunDownAt := testStart.Add(-time.Hour)
+	tm := newTestMonitor(config, DiskStats{
+		Name:        "sdzz",
+		IdleTime:    600 * time.Second,
+		CommandType: SCSI,
+		Reads:       100,
+		Writes:      200,
+		LastIoAt:    spunDownAt,
+		SpinDownAt:  spunDownAt,
+		SpunDown:    true,
+	})
+
+	tm.updateState(DiskStats{Name: "sdzz", Reads: 100, Writes: 200})
+	if !tm.disks[0].SpunDown {
+		t.Fatal("Expected the disk to stay spun down without a suspend")
+	}
+
+	tm.suspendedFor = time.Hour
+	tm.updateState(DiskStats{Name: "sdzz", Reads: 100, Writes: 200})
+	if ds := tm.disks[0]; ds.SpunDown || ds.LastIoAt != testStart {
+		t.Fatalf("Expected the disk to be taken as spun up after the suspend but found %+v", ds)
+	}
+}
+
+func TestSystemClockUptime(t *testing.T) {
+	monotonic, boottime, err := systemClock{}.Uptime()
+	if err != nil {
+		t.Skipf("Clocks not available: %s", err)
+	}
+	if monotonic <= 0 || boottime < monotonic {
+		t.Fatalf("Expected the boot time to be at least the monotonic time but found %v %v", boottime, monotonic)
+	}
+}
+
+func TestResumeDisk(t *testing.T) {
+	config := &Config{NameMap: map[string]string{}}
+	spunDownAt := testStart.Add(-time.Hour)
+	tests := []struct {
+		name      string
+		policy    string
+		spunDown  bool
+		reads     uint64
+		state     sgio.PowerState
+		stateErr  error
+		wantDown  bool
+		wantQuery bool
+		wantSent  bool
+	}{
+		{name: "reset", policy: ResumeReset, spunDown: true},
+		{name: "empty is reset", policy: "", spunDown: true},
+		{name: "restore", policy: ResumeRestore, spunDown: true, wantSent: true},
+		{name: "restore spinning disk", policy: ResumeRestore},
+		{name: "restore disk used since", policy: ResumeRestore, spunDown: true, reads: 1},
+		{name: "verify standby", policy: ResumeVerify, spunDown: true, state: sgio.PowerStateStandby,
+			wantDown: true, wantQuery: true},
+		{name: "verify active", policy: ResumeVerify, spunDown: true, state: sgio.PowerStateActive,
+			wantQuery: true, wantSent: true},
+		{name: "verify failed", policy: ResumeVerify, spunDown: true, stateErr: fmt.Errorf("not supported"),
+			wantQuery: true, wantSent: true},
+		{name: "verify spinning disk", policy: ResumeVerify},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestMonitor(config, DiskStats{
+				Name:         "sdzz",
+				IdleTime:     600 * time.Second,
+				CommandType:  SCSI,
+				ResumePolicy: tt.policy,
+				Reads:        100,
+				Writes:       200,
+				LastIoAt:     spunDownAt,
+				SpinDownAt:   spunDownAt,
+				SpunDown:     tt.spunDown,
+			})
+			tm.executor.state, tm.executor.stateErr = tt.state, tt.stateErr
+
+			tm.resumeDisk(0, DiskStats{Name: "sdzz", Reads: 100 + tt.reads, Writes: 200})
+
+			ds := tm.disks[0]
+			queried := len(tm.executor.sent()) > 0 && tm.executor.sent()[0] == "powerstate sdzz"
+			if ds.SpunDown != tt.wantDown || queried != tt.wantQuery || ds.CommandInProgress != tt.wantSent {
+				t.Fatalf("Expected spunDown=%t queried=%t sent=%t but found %t %t %t",
+					tt.wantDown, tt.wantQuery, tt.wantSent, ds.SpunDown, queried, ds.CommandInProgress)
+			}
+			if !tt.wantDown && ds.LastIoAt != testStart {
+				t.Fatalf("Expected the idle time to start over but found %v", ds.LastIoAt)
+			}
+			if tt.wantSent {
+				tm.waitSpindowns(t)
+				if ds := tm.disks[0]; !ds.SpunDown {
+					t.Fatalf("Expected the disk to be spun down again but found %+v", ds)
+				}
+			}
+		})
+	}
+}
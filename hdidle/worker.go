@@ -0,0 +1,322 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package hdidle
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/sgio"
+	"time"
+)
+
+// spindownWorkers is the number of disks spun down at the same time. A disk
+// whose bridge hangs the command only blocks its own worker.
+const spindownWorkers = 4
+
+// stuckCommandTime is how long a command runs before it is reported as stuck.
+const stuckCommandTime = 2 * time.Minute
+
+// commandWaitTime is how long the monitor waits for a command it sends to a
+// disk itself, like a power state query, before going on with the other
+// disks. Tests replace it.
+var commandWaitTime = 15 * time.Second
+
+// maxSpindownBackoff is the longest wait between two spin downs of a disk
+// whose spin down keeps failing.
+const maxSpindownBackoff = time.Hour
+
+type spindownJob struct {
+	ds    DiskStats
+	debug bool
+}
+
+// spindownResult reports a spin down back to the monitor loop.
+type spindownResult struct {
+	name string
+	// command is the command type which was sent last, the detected one
+	// may have been switched
+	command string
+	err     error
+	// state is the power state the drive reported after the command, if
+	// it was queried
+	state    sgio.PowerState
+	stateErr error
+}
+
+func (m *Monitor) startSpindownWorkers() {
+	m.spindownJobs = make(chan spindownJob, spindownWorkers)
+	m.spindownResults = make(chan spindownResult, spindownWorkers)
+	m.closed = make(chan struct{})
+	for i := 0; i < spindownWorkers; i++ {
+		go func() {
+			for job := range m.spindownJobs {
+				if m.isClosed() {
+					/* queued before Close */
+					continue
+				}
+				result := spindownWithState(m.executor, job.ds, job.debug)
+				select {
+				case m.spindownResults <- result:
+				case <-m.closed:
+				}
+			}
+		}()
+	}
+}
+
+// Close stops the spin down workers of the monitor once it is no longer
+// used. The spin downs already sent to the disks complete in the background
+// and their results are dropped. No spin down is sent after Close.
+func (m *Monitor) Close() {
+	/* the workers are not started by a Step after Close */
+	m.spindownOnce.Do(func() {})
+	if m.closed == nil || m.isClosed() {
+		return
+	}
+	close(m.closed)
+	close(m.spindownJobs)
+}
+
+func (m *Monitor) isClosed() bool {
+	select {
+	case <-m.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// submitSpindown queues the spin down of the disk. It returns false if all
+// workers are busy, in which case the spin down is tried again on the next
+// poll.
+func (m *Monitor) submitSpindown(ds DiskStats) bool {
+	m.spindownOnce.Do(m.startSpindownWorkers)
+	if m.spindownJobs == nil || m.isClosed() {
+		return false
+	}
+	select {
+	case m.spindownJobs <- spindownJob{ds: ds, debug: m.config.Defaults.Debug}:
+		return true
+	default:
+		return false
+	}
+}
+
+// collectSpindowns applies the results of the spin downs completed since the
+// last poll, without waiting for the ones still running.
+func (m *Monitor) collectSpindowns() {
+	if m.spindownResults == nil {
+		return
+	}
+	for {
+		select {
+		case result := <-m.spindownResults:
+			if dsi := m.diskIndex(result.name); dsi >= 0 {
+				m.finishSpindown(dsi, result)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// spindownWithState spins the disk down and asks it for its power state
+// afterwards, if configured to.
+func spindownWithState(executor Executor, ds DiskStats, debug bool) spindownResult {
+	result := spindownResult{name: ds.Name}
+	result.command, result.err = executor.Spindown(ds, debug)
+	if ds.QueryPowerState {
+		ds.CommandType = result.command
+		result.state, result.stateErr = executor.PowerState(ds, debug)
+	}
+	return result
+}
+
+// finishSpindown updates the state of the disk with the result of its spin
+// down command.
+func (m *Monitor) finishSpindown(dsi int, result spindownResult) {
+	ds := m.disks[dsi]
+	m.disks[dsi].CommandInProgress = false
+	if m.now.Sub(ds.CommandStartedAt) > stuckCommandTime {
+		m.emit(EventInfo, ds.Name, "%s command completed after %v",
+			m.config.resolveDeviceGivenName(ds.Name), m.now.Sub(ds.CommandStartedAt).Round(time.Second))
+	}
+
+	if result.err != nil {
+		/* the disk is not marked spun down, it is tried again after a backoff */
+		m.spindownFailed(dsi, result.err)
+		return
+	}
+	if result.command != ds.CommandType && ds.AutoCommandType {
+		/* the disk rejected the detected command type, keep the one that worked */
+		m.emit(EventInfo, ds.Name, "%s rejected the %s command, using %s",
+			m.config.resolveDeviceGivenName(ds.Name), ds.CommandType, result.command)
+		m.disks[dsi].CommandType = result.command
+		m.disks[dsi].AutoCommandType = false
+	}
+	m.debugf("disk=%s spindown sent with %s", ds.Name, commandMethod(m.disks[dsi]))
+	m.disks[dsi].Failures = 0
+	m.disks[dsi].RetryAt = time.Time{}
+	m.disks[dsi].LastSpunDownAt = m.now
+	if ds.LastIoAt.After(ds.CommandStartedAt) {
+		/* the disk was used while the command ran and may be spinning again */
+		return
+	}
+	if ds.QueryPowerState {
+		m.disks[dsi].PowerCheckAt = m.now
+		if result.stateErr == nil && !isSpunDown(result.state, result.command, ds.PowerCondition) {
+			/* the drive refused to spin down, try again after another idle time */
+			m.emit(EventSpindownFailed, ds.Name, "%s did not spin down, drive reports %s",
+				m.config.resolveDeviceGivenName(ds.Name), result.state)
+			return
+		}
+	}
+	m.disks[dsi].SpinDownAt = m.now
+	m.disks[dsi].SpunDown = true
+}
+
+// spindownFailed handles a failed spin down of the disk by the class of the
+// error. A disk which is gone is dropped, and a disk rejecting the command is
+// not sent it anymore. Other errors, retryable ones included, are counted and
+// the next attempt is scheduled with exponential backoff: a bridge hanging
+// the command until it times out would otherwise get it on every poll. After
+// MaxFailures failures in a row, spin down is suspended for the disk until
+// the configuration is reloaded.
+func (m *Monitor) spindownFailed(dsi int, err error) {
+	ds := &m.disks[dsi]
+	name := m.config.resolveDeviceGivenName(ds.Name)
+	class := sgio.Classify(err)
+	ds.TotalFailures++
+	ds.LastError = err.Error()
+	ds.LastErrorAt = m.now
+
+	m.emit(EventSpindownFailed, ds.Name, "%s", err)
+	logToFile(m.config.Defaults.LogFile,
+		fmt.Sprintf("date: %s, time: %s, disk: %s, spindown failed (%s, %d in a row): %s",
+			m.now.Format("2006-01-02"), m.now.Format("15:04:05"), name, class, ds.Failures+1, err))
+
+	switch class {
+	case sgio.ErrorClassDeviceGone:
+		/* the disk shows up again as a new one if it comes back */
+		m.emit(EventDiskRemoved, ds.Name, "%s is gone, dropping it", name)
+		m.removeDiskAt(dsi)
+		return
+	case sgio.ErrorClassUnsupported:
+		/* sending it again is of no use */
+		ds.Failures++
+		m.suspendSpindown(ds, name, "the disk rejects the command")
+		return
+	}
+
+	ds.Failures++
+	ds.RetryAt = m.now.Add(spindownBackoff(ds.Failures))
+	if maxFailures := m.config.Defaults.MaxFailures; maxFailures > 0 && ds.Failures >= maxFailures {
+		m.suspendSpindown(ds, name, fmt.Sprintf("after %d failures", ds.Failures))
+		return
+	}
+	m.emit(EventInfo, ds.Name, "%s spindown failed %d times (%s), retrying in %v",
+		name, ds.Failures, class, ds.RetryAt.Sub(m.now))
+}
+
+// suspendSpindown stops sending the spin down command to the disk until the
+// configuration is reloaded.
+func (m *Monitor) suspendSpindown(ds *DiskStats, name, reason string) {
+	ds.Suspended = true
+	m.emit(EventInfo, ds.Name, "%s spindown suspended %s, reload the configuration to resume", name, reason)
+	logToFile(m.config.Defaults.LogFile,
+		fmt.Sprintf("date: %s, time: %s, disk: %s, spindown suspended %s",
+			m.now.Format("2006-01-02"), m.now.Format("15:04:05"), name, reason))
+}
+
+// spindownBackoff returns the time to wait before the next spin down after
+// the given number of failures in a row: a minute after the first failure,
+// doubled after each further one, up to an hour.
+func spindownBackoff(failures int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < failures && backoff < maxSpindownBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxSpindownBackoff {
+		return maxSpindownBackoff
+	}
+	return backoff
+}
+
+// reportStuckCommand logs once that the command of the disk has not
+// completed yet. The disk is not sent another command until it does.
+func (m *Monitor) reportStuckCommand(ds DiskStats) {
+	running := m.now.Sub(ds.CommandStartedAt)
+	if running > stuckCommandTime && m.lastNow.Sub(ds.CommandStartedAt) <= stuckCommandTime {
+		m.emit(EventInfo, ds.Name, "%s command in progress for %v, the disk or its bridge may hang",
+			m.config.resolveDeviceGivenName(ds.Name), running.Round(time.Second))
+	}
+}
+
+// runCommand sends a command to the disk and waits for it for up to
+// commandWaitTime, so that a bridge hanging the command doesn't block the
+// monitor. The disk is sent no other command until the one given up on
+// completes.
+func (m *Monitor) runCommand(ds *DiskStats, command func() error) error {
+	if ds.commandHung() {
+		return fmt.Errorf("%s has not completed its previous command yet", ds.Name)
+	}
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		err = command()
+	}()
+	timer := time.NewTimer(commandWaitTime)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return err
+	case <-timer.C:
+		ds.hungCommand = done
+		return fmt.Errorf("%s has not completed the command after %v, waiting for it in the background",
+			ds.Name, commandWaitTime)
+	}
+}
+
+// commandHung tells whether a command runCommand gave up waiting for is still
+// running.
+func (ds *DiskStats) commandHung() bool {
+	if ds.hungCommand == nil {
+		return false
+	}
+	select {
+	case <-ds.hungCommand:
+		ds.hungCommand = nil
+		return false
+	default:
+		return true
+	}
+}
+
+// queryPowerState asks the drive for its power state, see runCommand.
+func (m *Monitor) queryPowerState(ds *DiskStats) (sgio.PowerState, error) {
+	query := *ds
+	state := sgio.PowerStateUnknown
+	err := m.runCommand(ds, func() error {
+		var err error
+		state, err = m.executor.PowerState(query, m.config.Defaults.Debug)
+		return err
+	})
+	if err != nil {
+		return sgio.PowerStateUnknown, err
+	}
+	return state, nil
+}
@@ -0,0 +1,257 @@
+package hdidle
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/sgio"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSpindownInWorker(t *testing.T) {
+	config := &Config{
+		Defaults: DefaultConf{Idle: DefaultIdleTime, CommandType: SCSI},
+		NameMap:  map[string]string{},
+		SkewTime: time.Hour,
+	}
+	tm := newTestMonitor(config, DiskStats{
+		Name:        "sdzz",
+		IdleTime:    600 * time.Second,
+		CommandType: SCSI,
+		Reads:       100,
+		Writes:      200,
+		LastIoAt:    testStart.Add(-time.Hour),
+	})
+	tm.executor.block = make(chan struct{})
+
+	/* the command hangs, the disk is not sent another one */
+	for i := 0; i < 3; i++ {
+		tm.updateState(DiskStats{Name: "sdzz", Reads: 100, Writes: 200})
+		if !tm.disks[0].CommandInProgress || tm.disks[0].SpunDown {
+			t.Fatalf("Expected command in progress but found %+v", tm.disks[0])
+		}
+	}
+
+	close(tm.executor.block)
+	tm.waitSpindowns(t)
+	if ds := tm.disks[0]; !ds.SpunDown {
+		t.Fatalf("Expected disk spun down but found %+v", ds)
+	}
+	if sent := tm.executor.sent(); len(sent) != 1 {
+		t.Fatalf("Expected 1 command but found %v", sent)
+	}
+}
+
+func TestClose(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	tm := newTestMonitor(&Config{NameMap: map[string]string{}}, DiskStats{Name: "sdzz", CommandType: SCSI})
+	tm.executor.block = make(chan struct{})
+	if !tm.submitSpindown(tm.disks[0]) {
+		t.Fatal("Expected the spin down to be queued")
+	}
+
+	tm.Close()
+	tm.Close()
+	if tm.submitSpindown(tm.disks[0]) {
+		t.Fatal("Expected no spin down to be queued after Close")
+	}
+	close(tm.executor.block)
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d goroutines but found %d", goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	/* a monitor which never spun a disk down */
+	newTestMonitor(&Config{NameMap: map[string]string{}}).Close()
+}
+
+func TestRunCommandHangs(t *testing.T) {
+	defer func(original time.Duration) { commandWaitTime = original }(commandWaitTime)
+	commandWaitTime = 10 * time.Millisecond
+	tm := newTestMonitor(&Config{NameMap: map[string]string{}},
+		DiskStats{Name: "sdzz", CommandType: SCSI, QueryPowerState: true})
+	tm.executor.state = sgio.PowerStateStandby
+	tm.executor.stateBlock = make(chan struct{})
+
+	if _, err := tm.queryPowerState(&tm.disks[0]); err == nil {
+		t.Fatal("Expected the query to be given up on")
+	}
+	/* the disk is not sent another command while the first one hangs */
+	if _, err := tm.queryPowerState(&tm.disks[0]); err == nil || len(tm.executor.sent()) != 1 {
+		t.Fatalf("Expected no other command but found %v, %v", tm.executor.sent(), err)
+	}
+
+	close(tm.executor.stateBlock)
+	deadline := time.Now().Add(5 * time.Second)
+	for tm.disks[0].commandHung() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the command to complete")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if state, err := tm.queryPowerState(&tm.disks[0]); err != nil || state != sgio.PowerStateStandby {
+		t.Fatalf("Expected %v but found %v, %v", sgio.PowerStateStandby, state, err)
+	}
+}
+
+func TestFinishSpindown(t *testing.T) {
+	config := &Config{NameMap: map[string]string{}}
+	startedAt := testStart.Add(-time.Minute)
+	tests := []struct {
+		name     string
+		lastIoAt time.Time
+		result   spindownResult
+		spunDown bool
+		command  string
+	}{
+		{
+			name:     "spun down",
+			result:   spindownResult{name: "sdzz", command: SCSI},
+			spunDown: true,
+			command:  SCSI,
+		},
+		{
+			name:     "other command type",
+			result:   spindownResult{name: "sdzz", command: ATA},
+			spunDown: true,
+			command:  ATA,
+		},
+		{
+			name:     "disk used meanwhile",
+			lastIoAt: testStart,
+			result:   spindownResult{name: "sdzz", command: SCSI},
+			spunDown: false,
+			command:  SCSI,
+		},
+		{
+			name:     "drive still active",
+			result:   spindownResult{name: "sdzz", command: SCSI, state: sgio.PowerStateActive},
+			spunDown: false,
+			command:  SCSI,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestMonitor(config, DiskStats{
+				Name:              "sdzz",
+				CommandType:       SCSI,
+				AutoCommandType:   true,
+				QueryPowerState:   true,
+				LastIoAt:          tt.lastIoAt,
+				CommandInProgress: true,
+				CommandStartedAt:  startedAt,
+			})
+			if tt.result.state == sgio.PowerStateUnknown {
+				tt.result.state = sgio.PowerStateStandby
+			}
+			tm.finishSpindown(0, tt.result)
+			ds := tm.disks[0]
+			if ds.CommandInProgress || ds.SpunDown != tt.spunDown || ds.CommandType != tt.command {
+				t.Fatalf("Expected spunDown=%t command=%s but found %+v", tt.spunDown, tt.command, ds)
+			}
+			if tt.command != SCSI && (len(tm.events) == 0 || tm.events[0].Message != "sdzz rejected the scsi command, using ata") {
+				t.Fatalf("Expected the command type switch to be reported but found %v", tm.events)
+			}
+		})
+	}
+}
+
+func TestSpindownFailures(t *testing.T) {
+	config := &Config{
+		Defaults: DefaultConf{MaxFailures: 3},
+		NameMap:  map[string]string{},
+	}
+	tm := newTestMonitor(config, DiskStats{Name: "sdzz", CommandType: ATA, IdleTime: time.Hour})
+	failed := spindownResult{name: "sdzz", command: ATA, err: fmt.Errorf("cannot spindown ata disk /dev/sdzz: %w", syscall.EBUSY)}
+
+	for i := 1; i <= 3; i++ {
+		tm.disks[0].CommandInProgress = true
+		tm.finishSpindown(0, failed)
+		ds := tm.disks[0]
+		if ds.SpunDown || ds.CommandInProgress || ds.Failures != i || !ds.LastSpunDownAt.IsZero() {
+			t.Fatalf("Expected %d failures without spin down but found %+v", i, ds)
+		}
+		if expected := testStart.Add(spindownBackoff(i)); ds.RetryAt != expected {
+			t.Fatalf("Expected retry at %v but found %v", expected, ds.RetryAt)
+		}
+		if ds.Suspended != (i == 3) {
+			t.Fatalf("Expected suspended=%t after %d failures", i == 3, i)
+		}
+	}
+	if ds := tm.disks[0]; ds.LastError != failed.err.Error() || ds.TotalFailures != 3 {
+		t.Fatalf("Expected the last error to be kept but found %+v", ds)
+	}
+
+	/* a suspended disk is not sent the command anymore */
+	tm.disks[0].RetryAt = time.Time{}
+	tm.updateState(DiskStats{Name: "sdzz"})
+	if tm.disks[0].CommandInProgress {
+		t.Fatal("Expected no spin down of a suspended disk")
+	}
+
+	tm.disks[0].Suspended = false
+	tm.finishSpindown(0, spindownResult{name: "sdzz", command: ATA})
+	if ds := tm.disks[0]; !ds.SpunDown || ds.Failures != 0 || ds.TotalFailures != 3 {
+		t.Fatalf("Expected the failures to be reset on success but found %+v", ds)
+	}
+}
+
+func TestSpindownFailureClasses(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantDisks     int
+		wantFailures  int
+		wantRetryAt   bool
+		wantSuspended bool
+	}{
+		{name: "failed", err: syscall.EIO, wantDisks: 1, wantFailures: 1, wantRetryAt: true},
+		{name: "retryable", err: syscall.EBUSY, wantDisks: 1, wantFailures: 1, wantRetryAt: true},
+		{name: "device gone", err: syscall.ENODEV},
+		{name: "unsupported", err: sgio.ErrUnsupportedCommand, wantDisks: 1, wantFailures: 1, wantSuspended: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Defaults: DefaultConf{MaxFailures: 3}, NameMap: map[string]string{}}
+			tm := newTestMonitor(config, DiskStats{Name: "sdzz", CommandType: ATA, IdleTime: time.Hour, CommandInProgress: true})
+
+			tm.finishSpindown(0, spindownResult{name: "sdzz", command: ATA,
+				err: fmt.Errorf("cannot spindown ata disk /dev/sdzz: %w", tt.err)})
+
+			if len(tm.disks) != tt.wantDisks {
+				t.Fatalf("Expected %d disks but found %+v", tt.wantDisks, tm.disks)
+			}
+			if tt.wantDisks == 0 {
+				return
+			}
+			ds := tm.disks[0]
+			if ds.SpunDown || ds.Failures != tt.wantFailures || !ds.RetryAt.IsZero() != tt.wantRetryAt ||
+				ds.Suspended != tt.wantSuspended || ds.TotalFailures != 1 {
+				t.Fatalf("Expected failures=%d retryAt=%t suspended=%t but found %+v",
+					tt.wantFailures, tt.wantRetryAt, tt.wantSuspended, ds)
+			}
+		})
+	}
+}
+
+func TestSpindownBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{7, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := spindownBackoff(tt.failures); got != tt.want {
+			t.Errorf("spindownBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/adelolmo/hd-idle/uevent"
+	"syscall"
+)
+
+// watchDisks listens for disks being added, removed and changed. The channel
+// is nil if the uevents of the kernel cannot be received, in which case disks
+// are only picked up and dropped when polling.
+func watchDisks() <-chan uevent.Event {
+	listener, err := uevent.Listen()
+	if err != nil {
+		fmt.Printf("Cannot listen for disk events, disks are detected when polling: %s\n", err)
+		return nil
+	}
+	events := make(chan uevent.Event, 16)
+	go func() {
+		defer listener.Close()
+		for {
+			event, err := listener.Read()
+			if err == syscall.ENOBUFS {
+				/* events were lost, polling catches up with them */
+				continue
+			}
+			if err != nil {
+				fmt.Printf("Cannot read disk events, disks are detected when polling: %s\n", err)
+				return
+			}
+			if event.Subsystem == "block" && event.DevType == "disk" && len(event.DevName) > 0 {
+				events <- event
+			}
+		}
+	}()
+	return events
+}
@@ -20,31 +20,169 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"syscall"
 )
 
+// tags maps the fstab forms of naming a file system to the directories of
+// the symlinks udev creates for them.
+var tags = []struct{ prefix, dir string }{
+	{"LABEL=", "by-label"},
+	{"UUID=", "by-uuid"},
+	{"PARTUUID=", "by-partuuid"},
+	{"PARTLABEL=", "by-partlabel"},
+}
+
+// resolver maps device names to disks, looking up device nodes in devDir and
+// block devices in sysBlockDir. Tests point them to a temporary directory.
+type resolver struct {
+	devDir      string
+	sysBlockDir string
+}
+
+var defaultResolver = resolver{devDir: "/dev", sysBlockDir: "/sys/class/block"}
+
+// Disks returns the kernel names of the disks the device is stored on. The
+// device is a kernel name like sda or md0, a path like /dev/sda1,
+// /dev/mapper/vg-lv or /dev/disk/by-id/..., or LABEL=, UUID=, PARTUUID= and
+// PARTLABEL= as in fstab. Symlinks are followed, partitions map to the disk
+// they are on, and device mapper and md devices to the disks underneath them,
+// so LVM and RAID volumes resolve to several disks.
+//
+// Kernel names and paths in /dev of disks not plugged in yet, and glob
+// patterns, are returned as they are, without the directory.
+func Disks(name string) ([]string, error) {
+	return defaultResolver.disks(name)
+}
+
+// RealPath returns the kernel name of the only disk the device is stored on,
+// see Disks.
 func RealPath(path string) (string, error) {
-	if path[0] != '/' {
-		return path, nil
-	}
-	if !strings.Contains(path, "by-") {
-		return filepath.Base(path), nil
-	}
-	s, err := os.Readlink(path)
-	if err == nil {
-		device := filepath.Base(s)
-		/* remove partition numbers, if any */
-		for {
-			i := device[len(device)-1:]
-			_, err := strconv.Atoi(i)
-			if err != nil {
-				break
+	disks, err := Disks(path)
+	if err != nil {
+		return "", err
+	}
+	if len(disks) > 1 {
+		return "", fmt.Errorf("cannot resolve %s: it spans the disks %s", path, strings.Join(disks, ", "))
+	}
+	return disks[0], nil
+}
+
+// FileDisks returns the kernel names of the disks the file is stored on, none
+// if its file system is not on a block device, like tmpfs.
+func FileDisks(path string) ([]string, error) {
+	return defaultResolver.fileDisks(path)
+}
+
+func (r resolver) disks(name string) ([]string, error) {
+	if len(name) == 0 {
+		return nil, fmt.Errorf("cannot resolve an empty device name")
+	}
+	if strings.ContainsAny(name, "*?[") {
+		return []string{filepath.Base(name)}, nil
+	}
+	for _, tag := range tags {
+		if strings.HasPrefix(name, tag.prefix) {
+			link := filepath.Join(r.devDir, "disk", tag.dir, strings.TrimPrefix(name, tag.prefix))
+			if _, err := os.Lstat(link); err != nil {
+				return nil, fmt.Errorf("cannot resolve %s: no file system with this %s, %s does not exist",
+					name, strings.ToLower(strings.TrimSuffix(tag.prefix, "=")), link)
 			}
-			device = device[:len(device)-1]
+			return r.pathDisks(name, link)
+		}
+	}
+	if !strings.HasPrefix(name, "/") {
+		if r.isBlockDevice(name) {
+			return r.underlyingDisks(name, map[string]bool{})
+		}
+		if path := filepath.Join(r.devDir, name); strings.Contains(name, "/") && exists(path) {
+			/* e.g. mapper/vg-lv or vg/lv */
+			return r.pathDisks(name, path)
+		}
+		return []string{name}, nil
+	}
+	return r.pathDisks(name, name)
+}
+
+// pathDisks follows the symlinks of the path to the device node, whose name
+// is the kernel name of the block device.
+func (r resolver) pathDisks(name, path string) ([]string, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) && filepath.Dir(path) == r.devDir {
+		/* a disk not plugged in yet */
+		return []string{filepath.Base(path)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %s: %w", name, err)
+	}
+	device := filepath.Base(target)
+	if !r.isBlockDevice(device) {
+		return nil, fmt.Errorf("cannot resolve %s: %s is not a block device", name, target)
+	}
+	return r.underlyingDisks(device, map[string]bool{})
+}
+
+// underlyingDisks maps a partition to its disk, and a device mapper or md
+// device to the disks of the devices it is built from, recursively.
+func (r resolver) underlyingDisks(device string, seen map[string]bool) ([]string, error) {
+	if seen[device] {
+		return nil, nil
+	}
+	seen[device] = true
+	dir := filepath.Join(r.sysBlockDir, device)
+	if exists(filepath.Join(dir, "partition")) {
+		/* /sys/class/block/sda1 links to .../block/sda/sda1 */
+		real, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find the disk of partition %s: %w", device, err)
+		}
+		return r.underlyingDisks(filepath.Base(filepath.Dir(real)), seen)
+	}
+	slaves, err := os.ReadDir(filepath.Join(dir, "slaves"))
+	if err != nil || len(slaves) == 0 {
+		return []string{device}, nil
+	}
+	var disks []string
+	for _, slave := range slaves {
+		slaveDisks, err := r.underlyingDisks(slave.Name(), seen)
+		if err != nil {
+			return nil, err
 		}
-		return device, nil
+		disks = append(disks, slaveDisks...)
 	}
+	if len(disks) == 0 {
+		return nil, fmt.Errorf("cannot find the disks underneath %s", device)
+	}
+	return disks, nil
+}
+
+// fileDisks looks up the block device with the device number of the file
+// system of the file, given in the dev attribute as major:minor.
+func (r resolver) fileDisks(path string) ([]string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return nil, fmt.Errorf("cannot find the disk of %s: %w", path, err)
+	}
+	dev := uint64(st.Dev)
+	number := fmt.Sprintf("%d:%d", (dev>>8)&0xfff|(dev>>32)&^0xfff, dev&0xff|(dev>>12)&^0xff)
+	devices, err := os.ReadDir(r.sysBlockDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the disk of %s: %w", path, err)
+	}
+	for _, device := range devices {
+		content, err := os.ReadFile(filepath.Join(r.sysBlockDir, device.Name(), "dev"))
+		if err == nil && strings.TrimSpace(string(content)) == number {
+			return r.underlyingDisks(device.Name(), map[string]bool{})
+		}
+	}
+	return nil, nil
+}
+
+func (r resolver) isBlockDevice(name string) bool {
+	return !strings.Contains(name, "/") && exists(filepath.Join(r.sysBlockDir, name))
+}
 
-	return "", fmt.Errorf("cannot find device for %s", path)
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
@@ -19,85 +19,149 @@ package io
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 )
 
-func TestRealPath(t *testing.T) {
-
-	type args struct {
-		path string
+// fakeTree creates device nodes and symlinks below dev and the block devices
+// of the kernel below sys, laid out like sysfs: partitions live in the
+// directory of their disk and dm and md devices list theirs in slaves.
+func fakeTree(t *testing.T) resolver {
+	root := t.TempDir()
+	r := resolver{devDir: filepath.Join(root, "dev"), sysBlockDir: filepath.Join(root, "sys", "class", "block")}
+	files := []string{
+		"dev/sdc", "dev/sdc1", "dev/nvme0n1", "dev/nvme0n1p1", "dev/mmcblk0", "dev/mmcblk0p1",
+		"dev/dm-0", "dev/md0", "dev/sdd1", "dev/sde1", "dev/not-a-disk",
+		"sys/devices/sdc/sdc1/partition", "sys/devices/nvme0n1/nvme0n1p1/partition",
+		"sys/devices/mmcblk0/mmcblk0p1/partition", "sys/devices/sdd/sdd1/partition",
+		"sys/devices/sde/sde1/partition",
+		"sys/devices/md0/slaves/sdd1", "sys/devices/md0/slaves/sde1",
+		"sys/devices/dm-0/slaves/md0", "sys/devices/dm-0/slaves/sdc1",
+	}
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"dev/disk/by-id/ata-SAMSUNG_HD103SJ":       "../../sdc",
+		"dev/disk/by-id/ata-SAMSUNG_HD103SJ-part1": "../../sdc1",
+		"dev/disk/by-id/nvme-Samsung_SSD-part1":    "../../nvme0n1p1",
+		"dev/disk/by-id/mmc-SD32G-part1":           "../../mmcblk0p1",
+		"dev/disk/by-id/ata-WRONG":                 "../../sdx",
+		"dev/disk/by-label/disk2":                  "../../sdc1",
+		"dev/disk/by-uuid/100e952e":                "../../sdc1",
+		"dev/disk/by-partuuid/14a81aa8":            "../../nvme0n1p1",
+		"dev/mapper/vg-lv":                         "../dm-0",
+		"dev/vg/lv":                                "../dm-0",
+		"dev/raid":                                 "md0",
+		"dev/disk/by-id/not-a-disk":                "../../not-a-disk",
+	}
+	for _, disk := range []string{"sdc", "nvme0n1", "mmcblk0", "sdd", "sde", "md0", "dm-0"} {
+		links["sys/class/block/"+disk] = "../../devices/" + disk
+	}
+	for _, partition := range []string{"sdc/sdc1", "nvme0n1/nvme0n1p1", "mmcblk0/mmcblk0p1", "sdd/sdd1", "sde/sde1"} {
+		links["sys/class/block/"+filepath.Base(partition)] = "../../devices/" + partition
 	}
+	for link, target := range links {
+		path := filepath.Join(root, link)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func TestDisks(t *testing.T) {
+	r := fakeTree(t)
 	tests := []struct {
-		name          string
-		args          args
-		want          string
-		symlinkTarget string
-		expectError   bool
+		name string
+		path string
+		want []string
+		err  string
 	}{
-		{
-			name: "only device name",
-			args: args{path: "sda"},
-			want: "sda",
-		},
-		{
-			name: "full device path",
-			args: args{path: "/tmp/dev/sda"},
-			want: "sda",
-		},
-		{
-			name:        "wrong symlink by id",
-			args:        args{path: "/tmp/dev/disk/by-id/ata-SAMSUNG_HD103SJ"},
-			want:        "",
-			expectError: true,
-		},
-		{
-			name:          "symlink by id",
-			args:          args{path: "/tmp/dev/disk/by-id/ata-SAMSUNG_HD103SJ"},
-			want:          "sdc",
-			symlinkTarget: "/tmp/dev/sdc",
-		},
-		{
-			name:          "symlink to partition by id",
-			args:          args{path: "/tmp/dev/disk/by-label/disk2"},
-			want:          "sdc",
-			symlinkTarget: "/tmp/dev/sdc1",
-		},
+		{name: "only device name", path: "sdc", want: []string{"sdc"}},
+		{name: "partition name", path: "sdc1", want: []string{"sdc"}},
+		{name: "device not plugged in", path: "sdz", want: []string{"sdz"}},
+		{name: "pattern", path: "sd[c-f]", want: []string{"sd[c-f]"}},
+		{name: "full device path", path: "dev/sdc", want: []string{"sdc"}},
+		{name: "device path not plugged in", path: "dev/sdz", want: []string{"sdz"}},
+		{name: "symlink by id", path: "dev/disk/by-id/ata-SAMSUNG_HD103SJ", want: []string{"sdc"}},
+		{name: "symlink to partition by id", path: "dev/disk/by-id/ata-SAMSUNG_HD103SJ-part1", want: []string{"sdc"}},
+		{name: "symlink to partition by label", path: "dev/disk/by-label/disk2", want: []string{"sdc"}},
+		{name: "nvme partition", path: "dev/disk/by-id/nvme-Samsung_SSD-part1", want: []string{"nvme0n1"}},
+		{name: "mmc partition", path: "dev/disk/by-id/mmc-SD32G-part1", want: []string{"mmcblk0"}},
+		{name: "label", path: "LABEL=disk2", want: []string{"sdc"}},
+		{name: "uuid", path: "UUID=100e952e", want: []string{"sdc"}},
+		{name: "partuuid", path: "PARTUUID=14a81aa8", want: []string{"nvme0n1"}},
+		{name: "md raid", path: "dev/raid", want: []string{"sdd", "sde"}},
+		{name: "lvm by mapper", path: "dev/mapper/vg-lv", want: []string{"sdd", "sde", "sdc"}},
+		{name: "lvm by volume group", path: "dev/vg/lv", want: []string{"sdd", "sde", "sdc"}},
+		{name: "lvm relative to dev", path: "vg/lv", want: []string{"sdd", "sde", "sdc"}},
+		{name: "wrong symlink by id", path: "dev/disk/by-id/ata-WRONG", err: "no such file or directory"},
+		{name: "unknown label", path: "LABEL=nope", err: "no file system with this label"},
+		{name: "not a block device", path: "dev/disk/by-id/not-a-disk", err: "is not a block device"},
 	}
 	for _, tt := range tests {
-		err := os.RemoveAll("/tmp/dev")
-		if err != nil {
-			panic(err)
-		}
-		err = os.MkdirAll("/tmp/dev/disk/by-id", os.ModePerm)
-		if err != nil {
-			panic("cannot create tmp dir")
-		}
-		err = os.MkdirAll("/tmp/dev/disk/by-label", os.ModePerm)
-		if err != nil {
-			panic("cannot create tmp dir")
-		}
 		t.Run(tt.name, func(t *testing.T) {
-			if len(tt.want) > 0 {
-				disk := fmt.Sprintf("/tmp/dev/%s", tt.want)
-				_, err := os.Create(disk)
-				if err != nil {
-					panic(err)
-				}
-				if len(tt.symlinkTarget) > 0 {
-					err = os.Symlink(tt.symlinkTarget, tt.args.path)
-					if err != nil {
-						panic(err)
-					}
+			path := tt.path
+			if strings.HasPrefix(path, "dev/") {
+				path = filepath.Join(filepath.Dir(r.devDir), path)
+			}
+			got, err := r.disks(path)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Expected error %q but found %v", tt.err, err)
 				}
+				return
 			}
-			got, err := RealPath(tt.args.path)
-
-			if err != nil && tt.expectError == false {
-				panic(err)
+			if err != nil {
+				t.Fatal(err)
 			}
-			if got != tt.want {
-				t.Errorf("RealPath() = %v, want %v", got, tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Expected %v but found %v", tt.want, got)
 			}
 		})
 	}
 }
+
+func TestFileDisks(t *testing.T) {
+	r := fakeTree(t)
+	file := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	disks, err := r.fileDisks(file)
+	if err != nil || len(disks) != 0 {
+		t.Fatalf("Expected no disk but found %v %v", disks, err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(file, &st); err != nil {
+		t.Fatal(err)
+	}
+	dev := uint64(st.Dev)
+	number := fmt.Sprintf("%d:%d\n", (dev>>8)&0xfff|(dev>>32)&^0xfff, dev&0xff|(dev>>12)&^0xff)
+	if err := os.WriteFile(filepath.Join(r.sysBlockDir, "sdc1", "dev"), []byte(number), 0644); err != nil {
+		t.Fatal(err)
+	}
+	disks, err = r.fileDisks(file)
+	if err != nil || !reflect.DeepEqual(disks, []string{"sdc"}) {
+		t.Fatalf("Expected [sdc] but found %v %v", disks, err)
+	}
+
+	if _, err := r.fileDisks(filepath.Join(file, "missing")); err == nil {
+		t.Fatal("Expected an error for a missing file")
+	}
+}
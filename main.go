@@ -17,220 +17,331 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"github.com/adelolmo/hd-idle/io"
+	"github.com/adelolmo/hd-idle/diskstats"
+	"github.com/adelolmo/hd-idle/hdidle"
+	"github.com/adelolmo/hd-idle/sgio"
 	"os"
-	"strconv"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
-	defaultIdleTime     = 600 * time.Second
 	symlinkResolveOnce  = 0
 	symlinkResolveRetry = 1
+	defaultMaxFailures  = 5
+
+	exitOK      = 0
+	exitFailure = 1 // a command could not be carried out, e.g. a disk did not spin down
+	exitUsage   = 2 // invalid command line or configuration
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "monitor the disks and spin them down when idle (default)", runCommand},
+		{"spindown", "spin down the given disks immediately and exit", spindownCommand},
+		{"spinup", "spin up the given disks immediately and exit", spinupCommand},
+		{"check-config", "validate the configuration and show the rule each disk matches", checkConfigCommand},
+		{"version", "print the version and exit", versionCommand},
+	}
+}
+
 func main() {
+	os.Exit(dispatch(os.Args[1:]))
+}
 
+// dispatch runs the command named by the first argument. Without a command,
+// or when the first argument is an option, hd-idle runs as a daemon so that
+// existing HD_IDLE_OPTS keep working.
+func dispatch(args []string) int {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		for _, c := range commands {
+			if c.name == args[0] {
+				return c.run(args[1:])
+			}
+		}
+		fmt.Printf("Unknown command %s.\n", args[0])
+		usage()
+		return exitUsage
+	}
+	return runCommand(args)
+}
+
+func runCommand(args []string) int {
 	if os.Getenv("START_HD_IDLE") == "false" {
 		fmt.Println("START_HD_IDLE=false exiting now.")
-		os.Exit(0)
+		return exitOK
 	}
 
-	singleDiskMode := false
-	var disk string
-	defaultConf := DefaultConf{
-		Idle:           defaultIdleTime,
-		CommandType:    SCSI,
-		PowerCondition: 0,
-		Debug:          false,
-		SymlinkPolicy:  0,
-	}
-	var config = &Config{
-		Devices:  []DeviceConf{},
-		Defaults: defaultConf,
-		NameMap:  map[string]string{},
+	opts, status := parseCommandOptions("run", args)
+	if opts == nil {
+		return status
 	}
-	var deviceConf *DeviceConf
-
-	if len(os.Args) == 0 {
+	if len(opts.args) > 0 {
+		fmt.Printf("Unexpected argument %s.\n", opts.args[0])
 		usage()
-		os.Exit(1)
+		return exitUsage
 	}
+	config := opts.config
 
-	for index, arg := range os.Args[1:] {
-		switch arg {
-		case "-t":
-			var err error
-			disk, err = argument(index)
-			if err != nil {
-				fmt.Println("Missing disk argument after -t. Must be a device (e.g. -t sda).")
-				os.Exit(1)
-			}
-			singleDiskMode = true
+	if len(opts.disk) > 0 {
+		return spindownDisks(config, []string{opts.disk})
+	}
 
-		case "-s":
-			s, err := argument(index)
-			if err != nil {
-				fmt.Println("Missing symlink_policy. Must be 0 or 1.")
-				os.Exit(1)
-			}
-			switch s {
-			case "0":
-				config.Defaults.SymlinkPolicy = symlinkResolveOnce
-			case "1":
-				config.Defaults.SymlinkPolicy = symlinkResolveRetry
-			default:
-				fmt.Printf("Wrong symlink_policy -s %s. Must be 0 or 1.\n", s)
-				os.Exit(1)
-			}
+	fmt.Println(config.String())
 
-		case "-a":
-			if deviceConf != nil {
-				config.Devices = append(config.Devices, *deviceConf)
-			}
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 
-			name, err := argument(index)
-			if err != nil {
-				fmt.Println("Missing disk argument after -a. Must be a device (e.g. -a sda).")
-				os.Exit(1)
-			}
+	monitor := hdidle.NewMonitor(config, hdidle.MonitorOptions{Sink: printEvent})
+	defer monitor.Close()
+	events := watchDisks()
+	monitor.LoadState()
+	save := time.NewTicker(hdidle.StateSaveInterval)
+	defer save.Stop()
 
-			deviceRealPath, err := io.RealPath(name)
-			if err != nil {
-				deviceRealPath = ""
-				fmt.Printf("Unable to resolve symlink: %s\n", name)
-			}
-			deviceConf = &DeviceConf{
-				Name:           deviceRealPath,
-				GivenName:      name,
-				Idle:           config.Defaults.Idle,
-				CommandType:    config.Defaults.CommandType,
-				PowerCondition: config.Defaults.PowerCondition,
+	interval := poolInterval(config.Devices)
+	config.SkewTime = interval * 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	if err := monitor.Step(); err != nil {
+		fmt.Println(err.Error())
+		return exitFailure
+	}
+	for {
+		select {
+		case <-ticker.C:
+			if err := monitor.Step(); err != nil {
+				fmt.Println(err.Error())
+				monitor.SaveState(true)
+				return exitFailure
 			}
-			config.NameMap[deviceRealPath] = name
-
-		case "-i":
-			s, err := argument(index)
-			if err != nil {
-				fmt.Println("Missing idle_time after -i. Must be a number.")
-				os.Exit(1)
+		case event := <-events:
+			monitor.HandleEvent(event)
+		case <-dump:
+			for _, line := range monitor.Status() {
+				fmt.Println(line)
 			}
-			idle, err := strconv.Atoi(s)
+		case <-save.C:
+			monitor.SaveState(false)
+		case <-stop:
+			monitor.SaveState(true)
+			return exitOK
+		case <-reload:
+			newOpts, err := parseOptions("run", args)
 			if err != nil {
-				fmt.Printf("Wrong idle_time -i %d. Must be a number.", idle)
-				os.Exit(1)
-			}
-			if deviceConf == nil {
-				config.Defaults.Idle = time.Duration(idle) * time.Second
-				break
+				fmt.Printf("Cannot reload configuration, keeping the current one: %s\n", err)
+				continue
 			}
-			deviceConf.Idle = time.Duration(idle) * time.Second
+			config = newOpts.config
+			interval = poolInterval(config.Devices)
+			config.SkewTime = interval * 3
+			ticker.Reset(interval)
+			monitor.Reconfigure(config)
+			fmt.Printf("Configuration reloaded: %s\n", config.String())
+		}
+	}
+}
 
-		case "-I":
-			config.Defaults.IgnoreSpinDownDetection = true
+// printEvent prints the events of the monitor the way hd-idle always logged
+// them to standard output.
+func printEvent(event hdidle.Event) {
+	fmt.Println(event.Message)
+}
 
-		case "-c":
-			command, err := argument(index)
-			if err != nil {
-				fmt.Println("Missing command_type after -c. Must be one of: scsi, ata.")
-				os.Exit(1)
-			}
-			switch command {
-			case SCSI, ATA:
-				if deviceConf == nil {
-					config.Defaults.CommandType = command
-					break
-				}
-				deviceConf.CommandType = command
-			default:
-				fmt.Printf("Wrong command_type -c %s. Must be one of: scsi, ata.", command)
-				os.Exit(1)
-			}
+func spindownCommand(args []string) int {
+	opts, status := parseCommandOptions("spindown", args)
+	if opts == nil {
+		return status
+	}
+	disks := opts.args
+	if len(opts.disk) > 0 {
+		disks = append(disks, opts.disk)
+	}
+	if len(disks) == 0 {
+		fmt.Println("Missing disk argument. Must be a device (e.g. hd-idle spindown sda).")
+		return exitUsage
+	}
+	return spindownDisks(opts.config, disks)
+}
 
-		case "-p":
-			s, err := argument(index)
-			if err != nil {
-				fmt.Println("Missing power condition after -p. Must be a number from 0-15.")
-				os.Exit(1)
-			}
-			powerCondition, err := strconv.ParseUint(s, 0, 4)
-			if err != nil {
-				fmt.Printf("Invalid power condition %s: %s", s, err.Error())
-				os.Exit(1)
-			}
-			if deviceConf == nil {
-				config.Defaults.PowerCondition = uint8(powerCondition)
-				break
-			}
-			deviceConf.PowerCondition = uint8(powerCondition)
+func spinupCommand(args []string) int {
+	opts, status := parseCommandOptions("spinup", args)
+	if opts == nil {
+		return status
+	}
+	if len(opts.args) == 0 {
+		fmt.Println("Missing disk argument. Must be a device (e.g. hd-idle spinup sda).")
+		return exitUsage
+	}
+	return controlDisks(opts.config, opts.args, "spinup", func(device, command string, deviceConf *hdidle.DeviceConf) error {
+		return hdidle.SpinupDisk(device, command, deviceConf.Exec, opts.config.Defaults.Debug)
+	})
+}
 
-		case "-l":
-			logfile, err := argument(index)
-			if err != nil {
-				fmt.Println("Missing logfile after -l.")
-				os.Exit(1)
+// spindownDisks spins down every given disk with the command type and power
+// condition configured for it.
+func spindownDisks(config *hdidle.Config, disks []string) int {
+	return controlDisks(config, disks, "spindown", func(device, command string, deviceConf *hdidle.DeviceConf) error {
+		var err error
+		if deviceConf.CommandType == hdidle.AUTO {
+			detected := command
+			command, err = hdidle.SpindownDetectedDisk(device, detected, deviceConf.PowerCondition, config.Defaults.Debug)
+			if err == nil && command != detected {
+				fmt.Printf("%s rejected the %s command, used %s\n", device, detected, command)
 			}
-			config.Defaults.LogFile = logfile
-
-		case "-d":
-			config.Defaults.Debug = true
-
-		case "-h":
-			usage()
-			os.Exit(0)
+		} else {
+			err = hdidle.SpindownDisk(device, command, deviceConf.PowerCondition, deviceConf.Exec, config.Defaults.Debug)
 		}
-	}
+		if err == nil && command == hdidle.ATA && config.Defaults.Debug {
+			fmt.Printf("%s spun down with method %s\n", device, sgio.MethodName(device))
+		}
+		return err
+	})
+}
 
-	if singleDiskMode {
-		if err := spindownDisk(
-			disk,
-			config.Defaults.CommandType,
-			config.Defaults.PowerCondition,
-			config.Defaults.Debug,
-		); err != nil {
+// controlDisks runs the action on every given disk with the command type
+// configured for it.
+func controlDisks(config *hdidle.Config, disks []string, action string,
+	run func(device, command string, deviceConf *hdidle.DeviceConf) error) int {
+	status := exitOK
+	for _, disk := range disks {
+		names, err := resolveDisks(disk)
+		if err != nil {
 			fmt.Println(err.Error())
-			os.Exit(1)
+			status = exitFailure
+			continue
+		}
+		for _, name := range names {
+			device := "/dev/" + name
+			deviceConf := config.DeviceConfig(name)
+			command := hdidle.CommandTypeFor(name, deviceConf.CommandType)
+			if len(command) == 0 {
+				fmt.Printf("cannot %s disk %s: not supported\n", action, device)
+				status = exitFailure
+				continue
+			}
+			if err := run(device, command, deviceConf); err != nil {
+				fmt.Println(err.Error())
+				status = exitFailure
+			}
 		}
-		os.Exit(0)
 	}
+	return status
+}
 
-	if deviceConf != nil {
-		config.Devices = append(config.Devices, *deviceConf)
+func checkConfigCommand(args []string) int {
+	opts, status := parseCommandOptions("check-config", args)
+	if opts == nil {
+		return status
 	}
+	if len(opts.args) > 0 {
+		fmt.Printf("Unexpected argument %s.\n", opts.args[0])
+		return exitUsage
+	}
+	config := opts.config
 	fmt.Println(config.String())
+	for _, device := range config.Devices {
+		if len(device.Name) == 0 {
+			fmt.Printf("warning: %s does not resolve to a disk\n", device.GivenName)
+		}
+	}
 
-	interval := poolInterval(config.Devices)
-	config.SkewTime = interval * 3
-	for {
-		ObserveDiskActivity(config)
-		time.Sleep(interval)
+	disks, err := diskstats.Snapshot()
+	if err != nil {
+		fmt.Printf("Cannot read disk activity: %s\n", err)
+		return exitFailure
+	}
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].Name < disks[j].Name
+	})
+	for _, disk := range disks {
+		i := config.MatchDevice(disk.Name)
+		if i < 0 {
+			fmt.Printf("%s: defaults\n", disk.Name)
+			continue
+		}
+		fmt.Printf("%s: rule #%d {%s}\n", disk.Name, i+1, config.Devices[i].String())
+	}
+	fmt.Println("Configuration OK")
+	return exitOK
+}
+
+func versionCommand(args []string) int {
+	if len(args) > 0 {
+		fmt.Printf("Unexpected argument %s.\n", args[0])
+		return exitUsage
 	}
+	fmt.Printf("hd-idle %s\n", version)
+	return exitOK
 }
 
-func argument(index int) (string, error) {
-	argIndex := index + 2
-	if argIndex >= len(os.Args) {
-		return "", fmt.Errorf("option requires argument")
+// parseCommandOptions parses the options of a command. If parsing fails or
+// help was requested, it prints the outcome and returns nil together with the
+// exit status.
+func parseCommandOptions(name string, args []string) (*options, int) {
+	opts, err := parseOptions(name, args)
+	if err == flag.ErrHelp {
+		usage()
+		return nil, exitOK
 	}
-	arg := os.Args[argIndex]
-	if arg[:1] == "-" {
-		return "", fmt.Errorf("option requires argument")
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil, exitUsage
 	}
-	return arg, nil
+	return opts, exitOK
 }
 
 func usage() {
-	fmt.Println("usage: hd-idle [-t <disk>] [-s <symlink_policy>] [-a <name>] [-i <idle_time>] " +
-		"[-c <command_type>] [-p power_condition] [-l <logfile>] [-d] [-I] [-h]")
+	fmt.Println(`usage: hd-idle [command] [options] [disk...]
+
+commands:`)
+	for _, c := range commands {
+		fmt.Printf("  %-14s %s\n", c.name, c.description)
+	}
+	fmt.Println(`
+options:
+  -f, --config <config_file>          read the configuration from this file (default /etc/hd-idle.conf)
+  -a, --device <name>                 set the disk for the subsequent -i, -c, -p, -q, -u and -r options
+  -i, --idle-time <idle_time>         idle time in seconds or as duration (e.g. 10m, 2h)
+  -c, --command-type <command_type>   api call to stop the device: auto, scsi, ata, nvme, hdio, exec
+  -p, --power-condition <0-15>        power condition of the SCSI START STOP UNIT command
+  -q, --query-power-state             query the power state of the disk from the drive itself
+  -u, --spinup-on-pending-io          spin up a stopped disk when requests wait for it
+  -r, --resume-policy <policy>        after a suspend: reset, restore or verify the spin down
+  -s, --symlink-policy <0|1>          resolve symlinks only on start (0) or also in runtime (1)
+  -l, --log-file <logfile>            write spin up events into this file
+  -I, --ignore-spin-down-detection    spin down even if the disk is considered spun down
+  -d, --debug                         print debugging info
+  -t <disk>                           spin down the disk immediately and exit (same as spindown)
+  -h, --help                          print this help`)
 }
 
-func poolInterval(deviceConfs []DeviceConf) time.Duration {
+func poolInterval(deviceConfs []hdidle.DeviceConf) time.Duration {
 	if len(deviceConfs) == 0 {
-		return defaultIdleTime / 10
+		return hdidle.DefaultIdleTime / 10
 	}
 
-	interval := defaultIdleTime
+	interval := hdidle.DefaultIdleTime
 	for _, dev := range deviceConfs {
 		if dev.Idle == 0 {
 			continue
@@ -1,25 +1,27 @@
 package main
 
 import (
+	"github.com/adelolmo/hd-idle/hdidle"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 func TestIntervalWithZeroSecondsIdle(t *testing.T) {
-	confs := []DeviceConf{{
+	confs := []hdidle.DeviceConf{{
 		Name:        "test",
 		GivenName:   "test",
 		Idle:        0,
 		CommandType: "ata",
 	}}
 	interval := poolInterval(confs)
-	if interval != defaultIdleTime/10 {
+	if interval != hdidle.DefaultIdleTime/10 {
 		t.Fatalf("interval should be the default. it was %d", interval)
 	}
 }
 
 func TestIntervalWith300SecondsIdle(t *testing.T) {
-	confs := []DeviceConf{{
+	confs := []hdidle.DeviceConf{{
 		Name:        "test",
 		GivenName:   "test",
 		Idle:        300 * time.Second,
@@ -30,3 +32,241 @@ func TestIntervalWith300SecondsIdle(t *testing.T) {
 		t.Fatalf("interval should be the 30s. it was %v", interval)
 	}
 }
+
+func TestParseArgumentsOverridesConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hd-idle.conf")
+	writeFile(t, file, "[defaults]\nidle_time = 900\ncommand_type = \"ata\"\n\n[device.sda]\nidle_time = 60\n\n[device.sdb]\nidle_time = 120\n")
+
+	opts, err := parseOptions("run", []string{"-f", file, "-i", "300", "-a", "sdb", "-i", "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := opts.config
+	if config.Defaults.Idle != 300*time.Second || config.Defaults.CommandType != hdidle.ATA {
+		t.Fatalf("Unexpected defaults %v", config.Defaults)
+	}
+	expected := []hdidle.DeviceConf{
+		{Name: "sdb", GivenName: "sdb", Idle: 30 * time.Second, CommandType: hdidle.ATA},
+		{Name: "sda", GivenName: "sda", Idle: 60 * time.Second, CommandType: hdidle.ATA},
+	}
+	if len(config.Devices) != len(expected) {
+		t.Fatalf("Expected %d devices but found %d", len(expected), len(config.Devices))
+	}
+	for i := range expected {
+		if config.Devices[i] != expected[i] {
+			t.Fatalf("Expected %v but found %v", expected[i], config.Devices[i])
+		}
+	}
+}
+
+func TestParseArgumentsRejectsInvalidConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hd-idle.conf")
+	writeFile(t, file, "[defaults]\nidle_time = soon\n")
+
+	if _, err := parseOptions("run", []string{"-f", file}); err == nil {
+		t.Fatal("Expected invalid configuration to be rejected")
+	}
+}
+
+func TestParseOptionsKeepsShortFlagsCompatible(t *testing.T) {
+	file := emptyConfigFile(t)
+	opts, err := parseOptions("run", []string{"-f", file,
+		"-i", "0", "-c", "ata", "-a", "sda", "-i", "300", "-a", "sdb", "-i", "1200", "-c", "scsi", "-p", "3",
+		"-s", "1", "-l", "/var/log/hd-idle.log", "-d", "-I"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := opts.config
+	expectedDefaults := hdidle.DefaultConf{
+		Idle:                    0,
+		CommandType:             hdidle.ATA,
+		Debug:                   true,
+		LogFile:                 "/var/log/hd-idle.log",
+		SymlinkPolicy:           symlinkResolveRetry,
+		IgnoreSpinDownDetection: true,
+		QuirksFile:              defaultQuirksFile,
+		StateFile:               defaultStateFile,
+		MaxFailures:             defaultMaxFailures,
+	}
+	if config.Defaults != expectedDefaults {
+		t.Fatalf("Expected %v but found %v", expectedDefaults, config.Defaults)
+	}
+	expected := []hdidle.DeviceConf{
+		{Name: "sda", GivenName: "sda", Idle: 300 * time.Second, CommandType: hdidle.ATA},
+		{Name: "sdb", GivenName: "sdb", Idle: 1200 * time.Second, CommandType: hdidle.SCSI, PowerCondition: 3},
+	}
+	if len(config.Devices) != len(expected) {
+		t.Fatalf("Expected %d devices but found %d", len(expected), len(config.Devices))
+	}
+	for i := range expected {
+		if config.Devices[i] != expected[i] {
+			t.Fatalf("Expected %v but found %v", expected[i], config.Devices[i])
+		}
+	}
+}
+
+func TestParseOptionsLongAliases(t *testing.T) {
+	file := emptyConfigFile(t)
+	opts, err := parseOptions("run", []string{"--config", file,
+		"--idle-time", "2h", "--device", "sda", "--idle-time=10m", "--command-type", "ata", "--resume-policy", "restore", "--debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := opts.config
+	if config.Defaults.Idle != 2*time.Hour || !config.Defaults.Debug {
+		t.Fatalf("Unexpected defaults %v", config.Defaults)
+	}
+	expected := hdidle.DeviceConf{Name: "sda", GivenName: "sda", Idle: 10 * time.Minute, CommandType: hdidle.ATA, ResumePolicy: hdidle.ResumeRestore}
+	if len(config.Devices) != 1 || config.Devices[0] != expected {
+		t.Fatalf("Expected %v but found %v", expected, config.Devices)
+	}
+}
+
+func TestParseOptionsDeviceOnSeveralDisks(t *testing.T) {
+	defer func(original func(string) ([]string, error)) { resolveDisks = original }(resolveDisks)
+	resolveDisks = func(name string) ([]string, error) {
+		if name == "/dev/md0" {
+			return []string{"sdzy", "sdzz"}, nil
+		}
+		return []string{name}, nil
+	}
+	file := emptyConfigFile(t)
+	writeFile(t, file, "[device.\"/dev/md0\"]\nidle_time = 60\n")
+	opts, err := parseOptions("run", []string{"-f", file, "-a", "/dev/md0", "-i", "30", "-c", "ata"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := opts.config
+	expected := []hdidle.DeviceConf{
+		{Name: "sdzy", GivenName: "/dev/md0", Idle: 30 * time.Second, CommandType: hdidle.ATA},
+		{Name: "sdzz", GivenName: "/dev/md0", Idle: 30 * time.Second, CommandType: hdidle.ATA},
+	}
+	if len(config.Devices) != len(expected) {
+		t.Fatalf("Expected %v but found %v", expected, config.Devices)
+	}
+	for i := range expected {
+		if config.Devices[i] != expected[i] {
+			t.Fatalf("Expected %v but found %v", expected[i], config.Devices[i])
+		}
+	}
+	if config.NameMap["sdzy"] != "/dev/md0" || config.NameMap["sdzz"] != "/dev/md0" {
+		t.Fatalf("Expected both disks to map to /dev/md0 but found %v", config.NameMap)
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	file := emptyConfigFile(t)
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "unknown flag",
+			args: []string{"-x"},
+			want: "flag provided but not defined: -x",
+		},
+		{
+			name: "wrong idle time",
+			args: []string{"-i", "soon"},
+			want: `invalid value "soon" for flag -i: wrong idle_time soon. Must be a number of seconds or a duration (e.g. 10m)`,
+		},
+		{
+			name: "negative idle time",
+			args: []string{"-i", "-5"},
+			want: `invalid value "-5" for flag -i: option requires argument`,
+		},
+		{
+			name: "empty device",
+			args: []string{"-a", ""},
+			want: `invalid value "" for flag -a: option requires argument`,
+		},
+		{
+			name: "wrong resume policy",
+			args: []string{"-r", "later"},
+			want: `invalid value "later" for flag -r: wrong resume_policy later. Must be one of: reset, restore, verify`,
+		},
+		{
+			name: "wrong command type",
+			args: []string{"-c", "sata"},
+			want: `invalid value "sata" for flag -c: wrong command_type sata. Must be one of: auto, scsi, ata, nvme, hdio, exec`,
+		},
+		{
+			name: "missing argument",
+			args: []string{"-a"},
+			want: "flag needs an argument: -a",
+		},
+		{
+			name: "same disk twice",
+			args: []string{"-a", "sda", "-a", "/dev/sda"},
+			want: "devices sda and /dev/sda refer to the same disk sda",
+		},
+		{
+			name: "exec without command",
+			args: []string{"-a", "sdc", "-c", "exec"},
+			want: "command type exec of device sdc requires exec_spindown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOptions("run", append([]string{"-f", file}, tt.args...))
+			if err == nil {
+				t.Fatalf("Expected error %s", tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Fatalf("Expected %v but found %v", tt.want, err.Error())
+			}
+		})
+	}
+}
+
+func TestParseIdleTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"0", 0},
+		{"600", 600 * time.Second},
+		{"10m", 10 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+	}
+	for _, tt := range tests {
+		got, err := parseIdleTime(tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Fatalf("parseIdleTime(%s) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDispatchExitStatus(t *testing.T) {
+	file := emptyConfigFile(t)
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"version", []string{"version"}, exitOK},
+		{"help", []string{"-h"}, exitOK},
+		{"unknown command", []string{"sleep"}, exitUsage},
+		{"check config", []string{"check-config", "-f", file, "-i", "10m"}, exitOK},
+		{"check invalid config", []string{"check-config", "-f", file, "-p", "16"}, exitUsage},
+		{"spindown without disk", []string{"spindown", "-f", file}, exitUsage},
+		{"unknown flag", []string{"run", "--sleep"}, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dispatch(tt.args); got != tt.want {
+				t.Fatalf("dispatch(%v) = %d, want %d", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func emptyConfigFile(t *testing.T) string {
+	file := filepath.Join(t.TempDir(), "hd-idle.conf")
+	writeFile(t, file, "")
+	return file
+}
@@ -0,0 +1,283 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package nvme
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/adelolmo/hd-idle/sgio"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// See NVM Express Base Specification 1.4, 5 Admin Command Set.
+const (
+	adminIdentify    = 0x06
+	adminSetFeatures = 0x09
+	adminGetFeatures = 0x0a
+
+	identifyController = 0x01
+	identifyLength     = 4096
+
+	featurePowerManagement = 0x02
+	featureApst            = 0x0c
+	apstTableLength        = 256
+	apstEnable             = 1 << 0
+
+	// MaxApstIdle is the longest idle time an APST table entry holds, in
+	// milliseconds on 24 bits.
+	MaxApstIdle = (1<<24 - 1) * time.Millisecond
+
+	// _IOWR('N', 0x41, struct nvme_admin_cmd)
+	nvmeIoctlAdminCmd = 0xc0484e41
+)
+
+// adminCmd mirrors struct nvme_admin_cmd of <linux/nvme_ioctl.h>.
+type adminCmd struct {
+	opcode      uint8
+	flags       uint8
+	rsvd1       uint16
+	nsid        uint32
+	cdw2        uint32
+	cdw3        uint32
+	metadata    uint64
+	addr        uint64
+	metadataLen uint32
+	dataLen     uint32
+	cdw10       uint32
+	cdw11       uint32
+	cdw12       uint32
+	cdw13       uint32
+	cdw14       uint32
+	cdw15       uint32
+	timeoutMs   uint32
+	result      uint32
+}
+
+// powerStates describes the power states of the controller, as returned by
+// Identify Controller.
+type powerStates struct {
+	// nonOperational tells for each power state whether the controller
+	// processes I/O in it
+	nonOperational []bool
+	apstSupported  bool
+}
+
+// StopDevice puts the controller into its deepest non-operational power
+// state. The controller returns to the last operational power state on its
+// own as soon as I/O is submitted.
+func StopDevice(device string, debug bool) error {
+	f, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	states, err := identifyPowerStates(f, debug)
+	if err != nil {
+		return err
+	}
+	ps, ok := states.deepest()
+	if !ok {
+		return fmt.Errorf("controller of %s has no non-operational power state", device)
+	}
+	if debug {
+		fmt.Printf(" setting power state %d\n", ps)
+	}
+	_, err = sendAdminCommand(f, setPowerState(ps), nil, debug)
+	return err
+}
+
+// StartDevice puts the controller back into power state 0, the full power
+// operational state.
+func StartDevice(device string, debug bool) error {
+	f, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if debug {
+		fmt.Println(" setting power state 0")
+	}
+	_, err = sendAdminCommand(f, setPowerState(0), nil, debug)
+	return err
+}
+
+// PowerState reads the current power state of the controller with Get
+// Features, which does not change it. Non-operational power states are
+// reported as standby, the other power states below full power as idle.
+func PowerState(device string, debug bool) (sgio.PowerState, error) {
+	f, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return sgio.PowerStateUnknown, err
+	}
+	defer f.Close()
+
+	states, err := identifyPowerStates(f, debug)
+	if err != nil {
+		return sgio.PowerStateUnknown, err
+	}
+	result, err := sendAdminCommand(f, getPowerState(), nil, debug)
+	if err != nil {
+		return sgio.PowerStateUnknown, err
+	}
+	if debug {
+		fmt.Printf(" power state: %d\n", result&0x1f)
+	}
+	return states.powerState(uint8(result & 0x1f)), nil
+}
+
+// SetApst programs Autonomous Power State Transitions, so that the controller
+// enters its deepest non-operational power state on its own after being idle
+// for the given time. A time of 0 disables APST.
+func SetApst(device string, idle time.Duration, debug bool) error {
+	if idle < 0 || idle > MaxApstIdle {
+		return fmt.Errorf("apst idle time %v out of range 0-%v", idle, MaxApstIdle)
+	}
+	f, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	states, err := identifyPowerStates(f, debug)
+	if err != nil {
+		return err
+	}
+	if !states.apstSupported {
+		return fmt.Errorf("controller of %s does not support autonomous power state transitions", device)
+	}
+	table, err := states.apstTable(idle)
+	if err != nil {
+		return err
+	}
+	if debug {
+		fmt.Printf(" setting apst idle time to %v\n", idle)
+	}
+	var enable uint32
+	if idle > 0 {
+		enable = apstEnable
+	}
+	cmd := adminCmd{opcode: adminSetFeatures, cdw10: featureApst, cdw11: enable}
+	_, err = sendAdminCommand(f, cmd, table, debug)
+	return err
+}
+
+func identifyPowerStates(f *os.File, debug bool) (powerStates, error) {
+	data := make([]uint8, identifyLength)
+	cmd := adminCmd{opcode: adminIdentify, cdw10: identifyController}
+	if _, err := sendAdminCommand(f, cmd, data, debug); err != nil {
+		return powerStates{}, fmt.Errorf("cannot identify controller: %s", err)
+	}
+	return parsePowerStates(data), nil
+}
+
+// parsePowerStates reads the power state descriptors of the Identify
+// Controller data structure.
+func parsePowerStates(data []uint8) powerStates {
+	npss := int(data[263]) + 1 // 0's based
+	states := powerStates{
+		nonOperational: make([]bool, npss),
+		apstSupported:  data[265]&0x01 != 0,
+	}
+	for i := 0; i < npss; i++ {
+		descriptor := data[2048+32*i:]
+		states.nonOperational[i] = descriptor[3]&0x02 != 0 // NOPS
+	}
+	return states
+}
+
+// deepest returns the highest numbered non-operational power state, which
+// consumes the least power.
+func (s powerStates) deepest() (uint8, bool) {
+	for i := len(s.nonOperational) - 1; i > 0; i-- {
+		if s.nonOperational[i] {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+func (s powerStates) powerState(ps uint8) sgio.PowerState {
+	switch {
+	case int(ps) >= len(s.nonOperational):
+		return sgio.PowerStateUnknown
+	case s.nonOperational[ps]:
+		return sgio.PowerStateStandby
+	case ps > 0:
+		return sgio.PowerStateIdle
+	}
+	return sgio.PowerStateActive
+}
+
+// apstTable builds the APST data structure: every operational power state
+// transitions to the deepest non-operational one after the idle time. Each
+// entry holds the idle time prior to transition in milliseconds in bits
+// 31:8 and the idle transition power state in bits 7:3.
+func (s powerStates) apstTable(idle time.Duration) ([]uint8, error) {
+	table := make([]uint8, apstTableLength)
+	if idle == 0 {
+		return table, nil
+	}
+	ps, ok := s.deepest()
+	if !ok {
+		return nil, fmt.Errorf("controller has no non-operational power state")
+	}
+	entry := uint64(idle/time.Millisecond)<<8 | uint64(ps)<<3
+	for i, nonOperational := range s.nonOperational {
+		if !nonOperational {
+			binary.LittleEndian.PutUint64(table[8*i:], entry)
+		}
+	}
+	return table, nil
+}
+
+func setPowerState(ps uint8) adminCmd {
+	return adminCmd{opcode: adminSetFeatures, cdw10: featurePowerManagement, cdw11: uint32(ps & 0x1f)}
+}
+
+func getPowerState() adminCmd {
+	return adminCmd{opcode: adminGetFeatures, cdw10: featurePowerManagement}
+}
+
+// sendAdminCommand passes the admin command to the controller and returns
+// the result of its completion queue entry. data is either read from or
+// written to the controller, depending on the command.
+func sendAdminCommand(f *os.File, cmd adminCmd, data []uint8, debug bool) (uint32, error) {
+	cmd.timeoutMs = uint32(sgio.CommandTimeout / time.Millisecond)
+	if len(data) > 0 {
+		cmd.addr = uint64(uintptr(unsafe.Pointer(&data[0])))
+		cmd.dataLen = uint32(len(data))
+	}
+	if debug {
+		fmt.Printf("outgoing admin command: opcode=0x%02x cdw10=0x%08x cdw11=0x%08x\n", cmd.opcode, cmd.cdw10, cmd.cdw11)
+	}
+
+	status, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), nvmeIoctlAdminCmd, uintptr(unsafe.Pointer(&cmd)))
+	runtime.KeepAlive(data)
+	if errno != 0 {
+		return 0, errno
+	}
+	if status != 0 {
+		return 0, fmt.Errorf("admin command 0x%02x failed with status 0x%x", cmd.opcode, status)
+	}
+	return cmd.result, nil
+}
@@ -0,0 +1,110 @@
+package nvme
+
+import (
+	"encoding/binary"
+	"github.com/adelolmo/hd-idle/sgio"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestAdminCmdSize(t *testing.T) {
+	if size := unsafe.Sizeof(adminCmd{}); size != 72 {
+		t.Fatalf("Expected 72 but found %d", size)
+	}
+}
+
+// identifyData returns Identify Controller data with the given power states.
+func identifyData(nonOperational []bool, apst bool) []uint8 {
+	data := make([]uint8, identifyLength)
+	data[263] = uint8(len(nonOperational) - 1)
+	if apst {
+		data[265] = 0x01
+	}
+	for i, nops := range nonOperational {
+		if nops {
+			data[2048+32*i+3] = 0x02
+		}
+	}
+	return data
+}
+
+func TestParsePowerStates(t *testing.T) {
+	states := parsePowerStates(identifyData([]bool{false, false, false, true, true}, true))
+	if !states.apstSupported {
+		t.Fatal("Expected apst to be supported")
+	}
+	if ps, ok := states.deepest(); !ok || ps != 4 {
+		t.Fatalf("Expected power state 4 but found %d, %t", ps, ok)
+	}
+
+	states = parsePowerStates(identifyData([]bool{false, false}, false))
+	if _, ok := states.deepest(); ok {
+		t.Fatal("Expected no non-operational power state")
+	}
+}
+
+func TestPowerState(t *testing.T) {
+	states := powerStates{nonOperational: []bool{false, false, true}}
+	tests := []struct {
+		ps   uint8
+		want sgio.PowerState
+	}{
+		{0, sgio.PowerStateActive},
+		{1, sgio.PowerStateIdle},
+		{2, sgio.PowerStateStandby},
+		{3, sgio.PowerStateUnknown},
+	}
+	for _, tt := range tests {
+		if got := states.powerState(tt.ps); got != tt.want {
+			t.Errorf("powerState(%d) = %v, want %v", tt.ps, got, tt.want)
+		}
+	}
+}
+
+func TestApstTable(t *testing.T) {
+	states := powerStates{nonOperational: []bool{false, false, true, true}}
+	table, err := states.apstTable(10 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := uint64(600000)<<8 | 3<<3
+	for i := 0; i < 32; i++ {
+		want := uint64(0)
+		if i < 2 {
+			want = expected
+		}
+		if got := binary.LittleEndian.Uint64(table[8*i:]); got != want {
+			t.Fatalf("Expected entry %d to be 0x%x but found 0x%x", i, want, got)
+		}
+	}
+
+	table, err = states.apstTable(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range table {
+		if b != 0 {
+			t.Fatalf("Expected empty table but found 0x%02x at %d", b, i)
+		}
+	}
+
+	if _, err := (powerStates{nonOperational: []bool{false}}).apstTable(time.Minute); err == nil {
+		t.Fatal("Expected an error without non-operational power state")
+	}
+}
+
+func TestPowerStateCommands(t *testing.T) {
+	if cmd := setPowerState(4); cmd.opcode != adminSetFeatures || cmd.cdw10 != featurePowerManagement || cmd.cdw11 != 4 {
+		t.Fatalf("Unexpected command %+v", cmd)
+	}
+	if cmd := getPowerState(); cmd.opcode != adminGetFeatures || cmd.cdw10 != featurePowerManagement {
+		t.Fatalf("Unexpected command %+v", cmd)
+	}
+}
+
+func TestSetApstOutOfRange(t *testing.T) {
+	if err := SetApst("/dev/nvme9n9", 5*time.Hour, false); err == nil {
+		t.Fatal("Expected an error for an idle time out of range")
+	}
+}
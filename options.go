@@ -0,0 +1,416 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/adelolmo/hd-idle/hdidle"
+	"github.com/adelolmo/hd-idle/io"
+	"github.com/adelolmo/hd-idle/sgio"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resolveDisks returns the disks a device name is stored on. Tests replace it.
+var resolveDisks = io.Disks
+
+// options is the result of parsing the command line of any command.
+type options struct {
+	config *hdidle.Config
+	// disk given with the legacy -t option
+	disk string
+	// positional arguments left after the options
+	args []string
+}
+
+// cliOption is a configuration option given on the command line. Options are
+// applied in the order they were given once the configuration files have been
+// read, because -i, -c, -p, -q, -u and -r apply to the device named by the preceding -a.
+type cliOption func(b *configBuilder)
+
+type configBuilder struct {
+	config *hdidle.Config
+	device *hdidle.DeviceConf
+	// disks the device is stored on, each gets a copy of the device
+	disks []string
+}
+
+func (b *configBuilder) addDevice(name string) {
+	b.flushDevice()
+
+	disks, err := resolveDisks(name)
+	if err != nil {
+		disks = []string{""}
+		fmt.Printf("Unable to resolve device: %s\n", err)
+	}
+	b.disks = disks
+	b.device = &hdidle.DeviceConf{
+		GivenName:         name,
+		Idle:              b.config.Defaults.Idle,
+		CommandType:       b.config.Defaults.CommandType,
+		PowerCondition:    b.config.Defaults.PowerCondition,
+		QueryPowerState:   b.config.Defaults.QueryPowerState,
+		SpinupOnPendingIo: b.config.Defaults.SpinupOnPendingIo,
+		FirmwareStandby:   b.config.Defaults.FirmwareStandby,
+		ApmLevel:          b.config.Defaults.ApmLevel,
+		ResumePolicy:      b.config.Defaults.ResumePolicy,
+		Exec:              b.config.Defaults.Exec,
+	}
+	for _, disk := range disks {
+		if !hdidle.IsPattern(disk) {
+			b.config.NameMap[disk] = name
+		}
+	}
+}
+
+func (b *configBuilder) flushDevice() {
+	if b.device != nil {
+		for _, disk := range b.disks {
+			device := *b.device
+			device.Name = disk
+			b.config.Devices = append(b.config.Devices, device)
+		}
+		b.device = nil
+	}
+}
+
+// optionFunc turns a function into a flag.Value, so that every occurrence of
+// an option is handled in order.
+type optionFunc func(string) error
+
+func (f optionFunc) String() string     { return "" }
+func (f optionFunc) Set(s string) error { return f(s) }
+
+type boolOptionFunc func(string) error
+
+func (f boolOptionFunc) String() string     { return "" }
+func (f boolOptionFunc) Set(s string) error { return f(s) }
+func (f boolOptionFunc) IsBoolFlag() bool   { return true }
+
+// parseOptions parses the options of the given command and builds the
+// configuration from the configuration files and the command line, which
+// takes precedence.
+func parseOptions(command string, args []string) (*options, error) {
+	parsed := &options{}
+	configFile := defaultConfigFile
+	configFileRequired := false
+	var cliOptions []cliOption
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Usage = func() {}
+
+	alias := func(value flag.Value, short, long string) {
+		fs.Var(value, short, "")
+		fs.Var(value, long, "")
+	}
+
+	alias(optionFunc(func(s string) error {
+		if err := requireValue(s); err != nil {
+			return err
+		}
+		configFile = s
+		configFileRequired = true
+		return nil
+	}), "f", "config")
+
+	alias(optionFunc(func(s string) error {
+		if err := requireValue(s); err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			b.addDevice(s)
+		})
+		return nil
+	}), "a", "device")
+
+	alias(optionFunc(func(s string) error {
+		idle, err := parseIdleTime(s)
+		if err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			if b.device == nil {
+				b.config.Defaults.Idle = idle
+				return
+			}
+			b.device.Idle = idle
+		})
+		return nil
+	}), "i", "idle-time")
+
+	alias(optionFunc(func(s string) error {
+		command, err := parseCommandType(s)
+		if err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			if b.device == nil {
+				b.config.Defaults.CommandType = command
+				return
+			}
+			b.device.CommandType = command
+		})
+		return nil
+	}), "c", "command-type")
+
+	alias(optionFunc(func(s string) error {
+		powerCondition, err := parsePowerCondition(s)
+		if err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			if b.device == nil {
+				b.config.Defaults.PowerCondition = powerCondition
+				return
+			}
+			b.device.PowerCondition = powerCondition
+		})
+		return nil
+	}), "p", "power-condition")
+
+	alias(boolOptionFunc(func(s string) error {
+		query, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			if b.device == nil {
+				b.config.Defaults.QueryPowerState = query
+				return
+			}
+			b.device.QueryPowerState = query
+		})
+		return nil
+	}), "q", "query-power-state")
+
+	alias(boolOptionFunc(func(s string) error {
+		spinup, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			if b.device == nil {
+				b.config.Defaults.SpinupOnPendingIo = spinup
+				return
+			}
+			b.device.SpinupOnPendingIo = spinup
+		})
+		return nil
+	}), "u", "spinup-on-pending-io")
+
+	alias(optionFunc(func(s string) error {
+		policy, err := parseResumePolicy(s)
+		if err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			if b.device == nil {
+				b.config.Defaults.ResumePolicy = policy
+				return
+			}
+			b.device.ResumePolicy = policy
+		})
+		return nil
+	}), "r", "resume-policy")
+
+	alias(optionFunc(func(s string) error {
+		policy, err := parseSymlinkPolicy(s)
+		if err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			b.config.Defaults.SymlinkPolicy = policy
+		})
+		return nil
+	}), "s", "symlink-policy")
+
+	alias(optionFunc(func(s string) error {
+		if err := requireValue(s); err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			b.config.Defaults.LogFile = s
+		})
+		return nil
+	}), "l", "log-file")
+
+	alias(boolOptionFunc(func(s string) error {
+		debug, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			b.config.Defaults.Debug = debug
+		})
+		return nil
+	}), "d", "debug")
+
+	alias(boolOptionFunc(func(s string) error {
+		ignore, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		cliOptions = append(cliOptions, func(b *configBuilder) {
+			b.config.Defaults.IgnoreSpinDownDetection = ignore
+		})
+		return nil
+	}), "I", "ignore-spin-down-detection")
+
+	fs.Var(optionFunc(func(s string) error {
+		if err := requireValue(s); err != nil {
+			return err
+		}
+		parsed.disk = s
+		return nil
+	}), "t", "")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	parsed.args = fs.Args()
+
+	fileConfig, err := loadConfigFiles(configFile, configFileRequired)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &configBuilder{config: newConfig()}
+	fileConfig.applyDefaults(&b.config.Defaults)
+	for _, option := range cliOptions {
+		option(b)
+	}
+	b.flushDevice()
+	fileConfig.applyDevices(b.config)
+
+	if err := b.config.Validate(); err != nil {
+		return nil, err
+	}
+	// a quirk file named in the configuration has to exist
+	if err := sgio.LoadQuirks(b.config.Defaults.QuirksFile, fileConfig.defaults.quirksFile != nil); err != nil {
+		return nil, err
+	}
+	parsed.config = b.config
+	return parsed, nil
+}
+
+func newConfig() *hdidle.Config {
+	return &hdidle.Config{
+		Devices: []hdidle.DeviceConf{},
+		Defaults: hdidle.DefaultConf{
+			Idle:           hdidle.DefaultIdleTime,
+			CommandType:    hdidle.AUTO,
+			PowerCondition: 0,
+			Debug:          false,
+			SymlinkPolicy:  symlinkResolveOnce,
+			QuirksFile:     defaultQuirksFile,
+			StateFile:      defaultStateFile,
+			MaxFailures:    defaultMaxFailures,
+		},
+		NameMap: map[string]string{},
+	}
+}
+
+func requireValue(s string) error {
+	if len(s) == 0 || strings.HasPrefix(s, "-") {
+		return fmt.Errorf("option requires argument")
+	}
+	return nil
+}
+
+// parseIdleTime accepts a number of seconds, as hd-idle always did, or a
+// duration with unit like "10m" or "2h".
+func parseIdleTime(s string) (time.Duration, error) {
+	if err := requireValue(s); err != nil {
+		return 0, err
+	}
+	if seconds, err := strconv.Atoi(s); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("wrong idle_time %s. Must not be negative", s)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	idle, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("wrong idle_time %s. Must be a number of seconds or a duration (e.g. 10m)", s)
+	}
+	if idle < 0 {
+		return 0, fmt.Errorf("wrong idle_time %s. Must not be negative", s)
+	}
+	return idle, nil
+}
+
+func parseCommandType(s string) (string, error) {
+	switch s {
+	case hdidle.AUTO, hdidle.SCSI, hdidle.ATA, hdidle.NVME, hdidle.HDIO, hdidle.EXEC:
+		return s, nil
+	}
+	return "", fmt.Errorf("wrong command_type %s. Must be one of: auto, scsi, ata, nvme, hdio, exec", s)
+}
+
+func parsePowerCondition(s string) (uint8, error) {
+	powerCondition, err := strconv.ParseUint(s, 0, 4)
+	if err != nil {
+		return 0, fmt.Errorf("invalid power_condition %s. Must be a number from 0-15", s)
+	}
+	return uint8(powerCondition), nil
+}
+
+// parseFirmwareStandby accepts the standby timer programmed into the drive as
+// idle_time does, or "off" to disable it.
+func parseFirmwareStandby(s string) (time.Duration, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	standby, err := parseIdleTime(s)
+	if err != nil {
+		return 0, fmt.Errorf("wrong firmware_standby %s. Must be off, a number of seconds or a duration (e.g. 20m)", s)
+	}
+	if standby > sgio.MaxFirmwareStandby {
+		return 0, fmt.Errorf("wrong firmware_standby %s. Must not exceed %v", s, sgio.MaxFirmwareStandby)
+	}
+	return standby, nil
+}
+
+func parseResumePolicy(s string) (string, error) {
+	switch s {
+	case hdidle.ResumeReset, hdidle.ResumeRestore, hdidle.ResumeVerify:
+		return s, nil
+	}
+	return "", fmt.Errorf("wrong resume_policy %s. Must be one of: reset, restore, verify", s)
+}
+
+func parseApmLevel(s string) (uint8, error) {
+	level, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || level == 0 {
+		return 0, fmt.Errorf("wrong apm_level %s. Must be a number from 1-255", s)
+	}
+	return uint8(level), nil
+}
+
+func parseSymlinkPolicy(s string) (int, error) {
+	switch s {
+	case "0":
+		return symlinkResolveOnce, nil
+	case "1":
+		return symlinkResolveRetry, nil
+	}
+	return 0, fmt.Errorf("wrong symlink_policy %s. Must be 0 or 1", s)
+}
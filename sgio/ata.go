@@ -31,35 +31,68 @@ const (
 
 	ataOpStandbyNow1 = 0xe0 // https://wiki.osdev.org/ATA/ATAPI_Power_Management
 	ataOpStandbyNow2 = 0x94 // Retired in ATA4. Did not coexist with ATAPI.
+	ataOpIdleNow1    = 0xe1 // IDLE IMMEDIATE
+	ataOpIdleNow2    = 0x95 // Retired in ATA4. Did not coexist with ATAPI.
 )
 
+// StopAtaDevice spins down the disk with STANDBY IMMEDIATE. The first time,
+// every method is tried in turn and the one that works is kept for the disk.
 func StopAtaDevice(device string, debug bool) error {
+	if usesHdio(device) {
+		return StopHdioDevice(device, debug)
+	}
+	return negotiate(device, debug, func(method Quirk) error {
+		if method.Method == ScsiStartStop {
+			if debug {
+				fmt.Println(" issuing scsi stop command")
+			}
+			return StartStopScsiDevice(device, 0)
+		}
+		if debug {
+			fmt.Println(" issuing standby command")
+		}
+		return sendAtaNonData(device, method, ataOpStandbyNow1, ataOpStandbyNow2, 0, 0, debug)
+	})
+}
+
+// StartAtaDevice spins up the disk with IDLE IMMEDIATE, which brings a drive in
+// standby back to the idle mode with the platters spinning.
+func StartAtaDevice(device string, debug bool) error {
+	bridge := deviceMethod(device, debug)
+	if bridge.Method == ScsiStartStop {
+		if debug {
+			fmt.Println(" issuing scsi start command")
+		}
+		return StartScsiDevice(device)
+	}
+	if debug {
+		fmt.Println(" issuing idle command")
+	}
+	return sendAtaNonData(device, bridge, ataOpIdleNow1, ataOpIdleNow2, 0, 0, debug)
+}
+
+// sendAtaNonData sends a non-data ATA command to the device. If the command
+// fails on a disk without quirks and a retired opcode is given, the retired
+// opcode is tried as well. Devices without SG_IO get the command through
+// HDIO_DRIVE_CMD.
+func sendAtaNonData(device string, bridge Quirk, command, retired, features, count uint8, debug bool) error {
 	f, err := openDevice(device)
+	if err == ErrNotSgDevice {
+		return sendHdioNonData(device, command, retired, features, count, debug)
+	}
 	if err != nil {
 		return err
 	}
 
-	switch NewAtaDevice(device, debug).deviceType() {
-	case Jmicron:
-		if err = sendSgio(f, jmicronGetRegisters(), debug); err != nil {
+	if err = sendBridgeCommand(f, bridge, command, features, count, debug); err != nil {
+		if retired == 0 || bridge.Method != Unknown {
+			f.Close()
 			return err
 		}
-		if debug {
-			fmt.Println(" issuing standby command")
-		}
-		if err = sendSgio(f, jmicronStandby(), debug); err != nil {
+		if err = sendBridgeCommand(f, bridge, retired, features, count, debug); err != nil {
+			f.Close()
 			return err
 		}
-		return nil
-	default:
-		if debug {
-			fmt.Println(" issuing standby command")
-		}
-		if err = sendAtaCommand(f, ataOpStandbyNow1, debug); err != nil {
-			if err = sendAtaCommand(f, ataOpStandbyNow2, debug); err != nil {
-				return err
-			}
-		}
 	}
 
 	if err := f.Close(); err != nil {
@@ -68,33 +101,62 @@ func StopAtaDevice(device string, debug bool) error {
 	return nil
 }
 
-func jmicronGetRegisters() []uint8 {
-	cbd := []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0} // len 12
-	cbd[0] = 0xdf
-	cbd[1] = 0x10 // read
-	cbd[4] = 0x01
-	cbd[6] = 0x72
-	cbd[7] = 0x0f
-	cbd[11] = 0xfd
-	return cbd
+// sendBridgeCommand sends a non-data ATA command with the method of the bridge.
+func sendBridgeCommand(f *os.File, bridge Quirk, command, features, count uint8, debug bool) error {
+	switch bridge.Method {
+	case Jmicron:
+		if err := sendSgio(f, jmicronGetRegisters(), debug); err != nil {
+			return err
+		}
+		return sendSgio(f, jmicronAtaCommandWithRegisters(command, features, count), debug)
+	case Sat12:
+		return sendSgio(f, ataPassThrough12(command, features, count, 0), debug)
+	case RawCdb:
+		cdbs, err := bridge.expandCdbs(command, features, count)
+		if err != nil {
+			return err
+		}
+		for _, cdb := range cdbs {
+			if err := sendSgio(f, cdb, debug); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ScsiStartStop:
+		return unsupportedCommandError{fmt.Errorf("bridge %s does not pass ATA commands through", bridge.Name)}
+	}
+	return sendSgio(f, ataPassThrough16(command, features, count, 0), debug)
 }
 
-func jmicronStandby() []uint8 {
-	cbd := []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0} // len 12
-	cbd[0] = 0xdf
-	cbd[1] = 0x10
-	cbd[10] = 0xa0 // device port. either 0xa0 or 0xb0
-	cbd[11] = ataOpStandbyNow1
-	return cbd
+func jmicronGetRegisters() []uint8 {
+	return jmicronReadRegisters(0x720f, 1)
 }
 
-func sendAtaCommand(f *os.File, command uint8, debug bool) error {
+// ataPassThrough16 builds an ATA PASS-THROUGH(16) CDB for a non-data command.
+func ataPassThrough16(command, features, count, flags uint8) []uint8 {
 	cbd := []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0} // len 16
 	cbd[0] = sgAta16
 	cbd[1] = sgAtaProtoNonData
+	cbd[2] = flags
+	cbd[4] = features
+	cbd[6] = count
 	cbd[13] = ataUsingLba
 	cbd[14] = command
-	return sendSgio(f, cbd, debug)
+	return cbd
+}
+
+// ataPassThrough12 builds an ATA PASS-THROUGH(12) CDB for a non-data command,
+// for bridges which don't understand the 16 byte variant.
+func ataPassThrough12(command, features, count, flags uint8) []uint8 {
+	cbd := []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0} // len 12
+	cbd[0] = sgAta12
+	cbd[1] = sgAtaProtoNonData
+	cbd[2] = flags
+	cbd[3] = features
+	cbd[4] = count
+	cbd[8] = ataUsingLba
+	cbd[9] = command
+	return cbd
 }
 
 func sendSgio(f *os.File, inqCmdBlk []uint8, debug bool) error {
@@ -106,7 +168,7 @@ func sendSgio(f *os.File, inqCmdBlk []uint8, debug bool) error {
 		MxSbLen:        sgio.SENSE_BUF_LEN,    //  9	1
 		Cmdp:           &inqCmdBlk[0],         // 24	8
 		Sbp:            &senseBuf[0],          // 32	8
-		Timeout:        0,                     // 40	4
+		Timeout:        sgioTimeout(),         // 40	4
 	}
 
 	if debug {
@@ -117,7 +179,7 @@ func sendSgio(f *os.File, inqCmdBlk []uint8, debug bool) error {
 		return err
 	}
 
-	if err := sgio.CheckSense(ioHdr, &senseBuf); err != nil {
+	if err := checkSense(ioHdr, senseBuf); err != nil {
 		return err
 	}
 	return nil
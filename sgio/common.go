@@ -17,15 +17,54 @@
 package sgio
 
 import (
-	"fmt"
+	"errors"
 	"github.com/benmcclelland/sgio"
 	"os"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 const SgDxferNone = -1
 
+// CommandTimeout is how long the kernel waits for a command to complete
+// before it aborts it, so that a hung bridge fails the command instead of
+// blocking the caller forever.
+var CommandTimeout = 30 * time.Second
+
+// sgioTimeout returns CommandTimeout in milliseconds, as the SG_IO header
+// takes it.
+func sgioTimeout() uint32 {
+	return uint32(CommandTimeout / time.Millisecond)
+}
+
+const senseIllegalRequest = 0x05
+
+// ErrUnsupportedCommand is matched by the errors of commands the device
+// rejects, e.g. with ILLEGAL REQUEST for an invalid operation code.
+var ErrUnsupportedCommand = errors.New("command not supported by the device")
+
+type unsupportedCommandError struct {
+	error
+}
+
+func (e unsupportedCommandError) Is(target error) bool {
+	return target == ErrUnsupportedCommand
+}
+
+// checkSense returns a SenseError if the command did not complete
+// successfully.
+func checkSense(ioHdr *sgio.SgIoHdr, senseBuf []byte) error {
+	if ioHdr.Info&sgio.SG_INFO_OK_MASK == sgio.SG_INFO_OK {
+		return nil
+	}
+	return newSenseError(ioHdr, senseBuf[:ioHdr.SbLenWr])
+}
+
+// ErrNotSgDevice is returned for devices which don't support SG_IO, like
+// disks of the old IDE drivers.
+var ErrNotSgDevice = errors.New("device does not appear to be an sg device")
+
 func openDevice(fname string) (*os.File, error) {
 	f, err := os.OpenFile(fname, os.O_RDONLY, 0)
 	if err != nil {
@@ -33,11 +72,33 @@ func openDevice(fname string) (*os.File, error) {
 	}
 	var version uint32
 	if (ioctl(f.Fd(), sgio.SG_GET_VERSION_NUM, uintptr(unsafe.Pointer(&version))) != nil) || (version < 30000) {
-		return nil, fmt.Errorf("device does not appear to be an sg device")
+		f.Close()
+		return nil, ErrNotSgDevice
 	}
 	return f, nil
 }
 
+// IsSgDevice tells whether the device supports SG_IO. The error is set if the
+// device cannot be opened at all.
+func IsSgDevice(device string) (bool, error) {
+	f, err := openDevice(device)
+	if err == ErrNotSgDevice {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	return true, nil
+}
+
+// usesHdio tells whether ATA commands have to be sent to the device through
+// the legacy HDIO ioctls, because it does not support SG_IO.
+func usesHdio(device string) bool {
+	sg, err := IsSgDevice(device)
+	return err == nil && !sg
+}
+
 func ioctl(fd, cmd, ptr uintptr) error {
 	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, cmd, ptr)
 	if err != 0 {
@@ -0,0 +1,151 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sgio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	ataOpIdle1       = 0xe3 // IDLE, sets the standby timer
+	ataOpIdle2       = 0x97 // Retired in ATA4. Did not coexist with ATAPI.
+	ataOpSetFeatures = 0xef
+
+	ataFeatureEnableApm  = 0x05
+	ataFeatureDisableApm = 0x85
+	ApmDisabled          = 255
+
+	// MaxFirmwareStandby is the longest standby timer an ATA drive accepts.
+	MaxFirmwareStandby = 5*time.Hour + 30*time.Minute
+
+	scsiModeSense10  = 0x5a
+	scsiModeSelect10 = 0x55
+
+	powerConditionPage       = 0x1a
+	powerConditionPageLength = 0x26
+	modeHeaderLength         = 8
+	standbyZ                 = 1 << 0
+)
+
+// StandbyTimerCount encodes the standby timer the way hdparm -S does: 0
+// disables the timer, 1-240 are multiples of 5 seconds up to 20 minutes and
+// 241-251 are multiples of 30 minutes up to 5.5 hours. Timers in between are
+// rounded up.
+func StandbyTimerCount(timer time.Duration) (uint8, error) {
+	switch {
+	case timer < 0 || timer > MaxFirmwareStandby:
+		return 0, fmt.Errorf("standby timer %v out of range 0-%v", timer, MaxFirmwareStandby)
+	case timer == 0:
+		return 0, nil
+	case timer <= 20*time.Minute:
+		return uint8((timer + 5*time.Second - 1) / (5 * time.Second)), nil
+	}
+	return uint8(240 + (timer+30*time.Minute-1)/(30*time.Minute)), nil
+}
+
+// SetAtaStandbyTimer programs the standby timer of the drive firmware with
+// the IDLE command. The drive spins down on its own once it has been idle
+// for that long, even if hd-idle is not running.
+func SetAtaStandbyTimer(device string, timer time.Duration, debug bool) error {
+	count, err := StandbyTimerCount(timer)
+	if err != nil {
+		return err
+	}
+	if debug {
+		fmt.Printf(" setting standby timer to %v (0x%02x)\n", timer, count)
+	}
+	return sendAtaNonData(device, deviceMethod(device, debug), ataOpIdle1, ataOpIdle2, 0, count, debug)
+}
+
+// SetAtaApm sets the Advanced Power Management level with SET FEATURES, like
+// hdparm -B. Levels 1-127 permit spin down, 128-254 don't and 255 disables
+// APM.
+func SetAtaApm(device string, level uint8, debug bool) error {
+	if level == 0 {
+		return fmt.Errorf("invalid apm level 0. Must be a number from 1-255")
+	}
+	if debug {
+		fmt.Printf(" setting apm level to %d\n", level)
+	}
+	bridge := deviceMethod(device, debug)
+	if level == ApmDisabled {
+		return sendAtaNonData(device, bridge, ataOpSetFeatures, 0, ataFeatureDisableApm, 0, debug)
+	}
+	return sendAtaNonData(device, bridge, ataOpSetFeatures, 0, ataFeatureEnableApm, level, debug)
+}
+
+// SetScsiStandbyTimer programs the STANDBY_Z condition timer of the Power
+// Condition mode page, which SAS disks use instead of the ATA standby timer.
+// A timer of 0 disables the standby condition. The page is saved, so that the
+// setting survives a power cycle.
+// See SPC-4, 7.5.13 Power Condition mode page.
+func SetScsiStandbyTimer(device string, timer time.Duration, debug bool) error {
+	f, err := openDevice(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data := make([]uint8, modeHeaderLength+2+powerConditionPageLength)
+	senseCmd := []uint8{scsiModeSense10, 0x08, powerConditionPage, 0, 0, 0, 0, 0, 0, 0} // DBD: no block descriptors
+	binary.BigEndian.PutUint16(senseCmd[7:], uint16(len(data)))
+	if err = sendSgioDataIn(f, senseCmd, data, debug); err != nil {
+		return fmt.Errorf("cannot read power condition mode page: %s", err)
+	}
+
+	page, err := powerConditionModePage(data, timer)
+	if err != nil {
+		return err
+	}
+	if debug {
+		fmt.Printf(" setting standby_z timer to %v\n", timer)
+	}
+	selectCmd := []uint8{scsiModeSelect10, 0x11, 0, 0, 0, 0, 0, 0, 0, 0} // PF, SP: save the page
+	binary.BigEndian.PutUint16(selectCmd[7:], uint16(len(page)))
+	return sendSgioDataOut(f, selectCmd, page, debug)
+}
+
+// powerConditionModePage turns the MODE SENSE(10) response into the MODE
+// SELECT(10) parameter list setting the STANDBY_Z condition timer, given in
+// units of 100 milliseconds.
+func powerConditionModePage(data []uint8, timer time.Duration) ([]uint8, error) {
+	if len(data) < modeHeaderLength {
+		return nil, fmt.Errorf("short mode parameter header")
+	}
+	offset := modeHeaderLength + int(binary.BigEndian.Uint16(data[6:8]))
+	if len(data) < offset+12 || data[offset]&0x3f != powerConditionPage {
+		return nil, fmt.Errorf("power condition mode page not supported")
+	}
+	pageLength := 2 + int(data[offset+1])
+	if len(data) < offset+pageLength {
+		pageLength = len(data) - offset
+	}
+
+	page := make([]uint8, modeHeaderLength+pageLength)
+	copy(page[modeHeaderLength:], data[offset:offset+pageLength])
+	page[modeHeaderLength] &= 0x3f // PS is reserved in MODE SELECT
+	flags := &page[modeHeaderLength+3]
+	if timer == 0 {
+		*flags &^= standbyZ
+	} else {
+		*flags |= standbyZ
+		binary.BigEndian.PutUint32(page[modeHeaderLength+8:], uint32(timer/(100*time.Millisecond)))
+	}
+	return page, nil
+}
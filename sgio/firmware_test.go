@@ -0,0 +1,70 @@
+package sgio
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStandbyTimerCount(t *testing.T) {
+	tests := []struct {
+		timer   time.Duration
+		want    uint8
+		wantErr bool
+	}{
+		{timer: 0, want: 0},
+		{timer: time.Second, want: 1},
+		{timer: 5 * time.Second, want: 1},
+		{timer: 10 * time.Minute, want: 120},
+		{timer: 20 * time.Minute, want: 240},
+		{timer: 21 * time.Minute, want: 241},
+		{timer: time.Hour, want: 242},
+		{timer: 5*time.Hour + 30*time.Minute, want: 251},
+		{timer: 6 * time.Hour, wantErr: true},
+		{timer: -time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := StandbyTimerCount(tt.timer)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("StandbyTimerCount(%v) error = %v, wantErr %t", tt.timer, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("StandbyTimerCount(%v) = %d, want %d", tt.timer, got, tt.want)
+		}
+	}
+}
+
+func TestPowerConditionModePage(t *testing.T) {
+	sense := []uint8{
+		0x00, 0x2e, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, // mode parameter header
+		0x9a, 0x26, 0x00, 0x02, 0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x00, 0x00,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	}
+
+	page, err := powerConditionModePage(sense, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint8{
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x1a, 0x26, 0x00, 0x03, 0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x17, 0x70,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(page, want) {
+		t.Fatalf("Expected % x but found % x", want, page)
+	}
+
+	page, err = powerConditionModePage(sense, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page[modeHeaderLength+3] != 0x02 {
+		t.Fatalf("Expected STANDBY_Z to be cleared but found 0x%02x", page[modeHeaderLength+3])
+	}
+
+	if _, err = powerConditionModePage([]uint8{0, 6, 0, 0, 0, 0, 0, 0, 0x08, 0x12}, time.Minute); err == nil {
+		t.Fatal("Expected an error for a missing power condition page")
+	}
+}
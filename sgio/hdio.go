@@ -0,0 +1,136 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sgio
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Legacy ioctls of <linux/hdreg.h>, which hdparm falls back to when SG_IO is
+// not available. See Documentation/ioctl/hdio.rst.
+const (
+	hdioDriveTask = 0x031e
+	hdioDriveCmd  = 0x031f
+)
+
+// StopHdioDevice spins down the disk with STANDBY IMMEDIATE sent through
+// HDIO_DRIVE_CMD.
+func StopHdioDevice(device string, debug bool) error {
+	if debug {
+		fmt.Println(" issuing standby command")
+	}
+	return sendHdioNonData(device, ataOpStandbyNow1, ataOpStandbyNow2, 0, 0, debug)
+}
+
+// StartHdioDevice spins up the disk with IDLE IMMEDIATE sent through
+// HDIO_DRIVE_CMD.
+func StartHdioDevice(device string, debug bool) error {
+	if debug {
+		fmt.Println(" issuing idle command")
+	}
+	return sendHdioNonData(device, ataOpIdleNow1, ataOpIdleNow2, 0, 0, debug)
+}
+
+// HdioPowerState issues CHECK POWER MODE through HDIO_DRIVE_CMD, or through
+// HDIO_DRIVE_TASK if the driver does not return the registers of the former.
+func HdioPowerState(device string, debug bool) (PowerState, error) {
+	f, err := openHdioDevice(device)
+	if err != nil {
+		return PowerStateUnknown, err
+	}
+	defer f.Close()
+
+	if debug {
+		fmt.Println(" issuing check power mode command")
+	}
+	count, err := hdioCommand(f, ataOpCheckPowerMode, 0, 0, debug)
+	if err != nil {
+		if count, err = hdioTask(f, ataOpCheckPowerMode, debug); err != nil {
+			return PowerStateUnknown, err
+		}
+	}
+	if debug {
+		fmt.Printf(" power mode: 0x%02x\n", count)
+	}
+	return ataPowerState(count), nil
+}
+
+// sendHdioNonData sends a non-data ATA command through HDIO_DRIVE_CMD. If the
+// command fails and a retired opcode is given, the retired opcode is tried as
+// well.
+func sendHdioNonData(device string, command, retired, features, count uint8, debug bool) error {
+	f, err := openHdioDevice(device)
+	if err != nil {
+		return err
+	}
+
+	if _, err = hdioCommand(f, command, features, count, debug); err != nil {
+		if retired == 0 {
+			f.Close()
+			return err
+		}
+		if _, err = hdioCommand(f, retired, features, count, debug); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot close file %s. Error: %s", device, err)
+	}
+	return nil
+}
+
+func openHdioDevice(device string) (*os.File, error) {
+	return os.OpenFile(device, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+}
+
+// hdioCommand sends HDIO_DRIVE_CMD and returns the sector count register.
+func hdioCommand(f *os.File, command, features, count uint8, debug bool) (uint8, error) {
+	args := hdioCommandArgs(command, features, count)
+	if debug {
+		fmt.Printf("outgoing hdio_drive_cmd:  % x\n", args)
+	}
+	if err := ioctl(f.Fd(), hdioDriveCmd, uintptr(unsafe.Pointer(&args[0]))); err != nil {
+		return 0, fmt.Errorf("HDIO_DRIVE_CMD 0x%02x failed: %s", command, err)
+	}
+	return args[2], nil
+}
+
+// hdioTask sends HDIO_DRIVE_TASK with the taskfile command, features, sector
+// count, sector, cylinder low/high and select registers, and returns the
+// sector count register.
+func hdioTask(f *os.File, command uint8, debug bool) (uint8, error) {
+	args := [7]uint8{command}
+	if debug {
+		fmt.Printf("outgoing hdio_drive_task:  % x\n", args)
+	}
+	if err := ioctl(f.Fd(), hdioDriveTask, uintptr(unsafe.Pointer(&args[0]))); err != nil {
+		return 0, fmt.Errorf("HDIO_DRIVE_TASK 0x%02x failed: %s", command, err)
+	}
+	return args[2], nil
+}
+
+// hdioCommandArgs builds the HDIO_DRIVE_CMD arguments: command, sector count,
+// features and the number of sectors to read. On return they hold the
+// status, error and sector count registers.
+func hdioCommandArgs(command, features, count uint8) [4]uint8 {
+	return [4]uint8{command, count, features, 0}
+}
@@ -0,0 +1,14 @@
+package sgio
+
+import "testing"
+
+func TestHdioCommandArgs(t *testing.T) {
+	expected := [4]uint8{0xe3, 0xf1, 0x00, 0x00}
+	if args := hdioCommandArgs(ataOpIdle1, 0, 0xf1); args != expected {
+		t.Fatalf("Expected % x but found % x", expected, args)
+	}
+	expected = [4]uint8{0xef, 0x7f, 0x05, 0x00}
+	if args := hdioCommandArgs(ataOpSetFeatures, ataFeatureEnableApm, 0x7f); args != expected {
+		t.Fatalf("Expected % x but found % x", expected, args)
+	}
+}
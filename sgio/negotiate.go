@@ -0,0 +1,115 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sgio
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var methodNames = map[int]string{
+	Sat16:         "sat16",
+	Sat12:         "sat12",
+	Jmicron:       "jmicron",
+	ScsiStartStop: "scsi",
+	RawCdb:        "cdb",
+}
+
+// negotiated remembers, per device, the method which spun the disk down.
+var (
+	negotiatedMutex sync.Mutex
+	negotiated      = map[string]Quirk{}
+)
+
+// MethodName returns the name of the method used to send ATA commands to the
+// device, or an empty string if none was negotiated yet.
+func MethodName(device string) string {
+	if q, ok := negotiatedMethod(device); ok {
+		return methodNames[q.Method]
+	}
+	return ""
+}
+
+// Forget drops the method negotiated for the device, so that it is negotiated
+// again with the next disk showing up under the device name.
+func Forget(device string) {
+	negotiatedMutex.Lock()
+	delete(negotiated, device)
+	negotiatedMutex.Unlock()
+}
+
+func negotiatedMethod(device string) (Quirk, bool) {
+	negotiatedMutex.Lock()
+	defer negotiatedMutex.Unlock()
+	q, ok := negotiated[device]
+	return q, ok
+}
+
+// deviceMethod returns the method negotiated for the device, or the one of
+// its bridge if the device was not spun down yet.
+func deviceMethod(device string, debug bool) Quirk {
+	if q, ok := negotiatedMethod(device); ok {
+		return q
+	}
+	return NewAtaDevice(device, debug).bridge()
+}
+
+// transports lists the methods to try in order: SAT-16, SAT-12 and SCSI
+// START STOP UNIT as a last resort. A bridge found in the quirk table is
+// known to need its method, which is tried first.
+func transports(bridge Quirk) []Quirk {
+	methods := []Quirk{bridge}
+	for _, method := range []int{Sat16, Sat12, ScsiStartStop} {
+		if method != bridge.Method {
+			methods = append(methods, Quirk{Name: bridge.Name, Method: method})
+		}
+	}
+	return methods
+}
+
+// negotiate sends the command with every transport until one succeeds, which
+// is used for the device from then on and reported by MethodName. If every
+// transport rejected the command, the error matches ErrUnsupportedCommand.
+func negotiate(device string, debug bool, send func(method Quirk) error) error {
+	if q, ok := negotiatedMethod(device); ok {
+		return send(q)
+	}
+
+	var errs []string
+	unsupported := true
+	for _, method := range transports(NewAtaDevice(device, debug).bridge()) {
+		if err := send(method); err != nil {
+			if Classify(err) == ErrorClassDeviceGone {
+				return err
+			}
+			errs = append(errs, fmt.Sprintf("%s: %s", methodNames[method.Method], err))
+			unsupported = unsupported && errors.Is(err, ErrUnsupportedCommand)
+			continue
+		}
+		negotiatedMutex.Lock()
+		negotiated[device] = method
+		negotiatedMutex.Unlock()
+		return nil
+	}
+	err := fmt.Errorf("no method accepted the command (%s)", strings.Join(errs, ", "))
+	if unsupported {
+		return unsupportedCommandError{err}
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package sgio
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTransports(t *testing.T) {
+	tests := []struct {
+		name   string
+		bridge Quirk
+		want   []int
+	}{
+		{name: "unknown bridge", bridge: Quirk{Method: Sat16}, want: []int{Sat16, Sat12, ScsiStartStop}},
+		{name: "sat12 bridge", bridge: Quirk{Method: Sat12}, want: []int{Sat12, Sat16, ScsiStartStop}},
+		{name: "jmicron bridge", bridge: Quirk{Method: Jmicron}, want: []int{Jmicron, Sat16, Sat12, ScsiStartStop}},
+		{name: "scsi bridge", bridge: Quirk{Method: ScsiStartStop}, want: []int{ScsiStartStop, Sat16, Sat12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, q := range transports(tt.bridge) {
+				got = append(got, q.Method)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v but found %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	device := "/dev/sdzz"
+	defer func() { delete(negotiated, device) }()
+
+	var tried []int
+	send := func(q Quirk) error {
+		tried = append(tried, q.Method)
+		if q.Method != Sat12 {
+			return fmt.Errorf("rejected")
+		}
+		return nil
+	}
+	if err := negotiate(device, false, send); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tried, []int{Sat16, Sat12}) {
+		t.Fatalf("Expected %v but found %v", []int{Sat16, Sat12}, tried)
+	}
+	if method := MethodName(device); method != "sat12" {
+		t.Fatalf("Expected sat12 but found %s", method)
+	}
+
+	tried = nil
+	if err := negotiate(device, false, send); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tried, []int{Sat12}) {
+		t.Fatalf("Expected %v but found %v", []int{Sat12}, tried)
+	}
+	if q := deviceMethod(device, false); q.Method != Sat12 {
+		t.Fatalf("Expected method %d but found %d", Sat12, q.Method)
+	}
+
+	Forget(device)
+	if method := MethodName(device); method != "" {
+		t.Fatalf("Expected no method but found %s", method)
+	}
+}
+
+func TestNegotiateFails(t *testing.T) {
+	device := "/dev/sdzz"
+	err := negotiate(device, false, func(q Quirk) error {
+		return fmt.Errorf("rejected")
+	})
+	want := "no method accepted the command (sat16: rejected, sat12: rejected, scsi: rejected)"
+	if err == nil || err.Error() != want {
+		t.Fatalf("Expected %v but found %v", want, err)
+	}
+	if method := MethodName(device); method != "" {
+		t.Fatalf("Expected no method but found %s", method)
+	}
+}
+
+func TestNegotiateUnsupported(t *testing.T) {
+	device := "/dev/sdzz"
+	err := negotiate(device, false, func(q Quirk) error {
+		return unsupportedCommandError{fmt.Errorf("rejected")}
+	})
+	if !errors.Is(err, ErrUnsupportedCommand) {
+		t.Fatalf("Expected unsupported command error but found %v", err)
+	}
+
+	err = negotiate(device, false, func(q Quirk) error {
+		if q.Method == Sat12 {
+			return fmt.Errorf("timeout")
+		}
+		return unsupportedCommandError{fmt.Errorf("rejected")}
+	})
+	if err == nil || errors.Is(err, ErrUnsupportedCommand) {
+		t.Fatalf("Expected a generic error but found %v", err)
+	}
+}
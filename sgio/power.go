@@ -0,0 +1,322 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sgio
+
+import (
+	"fmt"
+	"github.com/benmcclelland/sgio"
+	"os"
+)
+
+type PowerState int
+
+const (
+	PowerStateUnknown PowerState = iota
+	PowerStateActive
+	PowerStateIdle
+	PowerStateStandby
+)
+
+func (p PowerState) String() string {
+	switch p {
+	case PowerStateActive:
+		return "active"
+	case PowerStateIdle:
+		return "idle"
+	case PowerStateStandby:
+		return "standby"
+	}
+	return "unknown"
+}
+
+const (
+	ataOpCheckPowerMode = 0xe5
+
+	sgAtaCheckCondition = 1 << 5 // CK_COND: return the ATA registers in the sense data
+
+	scsiRequestSense   = 0x03
+	requestSenseLength = 18
+
+	senseDescriptorFormat      = 0x72
+	senseDescriptorFormatDefer = 0x73
+	senseFixedFormat           = 0x70
+	senseFixedFormatDefer      = 0x71
+	ataStatusReturnDescriptor  = 0x09
+
+	jmicronRegistersPort0 = 0x8000 // output registers of the drive on port 0xa0
+
+	driverSense = 0x08
+)
+
+// AtaPowerState issues ATA CHECK POWER MODE, which reports the power mode of
+// the drive without waking it up.
+// See https://wiki.osdev.org/ATA/ATAPI_Power_Management
+func AtaPowerState(device string, debug bool) (PowerState, error) {
+	bridge := deviceMethod(device, debug)
+	if bridge.Method == ScsiStartStop {
+		return ScsiPowerState(device, debug)
+	}
+
+	f, err := openDevice(device)
+	if err == ErrNotSgDevice {
+		return HdioPowerState(device, debug)
+	}
+	if err != nil {
+		return PowerStateUnknown, err
+	}
+	defer f.Close()
+
+	var count uint8
+	if debug {
+		fmt.Println(" issuing check power mode command")
+	}
+	switch bridge.Method {
+	case Jmicron:
+		if err = sendSgio(f, jmicronAtaCommand(ataOpCheckPowerMode), debug); err != nil {
+			return PowerStateUnknown, err
+		}
+		registers := make([]uint8, 16)
+		if err = sendSgioDataIn(f, jmicronReadRegisters(jmicronRegistersPort0, len(registers)), registers, debug); err != nil {
+			return PowerStateUnknown, err
+		}
+		count = registers[0]
+	case RawCdb:
+		return PowerStateUnknown, fmt.Errorf("bridge %s does not return ATA registers", bridge.Name)
+	default:
+		cbd := ataPassThrough16(ataOpCheckPowerMode, 0, 0, sgAtaCheckCondition)
+		if bridge.Method == Sat12 {
+			cbd = ataPassThrough12(ataOpCheckPowerMode, 0, 0, sgAtaCheckCondition)
+		}
+		sense, err := sendSgioSense(f, cbd, debug)
+		if err != nil {
+			return PowerStateUnknown, err
+		}
+		var ok bool
+		if count, ok = ataReturnCount(sense); !ok {
+			return PowerStateUnknown, fmt.Errorf("no ATA registers returned for check power mode")
+		}
+	}
+
+	if debug {
+		fmt.Printf(" power mode: 0x%02x\n", count)
+	}
+	return ataPowerState(count), nil
+}
+
+// ScsiPowerState issues REQUEST SENSE, which reports the power condition of
+// the logical unit in the returned sense data without changing it.
+func ScsiPowerState(device string, debug bool) (PowerState, error) {
+	f, err := openDevice(device)
+	if err != nil {
+		return PowerStateUnknown, err
+	}
+	defer f.Close()
+
+	sense := make([]uint8, requestSenseLength)
+	cbd := []uint8{scsiRequestSense, 0, 0, 0, requestSenseLength, 0}
+	if err = sendSgioDataIn(f, cbd, sense, debug); err != nil {
+		return PowerStateUnknown, err
+	}
+
+	_, asc, ascq := senseCodes(sense)
+	if debug {
+		fmt.Printf(" sense: asc=0x%02x ascq=0x%02x\n", asc, ascq)
+	}
+	return scsiPowerState(asc, ascq), nil
+}
+
+// ataPowerState decodes the sector count returned by CHECK POWER MODE.
+func ataPowerState(count uint8) PowerState {
+	switch count {
+	case 0x00, 0x01:
+		return PowerStateStandby
+	case 0x40, 0x41, 0x80, 0x81, 0x82, 0x83:
+		return PowerStateIdle
+	case 0xff:
+		return PowerStateActive
+	}
+	return PowerStateUnknown
+}
+
+// scsiPowerState decodes the additional sense code returned by REQUEST SENSE.
+// See SPC-4, 4.5.6 Sense key and additional sense code definitions.
+func scsiPowerState(asc, ascq uint8) PowerState {
+	switch {
+	case asc == 0x04 && ascq == 0x02:
+		// LOGICAL UNIT NOT READY, INITIALIZING COMMAND REQUIRED: stopped
+		return PowerStateStandby
+	case asc == 0x5e:
+		switch ascq {
+		case 0x02, 0x04, 0x09, 0x0a:
+			// STANDBY, STANDBY_Y CONDITION ACTIVATED BY TIMER/COMMAND
+			return PowerStateStandby
+		default:
+			// LOW POWER CONDITION ON, IDLE_A/B/C CONDITION ACTIVATED
+			return PowerStateIdle
+		}
+	}
+	return PowerStateActive
+}
+
+// senseCodes returns the sense key, the additional sense code and its
+// qualifier from fixed or descriptor format sense data.
+func senseCodes(sense []uint8) (key, asc, ascq uint8) {
+	if len(sense) == 0 {
+		return 0, 0, 0
+	}
+	switch sense[0] & 0x7f {
+	case senseDescriptorFormat, senseDescriptorFormatDefer:
+		if len(sense) < 4 {
+			return 0, 0, 0
+		}
+		return sense[1] & 0x0f, sense[2], sense[3]
+	case senseFixedFormat, senseFixedFormatDefer:
+		if len(sense) < 14 {
+			return 0, 0, 0
+		}
+		return sense[2] & 0x0f, sense[12], sense[13]
+	}
+	return 0, 0, 0
+}
+
+// ataReturnCount returns the sector count register of the ATA Status Return
+// descriptor, or of the information field of fixed format sense data, which
+// a SAT device returns for ATA PASS-THROUGH with CK_COND set.
+func ataReturnCount(sense []uint8) (uint8, bool) {
+	if len(sense) == 0 {
+		return 0, false
+	}
+	if descriptor := ataStatusDescriptor(sense); descriptor != nil {
+		return descriptor[5], true
+	}
+	switch sense[0] & 0x7f {
+	case senseFixedFormat, senseFixedFormatDefer:
+		if len(sense) > 6 {
+			return sense[6], true
+		}
+	}
+	return 0, false
+}
+
+// ataStatusDescriptor returns the ATA Status Return descriptor of descriptor
+// format sense data, or nil if there is none. See SAT-3, 12.2.2.6.
+func ataStatusDescriptor(sense []uint8) []uint8 {
+	if len(sense) < 8 {
+		return nil
+	}
+	switch sense[0] & 0x7f {
+	case senseDescriptorFormat, senseDescriptorFormatDefer:
+		end := 8 + int(sense[7])
+		if end > len(sense) {
+			end = len(sense)
+		}
+		for i := 8; i+1 < end; i += 2 + int(sense[i+1]) {
+			if sense[i] == ataStatusReturnDescriptor && i+13 < len(sense) {
+				return sense[i : i+14]
+			}
+		}
+	}
+	return nil
+}
+
+func jmicronAtaCommand(command uint8) []uint8 {
+	return jmicronAtaCommandWithRegisters(command, 0, 0)
+}
+
+func jmicronAtaCommandWithRegisters(command, features, count uint8) []uint8 {
+	cbd := []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0} // len 12
+	cbd[0] = 0xdf
+	cbd[1] = 0x10
+	cbd[5] = features
+	cbd[6] = count
+	cbd[10] = 0xa0 // device port. either 0xa0 or 0xb0
+	cbd[11] = command
+	return cbd
+}
+
+func jmicronReadRegisters(address uint16, length int) []uint8 {
+	cbd := []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0} // len 12
+	cbd[0] = 0xdf
+	cbd[1] = 0x10 // read
+	cbd[3] = uint8(length >> 8)
+	cbd[4] = uint8(length)
+	cbd[6] = uint8(address >> 8)
+	cbd[7] = uint8(address)
+	cbd[11] = 0xfd
+	return cbd
+}
+
+// sendSgioSense sends a command which is expected to end in CHECK CONDITION
+// and returns the sense data.
+func sendSgioSense(f *os.File, inqCmdBlk []uint8, debug bool) ([]uint8, error) {
+	senseBuf := make([]byte, sgio.SENSE_BUF_LEN)
+	ioHdr := &sgio.SgIoHdr{
+		InterfaceID:    'S',
+		DxferDirection: SgDxferNone,
+		CmdLen:         uint8(len(inqCmdBlk)),
+		MxSbLen:        sgio.SENSE_BUF_LEN,
+		Cmdp:           &inqCmdBlk[0],
+		Sbp:            &senseBuf[0],
+		Timeout:        sgioTimeout(),
+	}
+
+	if debug {
+		dumpBytes(inqCmdBlk)
+	}
+
+	if err := sgio.SgioSyscall(f, ioHdr); err != nil {
+		return nil, err
+	}
+	if driverStatus := ioHdr.DriverStatus & 0x0f; ioHdr.HostStatus != 0 || (driverStatus != 0 && driverStatus != driverSense) {
+		return nil, checkSense(ioHdr, senseBuf)
+	}
+	return senseBuf[:ioHdr.SbLenWr], nil
+}
+
+// sendSgioDataIn sends a command reading len(data) bytes from the device.
+func sendSgioDataIn(f *os.File, inqCmdBlk []uint8, data []uint8, debug bool) error {
+	return sendSgioData(f, inqCmdBlk, data, sgio.SG_DXFER_FROM_DEV, debug)
+}
+
+// sendSgioDataOut sends a command writing data to the device.
+func sendSgioDataOut(f *os.File, inqCmdBlk []uint8, data []uint8, debug bool) error {
+	return sendSgioData(f, inqCmdBlk, data, sgio.SG_DXFER_TO_DEV, debug)
+}
+
+func sendSgioData(f *os.File, inqCmdBlk []uint8, data []uint8, direction int32, debug bool) error {
+	senseBuf := make([]byte, sgio.SENSE_BUF_LEN)
+	ioHdr := &sgio.SgIoHdr{
+		InterfaceID:    'S',
+		DxferDirection: direction,
+		CmdLen:         uint8(len(inqCmdBlk)),
+		MxSbLen:        sgio.SENSE_BUF_LEN,
+		DxferLen:       uint32(len(data)),
+		Dxferp:         &data[0],
+		Cmdp:           &inqCmdBlk[0],
+		Sbp:            &senseBuf[0],
+		Timeout:        sgioTimeout(),
+	}
+
+	if debug {
+		dumpBytes(inqCmdBlk)
+	}
+
+	if err := sgio.SgioSyscall(f, ioHdr); err != nil {
+		return err
+	}
+	return checkSense(ioHdr, senseBuf)
+}
@@ -0,0 +1,123 @@
+package sgio
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAtaReturnCount(t *testing.T) {
+	tests := []struct {
+		name  string
+		sense []uint8
+		want  uint8
+		ok    bool
+	}{
+		{
+			name: "descriptor format standby",
+			sense: []uint8{0x72, 0x01, 0x00, 0x1d, 0, 0, 0, 0x0e,
+				0x09, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x50},
+			want: 0x00,
+			ok:   true,
+		},
+		{
+			name: "descriptor format active",
+			sense: []uint8{0x72, 0x01, 0x00, 0x1d, 0, 0, 0, 0x0e,
+				0x09, 0x0c, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x50},
+			want: 0xff,
+			ok:   true,
+		},
+		{
+			name:  "fixed format idle",
+			sense: []uint8{0x70, 0x00, 0x01, 0x00, 0x50, 0x40, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1d},
+			want:  0x80,
+			ok:    true,
+		},
+		{
+			name:  "no ata status return descriptor",
+			sense: []uint8{0x72, 0x05, 0x24, 0x00, 0, 0, 0, 0x00},
+			ok:    false,
+		},
+		{
+			name: "no sense",
+			ok:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ataReturnCount(tt.sense)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("ataReturnCount() = 0x%02x, %t, want 0x%02x, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAtaPowerState(t *testing.T) {
+	tests := []struct {
+		count uint8
+		want  PowerState
+	}{
+		{0x00, PowerStateStandby},
+		{0x40, PowerStateIdle},
+		{0x80, PowerStateIdle},
+		{0xff, PowerStateActive},
+		{0x12, PowerStateUnknown},
+	}
+	for _, tt := range tests {
+		if got := ataPowerState(tt.count); got != tt.want {
+			t.Errorf("ataPowerState(0x%02x) = %v, want %v", tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestScsiPowerState(t *testing.T) {
+	tests := []struct {
+		name  string
+		sense []uint8
+		want  PowerState
+	}{
+		{
+			name:  "no sense",
+			sense: []uint8{0x70, 0, 0x00, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x00, 0x00, 0, 0, 0, 0},
+			want:  PowerStateActive,
+		},
+		{
+			name:  "standby condition activated by command",
+			sense: []uint8{0x70, 0, 0x00, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x5e, 0x04, 0, 0, 0, 0},
+			want:  PowerStateStandby,
+		},
+		{
+			name:  "idle condition activated by timer",
+			sense: []uint8{0x70, 0, 0x00, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x5e, 0x01, 0, 0, 0, 0},
+			want:  PowerStateIdle,
+		},
+		{
+			name:  "stopped",
+			sense: []uint8{0x72, 0x02, 0x04, 0x02, 0, 0, 0, 0},
+			want:  PowerStateStandby,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, asc, ascq := senseCodes(tt.sense)
+			if got := scsiPowerState(asc, ascq); got != tt.want {
+				t.Errorf("scsiPowerState() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJmicronCommands(t *testing.T) {
+	getRegisters := []uint8{0xdf, 0x10, 0, 0, 0x01, 0, 0x72, 0x0f, 0, 0, 0, 0xfd}
+	if got := jmicronGetRegisters(); !bytes.Equal(got, getRegisters) {
+		t.Errorf("jmicronGetRegisters() = % x, want % x", got, getRegisters)
+	}
+	standby := []uint8{0xdf, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0xa0, 0xe0}
+	if got := jmicronAtaCommand(ataOpStandbyNow1); !bytes.Equal(got, standby) {
+		t.Errorf("jmicronAtaCommand() = % x, want % x", got, standby)
+	}
+	readRegisters := []uint8{0xdf, 0x10, 0, 0, 0x10, 0, 0x80, 0x00, 0, 0, 0, 0xfd}
+	if got := jmicronReadRegisters(jmicronRegistersPort0, 16); !bytes.Equal(got, readRegisters) {
+		t.Errorf("jmicronReadRegisters() = % x, want % x", got, readRegisters)
+	}
+}
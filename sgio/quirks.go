@@ -0,0 +1,268 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sgio
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Quirk files list one USB bridge per line:
+
+	# <idVendor>:<idProduct>[:<bcdDevice>[-<bcdDevice>]] <method> [<cdb>[; <cdb>...]]
+	152d:0578 sat12
+	174c:55aa:0100-01ff scsi
+	04b4:6830 cdb 24 24 00 be 01 00 {features} {count} 00 00 00 00 {command} 00 00 00
+
+Methods are sat16, sat12, jmicron, scsi and cdb. The cdb method takes one or
+more CDB templates, sent in order for every ATA command. A template is a list
+of hex bytes where {command}, {features} and {count} are replaced by the ATA
+registers of the command.
+*/
+
+// Quirk tells how to send ATA commands to the disks behind a USB bridge.
+type Quirk struct {
+	Name      string
+	IdVendor  uint16
+	IdProduct uint16
+	// BcdDevice range of the firmware revisions the quirk applies to
+	BcdMin, BcdMax uint16
+	Method         int
+	// Cdbs are the CDB templates of the RawCdb method
+	Cdbs [][]string
+}
+
+const (
+	cdbCommand  = "{command}"
+	cdbFeatures = "{features}"
+	cdbCount    = "{count}"
+)
+
+// builtinQuirks lists the bridges known to need something else than ATA
+// PASS-THROUGH(16), as documented in the smartmontools drive database.
+var builtinQuirks = []Quirk{
+	{Name: "JMicron JM20329", IdVendor: 0x152d, IdProduct: 0x2329, BcdMax: 0xffff, Method: Jmicron},
+	{Name: "JMicron JM20336", IdVendor: 0x152d, IdProduct: 0x2336, BcdMax: 0xffff, Method: Jmicron},
+	{Name: "JMicron JM20337/8", IdVendor: 0x152d, IdProduct: 0x2338, BcdMax: 0xffff, Method: Jmicron},
+	{Name: "JMicron JM20339", IdVendor: 0x152d, IdProduct: 0x2339, BcdMax: 0xffff, Method: Jmicron},
+	{Name: "JMicron JMS539", IdVendor: 0x152d, IdProduct: 0x0539, BcdMin: 0x0100, BcdMax: 0x0100, Method: Jmicron},
+	{Name: "JMicron JMS567", IdVendor: 0x152d, IdProduct: 0x0567, BcdMax: 0xffff, Method: Sat12},
+	{Name: "JMicron JMS578", IdVendor: 0x152d, IdProduct: 0x0578, BcdMax: 0xffff, Method: Sat12},
+	{Name: "ASMedia ASM1051", IdVendor: 0x174c, IdProduct: 0x5106, BcdMax: 0xffff, Method: Sat12},
+	{Name: "ASMedia AS2105", IdVendor: 0x174c, IdProduct: 0x5136, BcdMax: 0xffff, Method: Sat12},
+	{Name: "Initio INIC-1610P", IdVendor: 0x13fd, IdProduct: 0x1640, BcdMax: 0xffff, Method: Sat12},
+	{Name: "Initio INIC-3609", IdVendor: 0x13fd, IdProduct: 0x3910, BcdMax: 0xffff, Method: Sat12},
+	{Name: "Initio INIC-1607E", IdVendor: 0x13fd, IdProduct: 0x0840, BcdMax: 0xffff, Method: ScsiStartStop},
+	{Name: "Realtek RTL9201", IdVendor: 0x0bda, IdProduct: 0x9201, BcdMax: 0xffff, Method: ScsiStartStop},
+	{Name: "Cypress CY7C68300A (AT2)", IdVendor: 0x04b4, IdProduct: 0x6830, BcdMin: 0x0001, BcdMax: 0x0001, Method: ScsiStartStop},
+	{Name: "Cypress CY7C68300B/C (AT2LP)", IdVendor: 0x04b4, IdProduct: 0x6830, BcdMin: 0x0200, BcdMax: 0xffff, Method: RawCdb,
+		Cdbs: [][]string{cypressAtacb}},
+	{Name: "Cypress CY7C68310 (ISD-300LP)", IdVendor: 0x04b4, IdProduct: 0x6831, BcdMax: 0xffff, Method: RawCdb,
+		Cdbs: [][]string{cypressAtacb}},
+	{Name: "Sunplus SPDIF215", IdVendor: 0x04fc, IdProduct: 0x0c15, BcdMax: 0xffff, Method: RawCdb,
+		Cdbs: [][]string{sunplusPassThrough}},
+	{Name: "Sunplus SPIF225", IdVendor: 0x04fc, IdProduct: 0x0c25, BcdMax: 0xffff, Method: RawCdb,
+		Cdbs: [][]string{sunplusPassThrough}},
+	{Name: "Prolific PL2507", IdVendor: 0x067b, IdProduct: 0x2507, BcdMax: 0xffff, Method: Jmicron},
+	{Name: "Prolific PL2571", IdVendor: 0x067b, IdProduct: 0x2571, BcdMax: 0xffff, Method: RawCdb,
+		Cdbs: [][]string{prolificPassThrough}},
+	{Name: "Prolific PL2773", IdVendor: 0x067b, IdProduct: 0x2773, BcdMax: 0xffff, Method: RawCdb,
+		Cdbs: [][]string{prolificPassThrough}},
+	{Name: "Prolific PL2775", IdVendor: 0x067b, IdProduct: 0x2775, BcdMax: 0xffff, Method: RawCdb,
+		Cdbs: [][]string{prolificPassThrough}},
+}
+
+var (
+	// Cypress ATA Command Block, vendor CDB 0x24
+	cypressAtacb = strings.Fields("24 24 00 be 01 00 {features} {count} 00 00 00 00 {command} 00 00 00")
+	// Sunplus pass-through, vendor CDB 0xf8 subcommand 0x22
+	sunplusPassThrough = strings.Fields("f8 00 22 00 00 {features} {count} 00 00 00 a0 {command}")
+	// Prolific pass-through, vendor CDB 0xd8
+	prolificPassThrough = strings.Fields("d8 00 00 00 00 00 00 00 {features} {count} 00 00 00 e0 {command} 06")
+)
+
+// userQuirks are the entries read from the quirk file. LoadQuirks replaces
+// them on reload while the spindown workers look bridges up.
+var (
+	userQuirksMutex sync.RWMutex
+	userQuirks      []Quirk
+)
+
+func loadedQuirks() []Quirk {
+	userQuirksMutex.RLock()
+	defer userQuirksMutex.RUnlock()
+	return userQuirks
+}
+
+func setQuirks(quirks []Quirk) {
+	userQuirksMutex.Lock()
+	userQuirks = quirks
+	userQuirksMutex.Unlock()
+}
+
+func (q Quirk) matches(idVendor, idProduct, bcdDevice uint16) bool {
+	return q.IdVendor == idVendor && q.IdProduct == idProduct &&
+		bcdDevice >= q.BcdMin && bcdDevice <= q.BcdMax
+}
+
+// expandCdbs returns the CDBs of the RawCdb method for an ATA command.
+func (q Quirk) expandCdbs(command, features, count uint8) ([][]uint8, error) {
+	var cdbs [][]uint8
+	for _, template := range q.Cdbs {
+		cdb := make([]uint8, len(template))
+		for i, field := range template {
+			switch field {
+			case cdbCommand:
+				cdb[i] = command
+			case cdbFeatures:
+				cdb[i] = features
+			case cdbCount:
+				cdb[i] = count
+			default:
+				b, err := strconv.ParseUint(field, 16, 8)
+				if err != nil {
+					return nil, fmt.Errorf("invalid byte %s in cdb of bridge %s", field, q.Name)
+				}
+				cdb[i] = uint8(b)
+			}
+		}
+		cdbs = append(cdbs, cdb)
+	}
+	return cdbs, nil
+}
+
+// LoadQuirks reads the bridges of the quirk file, which are looked up before
+// the built-in ones. A missing file is only an error if it was required. The
+// bridges in use are only replaced once the whole file was read.
+func LoadQuirks(file string, required bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			setQuirks(nil)
+			return nil
+		}
+		return fmt.Errorf("cannot read quirk file %s: %s", file, err)
+	}
+	defer f.Close()
+
+	var quirks []Quirk
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		q, err := parseQuirk(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", file, lineNumber, err)
+		}
+		quirks = append(quirks, q)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	setQuirks(quirks)
+	return nil
+}
+
+func parseQuirk(line string) (Quirk, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return Quirk{}, fmt.Errorf("expected <idVendor>:<idProduct> <method>")
+	}
+	q := Quirk{Name: fields[0], BcdMax: 0xffff}
+
+	ids := strings.Split(fields[0], ":")
+	if len(ids) < 2 || len(ids) > 3 {
+		return Quirk{}, fmt.Errorf("invalid usb id %s. Must be <idVendor>:<idProduct>[:<bcdDevice>[-<bcdDevice>]]", fields[0])
+	}
+	var err error
+	if q.IdVendor, err = parseHex16(ids[0]); err != nil {
+		return Quirk{}, err
+	}
+	if q.IdProduct, err = parseHex16(ids[1]); err != nil {
+		return Quirk{}, err
+	}
+	if len(ids) == 3 {
+		bcd := strings.SplitN(ids[2], "-", 2)
+		if q.BcdMin, err = parseHex16(bcd[0]); err != nil {
+			return Quirk{}, err
+		}
+		q.BcdMax = q.BcdMin
+		if len(bcd) == 2 {
+			if q.BcdMax, err = parseHex16(bcd[1]); err != nil {
+				return Quirk{}, err
+			}
+		}
+		if q.BcdMin > q.BcdMax {
+			return Quirk{}, fmt.Errorf("invalid bcdDevice range %s", ids[2])
+		}
+	}
+
+	q.Method = -1
+	for method, name := range methodNames {
+		if name == fields[1] {
+			q.Method = method
+		}
+	}
+	if q.Method < 0 {
+		return Quirk{}, fmt.Errorf("unknown method %s. Must be one of: sat16, sat12, jmicron, scsi, cdb", fields[1])
+	}
+
+	rest := strings.Join(fields[2:], " ")
+	if q.Method != RawCdb {
+		if len(rest) > 0 {
+			return Quirk{}, fmt.Errorf("method %s takes no cdb", fields[1])
+		}
+		return q, nil
+	}
+	for _, template := range strings.Split(rest, ";") {
+		cdb := strings.Fields(template)
+		if len(cdb) == 0 {
+			continue
+		}
+		if len(cdb) != 6 && len(cdb) != 10 && len(cdb) != 12 && len(cdb) != 16 {
+			return Quirk{}, fmt.Errorf("invalid cdb length %d. Must be 6, 10, 12 or 16 bytes", len(cdb))
+		}
+		q.Cdbs = append(q.Cdbs, cdb)
+	}
+	if len(q.Cdbs) == 0 {
+		return Quirk{}, fmt.Errorf("method cdb requires at least one cdb")
+	}
+	if _, err := q.expandCdbs(0, 0, 0); err != nil {
+		return Quirk{}, err
+	}
+	return q, nil
+}
+
+func parseHex16(s string) (uint16, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hex number %s", s)
+	}
+	return uint16(v), nil
+}
@@ -0,0 +1,126 @@
+package sgio
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAptQuirk(t *testing.T) {
+	defer func() { userQuirks = nil }()
+	userQuirks = []Quirk{{Name: "override", IdVendor: 0x152d, IdProduct: 0x2339, BcdMin: 0x0100, BcdMax: 0x01ff, Method: ScsiStartStop}}
+
+	tests := []struct {
+		name   string
+		apt    apt
+		want   string
+		wantOk bool
+	}{
+		{name: "built-in", apt: apt{"04b4", "6831", "0001"}, want: "Cypress CY7C68310 (ISD-300LP)", wantOk: true},
+		{name: "bcdDevice range", apt: apt{"04b4", "6830", "0240"}, want: "Cypress CY7C68300B/C (AT2LP)", wantOk: true},
+		{name: "user entry first", apt: apt{"152d", "2339", "0100"}, want: "override", wantOk: true},
+		{name: "user entry out of range", apt: apt{"152d", "2339", "0200"}, want: "JMicron JM20339", wantOk: true},
+		{name: "no quirk", apt: apt{"1058", "25a3", "1021"}, wantOk: false},
+		{name: "malformed id", apt: apt{"xyz", "25a3", "1021"}, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.apt.quirk()
+			if ok != tt.wantOk || got.Name != tt.want {
+				t.Errorf("quirk() = %s, %t, want %s, %t", got.Name, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestLoadQuirks(t *testing.T) {
+	defer func() { userQuirks = nil }()
+	file := filepath.Join(t.TempDir(), "hd-idle.quirks")
+	content := `# bridges of the backup shelf
+152d:0578 sat12
+174c:55aa:0100-01ff scsi   # old firmware
+0bda:9201:0100 cdb df 10 00 00 01 00 72 0f 00 00 00 fd; df 10 00 00 00 {features} {count} 00 00 00 a0 {command}
+`
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadQuirks(file, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(userQuirks) != 3 {
+		t.Fatalf("Expected 3 quirks but found %d", len(userQuirks))
+	}
+	if q := userQuirks[0]; q.Method != Sat12 || q.BcdMin != 0 || q.BcdMax != 0xffff {
+		t.Fatalf("Unexpected quirk %+v", q)
+	}
+	if q := userQuirks[1]; q.Method != ScsiStartStop || q.IdVendor != 0x174c || q.BcdMin != 0x0100 || q.BcdMax != 0x01ff {
+		t.Fatalf("Unexpected quirk %+v", q)
+	}
+
+	cdbs, err := userQuirks[2].expandCdbs(ataOpSetFeatures, ataFeatureEnableApm, 127)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]uint8{
+		{0xdf, 0x10, 0, 0, 0x01, 0, 0x72, 0x0f, 0, 0, 0, 0xfd},
+		{0xdf, 0x10, 0, 0, 0, 0x05, 0x7f, 0, 0, 0, 0xa0, 0xef},
+	}
+	if len(cdbs) != len(want) {
+		t.Fatalf("Expected %d cdbs but found %d", len(want), len(cdbs))
+	}
+	for i := range want {
+		if !bytes.Equal(cdbs[i], want[i]) {
+			t.Fatalf("Expected % x but found % x", want[i], cdbs[i])
+		}
+	}
+
+	if err := LoadQuirks(filepath.Join(t.TempDir(), "missing"), false); err != nil || userQuirks != nil {
+		t.Fatalf("Missing optional quirk file should reset the quirks: %v", err)
+	}
+}
+
+func TestLoadQuirksErrors(t *testing.T) {
+	defer setQuirks(nil)
+	loaded := []Quirk{{Name: "loaded", IdVendor: 0x152d, IdProduct: 0x0578, BcdMax: 0xffff, Method: Sat12}}
+	setQuirks(loaded)
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "missing method", content: "152d:0578", want: "1: expected <idVendor>:<idProduct> <method>"},
+		{name: "bad id", content: "152d sat12", want: "1: invalid usb id 152d. Must be <idVendor>:<idProduct>[:<bcdDevice>[-<bcdDevice>]]"},
+		{name: "bad range", content: "152d:0578:0200-0100 sat12", want: "1: invalid bcdDevice range 0200-0100"},
+		{name: "unknown method", content: "\n152d:0578 sat32", want: "2: unknown method sat32. Must be one of: sat16, sat12, jmicron, scsi, cdb"},
+		{name: "cdb without cdb method", content: "152d:0578 sat12 a1 00", want: "1: method sat12 takes no cdb"},
+		{name: "bad cdb length", content: "152d:0578 cdb a1 00", want: "1: invalid cdb length 2. Must be 6, 10, 12 or 16 bytes"},
+		{name: "bad cdb byte", content: "152d:0578 cdb a1 00 00 00 {cmd} 00", want: "1: invalid byte {cmd} in cdb of bridge 152d:0578"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "quirks")
+			if err := os.WriteFile(file, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := LoadQuirks(file, true)
+			if err == nil {
+				t.Fatalf("Expected error %s", tt.want)
+			}
+			if err.Error() != file+":"+tt.want {
+				t.Fatalf("Expected %v but found %v", file+":"+tt.want, err.Error())
+			}
+			if quirks := loadedQuirks(); !reflect.DeepEqual(quirks, loaded) {
+				t.Fatalf("Expected %v but found %v", loaded, quirks)
+			}
+		})
+	}
+}
+
+func TestAtaPassThrough12(t *testing.T) {
+	want := []uint8{0xa1, 0x06, 0x20, 0x05, 0x7f, 0, 0, 0, 0x40, 0xef, 0, 0}
+	if got := ataPassThrough12(ataOpSetFeatures, ataFeatureEnableApm, 127, sgAtaCheckCondition); !bytes.Equal(got, want) {
+		t.Errorf("ataPassThrough12() = % x, want % x", got, want)
+	}
+}
@@ -17,18 +17,31 @@
 package sgio
 
 import (
-	"fmt"
 	"github.com/benmcclelland/sgio"
 )
 
 // https://en.wikipedia.org/wiki/SCSI_command
 const startStopUnit = 0x1b
 
+const startStopStart = 1 // START bit
+
 func StartStopScsiDevice(device string, powerCondition uint8) error {
+	return sendStartStopUnit(device, powerCondition<<4)
+}
+
+// StartScsiDevice spins up the disk with START=1 and power condition
+// START_VALID, which brings the disk to the active power condition whether it
+// was stopped or put into idle or standby.
+func StartScsiDevice(device string) error {
+	return sendStartStopUnit(device, startStopStart)
+}
+
+func sendStartStopUnit(device string, powerConditionStart uint8) error {
 	f, err := openDevice(device)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	senseBuf := make([]byte, sgio.SENSE_BUF_LEN)
 	//See https://www.seagate.com/files/staticfiles/support/docs/manual/Interface%20manuals/100293068j.pdf - 3.49 START STOP UNIT command
@@ -37,7 +50,7 @@ func StartStopScsiDevice(device string, powerCondition uint8) error {
 		0,                   //Reserved (7 bit) + IMMED
 		0,                   //Reserved (8 bit)
 		0,                   //Reserved (4 bit) + POWER CONDITION MODIFER
-		powerCondition << 4, //POWER CONDITION + Reserved (1 bit) + NO_ FLUSH + LOEJ + LOEJ
+		powerConditionStart, //POWER CONDITION + Reserved (1 bit) + NO_ FLUSH + LOEJ + START
 		0}                   //CONTROL
 	ioHdr := &sgio.SgIoHdr{
 		InterfaceID:    'S',
@@ -46,18 +59,11 @@ func StartStopScsiDevice(device string, powerCondition uint8) error {
 		CmdLen:         uint8(len(inqCmdBlk)),
 		Sbp:            &senseBuf[0],
 		MxSbLen:        sgio.SENSE_BUF_LEN,
+		Timeout:        sgioTimeout(),
 	}
 
 	if err := sgio.SgioSyscall(f, ioHdr); err != nil {
 		return err
 	}
-
-	if err := sgio.CheckSense(ioHdr, &senseBuf); err != nil {
-		return err
-	}
-
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("cannot close file %s. Error: %s", device, err)
-	}
-	return nil
+	return checkSense(ioHdr, senseBuf)
 }
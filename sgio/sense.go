@@ -0,0 +1,237 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sgio
+
+import (
+	"errors"
+	"fmt"
+	"github.com/benmcclelland/sgio"
+	"strings"
+	"syscall"
+)
+
+// ErrorClass tells how a failed command should be handled.
+type ErrorClass int
+
+const (
+	// ErrorClassFailed is a command which failed for good, like on a
+	// hardware error.
+	ErrorClassFailed ErrorClass = iota
+	// ErrorClassRetryable is a command which may succeed when sent again,
+	// e.g. after a bus reset or while the disk becomes ready.
+	ErrorClassRetryable
+	// ErrorClassUnsupported is a command the device or its bridge rejects.
+	ErrorClassUnsupported
+	// ErrorClassDeviceGone is a command sent to a device which was removed.
+	ErrorClassDeviceGone
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassRetryable:
+		return "retryable"
+	case ErrorClassUnsupported:
+		return "unsupported command"
+	case ErrorClassDeviceGone:
+		return "device gone"
+	}
+	return "failed"
+}
+
+// ErrDeviceGone is matched by the errors of commands sent to a device which
+// is not there anymore.
+var ErrDeviceGone = errors.New("device gone")
+
+// See SPC-4, 4.5.6 Sense key and additional sense code definitions.
+var senseKeys = []string{
+	"NO SENSE",
+	"RECOVERED ERROR",
+	"NOT READY",
+	"MEDIUM ERROR",
+	"HARDWARE ERROR",
+	"ILLEGAL REQUEST",
+	"UNIT ATTENTION",
+	"DATA PROTECT",
+	"BLANK CHECK",
+	"VENDOR SPECIFIC",
+	"COPY ABORTED",
+	"ABORTED COMMAND",
+	"RESERVED",
+	"VOLUME OVERFLOW",
+	"MISCOMPARE",
+	"COMPLETED",
+}
+
+const (
+	senseNotReady       = 0x02
+	senseUnitAttention  = 0x06
+	senseAbortedCommand = 0x0b
+
+	ascMediumNotPresent = 0x3a
+
+	scsiStatusBusy         = 0x08
+	scsiStatusTaskSetFull  = 0x28
+	ataStatusError         = 1 << 0 // ERR
+	ataErrorAbort          = 1 << 2 // ABRT
+	hostStatusNoConnect    = 0x01
+	hostStatusBusBusy      = 0x02
+	hostStatusTimeOut      = 0x03
+	hostStatusBadTarget    = 0x04
+	hostStatusReset        = 0x08
+	hostStatusSoftError    = 0x0b
+	hostStatusImmRetry     = 0x0c
+	hostStatusRequeue      = 0x0d
+	hostStatusTransportErr = 0x0e // DID_TRANSPORT_DISRUPTED
+)
+
+// SenseError is a command the device did not complete successfully, as
+// reported by SG_IO.
+type SenseError struct {
+	Status       uint8
+	HostStatus   uint16
+	DriverStatus uint16
+	SenseKey     uint8
+	Asc          uint8
+	Ascq         uint8
+	// AtaRegisters is set if the sense data holds the status and error
+	// registers the drive returned for an ATA PASS-THROUGH command
+	AtaRegisters bool
+	AtaStatus    uint8
+	AtaError     uint8
+	Sense        []uint8
+}
+
+func newSenseError(ioHdr *sgio.SgIoHdr, sense []uint8) *SenseError {
+	e := &SenseError{
+		Status:       ioHdr.Status,
+		HostStatus:   ioHdr.HostStatus,
+		DriverStatus: ioHdr.DriverStatus,
+		Sense:        append([]uint8(nil), sense...),
+	}
+	e.SenseKey, e.Asc, e.Ascq = senseCodes(sense)
+	e.AtaStatus, e.AtaError, e.AtaRegisters = ataReturnRegisters(sense)
+	return e
+}
+
+// SenseKeyName returns the name of the sense key, like ILLEGAL REQUEST.
+func (e *SenseError) SenseKeyName() string {
+	return senseKeys[e.SenseKey&0x0f]
+}
+
+// Description returns the description of the additional sense code and its
+// qualifier, like INVALID COMMAND OPERATION CODE.
+func (e *SenseError) Description() string {
+	if description := sgio.GetErrString(e.Asc, e.Ascq); len(description) > 0 {
+		return description
+	}
+	return fmt.Sprintf("UNKNOWN ASC/ASCQ 0x%02x/0x%02x", e.Asc, e.Ascq)
+}
+
+func (e *SenseError) Error() string {
+	var b strings.Builder
+	if len(e.Sense) == 0 {
+		fmt.Fprintf(&b, "SCSI status 0x%02x host status 0x%02x driver status 0x%02x",
+			e.Status, e.HostStatus, e.DriverStatus)
+	} else {
+		fmt.Fprintf(&b, "%s, %s (asc=0x%02x ascq=0x%02x)", e.SenseKeyName(), e.Description(), e.Asc, e.Ascq)
+	}
+	if e.AtaRegisters {
+		fmt.Fprintf(&b, ", ata status=0x%02x error=0x%02x", e.AtaStatus, e.AtaError)
+	}
+	fmt.Fprintf(&b, " [%s]", e.Class())
+	return b.String()
+}
+
+// Class tells whether the command is worth retrying, was rejected by the
+// device or failed because the device went away.
+func (e *SenseError) Class() ErrorClass {
+	switch e.HostStatus {
+	case hostStatusNoConnect, hostStatusBadTarget:
+		return ErrorClassDeviceGone
+	case hostStatusBusBusy, hostStatusTimeOut, hostStatusReset, hostStatusSoftError,
+		hostStatusImmRetry, hostStatusRequeue, hostStatusTransportErr:
+		return ErrorClassRetryable
+	}
+	switch e.Status {
+	case scsiStatusBusy, scsiStatusTaskSetFull:
+		return ErrorClassRetryable
+	}
+	if e.AtaRegisters && e.AtaStatus&ataStatusError != 0 && e.AtaError&ataErrorAbort != 0 {
+		// the drive aborted the command it does not implement
+		return ErrorClassUnsupported
+	}
+	switch e.SenseKey {
+	case senseIllegalRequest:
+		return ErrorClassUnsupported
+	case senseNotReady:
+		if e.Asc == ascMediumNotPresent {
+			return ErrorClassDeviceGone
+		}
+		return ErrorClassRetryable
+	case senseUnitAttention, senseAbortedCommand:
+		return ErrorClassRetryable
+	}
+	return ErrorClassFailed
+}
+
+func (e *SenseError) Is(target error) bool {
+	switch target {
+	case ErrUnsupportedCommand:
+		return e.Class() == ErrorClassUnsupported
+	case ErrDeviceGone:
+		return e.Class() == ErrorClassDeviceGone
+	}
+	return false
+}
+
+// Classify returns the class of an error returned by this package. Besides
+// SenseError, it knows the errors of opening the device and of the SG_IO
+// ioctl itself.
+func Classify(err error) ErrorClass {
+	var senseErr *SenseError
+	switch {
+	case err == nil:
+		return ErrorClassFailed
+	case errors.As(err, &senseErr):
+		return senseErr.Class()
+	case errors.Is(err, ErrUnsupportedCommand):
+		return ErrorClassUnsupported
+	case errors.Is(err, ErrDeviceGone), errors.Is(err, syscall.ENOENT),
+		errors.Is(err, syscall.ENODEV), errors.Is(err, syscall.ENXIO):
+		return ErrorClassDeviceGone
+	case errors.Is(err, syscall.EBUSY), errors.Is(err, syscall.EAGAIN),
+		errors.Is(err, syscall.EINTR), errors.Is(err, syscall.ETIMEDOUT):
+		return ErrorClassRetryable
+	}
+	return ErrorClassFailed
+}
+
+// ataReturnRegisters returns the status and error registers of the ATA Status
+// Return descriptor, or of the information field of fixed format sense data
+// with ATA PASS-THROUGH INFORMATION AVAILABLE.
+func ataReturnRegisters(sense []uint8) (status, errorRegister uint8, ok bool) {
+	if descriptor := ataStatusDescriptor(sense); descriptor != nil {
+		return descriptor[13], descriptor[3], true
+	}
+	if _, asc, ascq := senseCodes(sense); len(sense) > 6 && asc == 0x00 && ascq == 0x1d {
+		switch sense[0] & 0x7f {
+		case senseFixedFormat, senseFixedFormatDefer:
+			return sense[4], sense[3], true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,114 @@
+package sgio
+
+import (
+	"errors"
+	"fmt"
+	"github.com/benmcclelland/sgio"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestSenseError(t *testing.T) {
+	tests := []struct {
+		name    string
+		ioHdr   sgio.SgIoHdr
+		sense   []uint8
+		class   ErrorClass
+		message string
+	}{
+		{
+			name:    "invalid opcode",
+			ioHdr:   sgio.SgIoHdr{Status: 0x02, DriverStatus: 0x08},
+			sense:   []uint8{0x70, 0x00, 0x05, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x20, 0x00},
+			class:   ErrorClassUnsupported,
+			message: "ILLEGAL REQUEST, INVALID COMMAND OPERATION CODE (asc=0x20 ascq=0x00) [unsupported command]",
+		},
+		{
+			name:  "ata command aborted",
+			ioHdr: sgio.SgIoHdr{Status: 0x02, DriverStatus: 0x08},
+			sense: []uint8{0x72, 0x0b, 0x00, 0x00, 0, 0, 0, 0x0e,
+				0x09, 0x0c, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x51},
+			class:   ErrorClassUnsupported,
+			message: "ABORTED COMMAND, NO ADDITIONAL SENSE INFORMATION (asc=0x00 ascq=0x00), ata status=0x51 error=0x04 [unsupported command]",
+		},
+		{
+			name:    "power on reset",
+			ioHdr:   sgio.SgIoHdr{Status: 0x02, DriverStatus: 0x08},
+			sense:   []uint8{0x72, 0x06, 0x29, 0x00, 0, 0, 0, 0x00},
+			class:   ErrorClassRetryable,
+			message: "UNIT ATTENTION, POWER ON, RESET, OR BUS DEVICE RESET OCCURRED (asc=0x29 ascq=0x00) [retryable]",
+		},
+		{
+			name:  "becoming ready",
+			ioHdr: sgio.SgIoHdr{Status: 0x02, DriverStatus: 0x08},
+			sense: []uint8{0x70, 0x00, 0x02, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x04, 0x01},
+			class: ErrorClassRetryable,
+		},
+		{
+			name:  "medium not present",
+			ioHdr: sgio.SgIoHdr{Status: 0x02, DriverStatus: 0x08},
+			sense: []uint8{0x70, 0x00, 0x02, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x3a, 0x00},
+			class: ErrorClassDeviceGone,
+		},
+		{
+			name:    "no connect",
+			ioHdr:   sgio.SgIoHdr{HostStatus: 0x01},
+			class:   ErrorClassDeviceGone,
+			message: "SCSI status 0x00 host status 0x01 driver status 0x00 [device gone]",
+		},
+		{
+			name:  "bus reset",
+			ioHdr: sgio.SgIoHdr{HostStatus: 0x08},
+			class: ErrorClassRetryable,
+		},
+		{
+			name:  "hardware error",
+			ioHdr: sgio.SgIoHdr{Status: 0x02, DriverStatus: 0x08},
+			sense: []uint8{0x70, 0x00, 0x04, 0, 0, 0, 0, 0x0a, 0, 0, 0, 0, 0x44, 0x00},
+			class: ErrorClassFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newSenseError(&tt.ioHdr, tt.sense)
+			if class := Classify(fmt.Errorf("cannot spindown: %w", err)); class != tt.class {
+				t.Errorf("Expected %v but found %v", tt.class, class)
+			}
+			if len(tt.message) > 0 && err.Error() != tt.message {
+				t.Errorf("Expected %q but found %q", tt.message, err.Error())
+			}
+			if errors.Is(err, ErrUnsupportedCommand) != (tt.class == ErrorClassUnsupported) {
+				t.Errorf("Unexpected match of ErrUnsupportedCommand for %v", tt.class)
+			}
+		})
+	}
+}
+
+func TestAtaReturnRegisters(t *testing.T) {
+	status, errorRegister, ok := ataReturnRegisters([]uint8{0x70, 0x00, 0x01, 0x04, 0x51, 0x40, 0x00, 0x0a, 0, 0, 0, 0, 0x00, 0x1d})
+	if !ok || status != 0x51 || errorRegister != 0x04 {
+		t.Fatalf("Expected 0x51, 0x04 but found 0x%02x, 0x%02x, %t", status, errorRegister, ok)
+	}
+	if _, _, ok := ataReturnRegisters([]uint8{0x70, 0x00, 0x05, 0x04, 0x51, 0x40, 0x00, 0x0a, 0, 0, 0, 0, 0x20, 0x00}); ok {
+		t.Fatal("Expected no ata registers in fixed format sense without ata pass-through information")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err  error
+		want ErrorClass
+	}{
+		{&os.PathError{Op: "open", Path: "/dev/sdzz", Err: syscall.ENOENT}, ErrorClassDeviceGone},
+		{syscall.ENXIO, ErrorClassDeviceGone},
+		{syscall.EBUSY, ErrorClassRetryable},
+		{unsupportedCommandError{fmt.Errorf("rejected")}, ErrorClassUnsupported},
+		{syscall.EIO, ErrorClassFailed},
+	}
+	for _, tt := range tests {
+		if got := Classify(tt.err); got != tt.want {
+			t.Errorf("Classify(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
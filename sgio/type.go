@@ -20,16 +20,21 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
+// Methods to talk to the disk behind a USB bridge.
 const (
-	Jmicron = iota
-	Unknown = iota
+	Jmicron       = iota // JMicron vendor CDB 0xdf
+	Unknown              // no quirk, ATA PASS-THROUGH(16)
+	Sat12                // ATA PASS-THROUGH(12)
+	ScsiStartStop        // ATA commands are not passed through, only SCSI START STOP UNIT works
+	RawCdb               // vendor CDB templates
 
-	sysblock = "/sys/block"
+	Sat16 = Unknown
 
-	jmicron = "152d"
+	sysblock = "/sys/block"
 )
 
 type AtaDevice struct {
@@ -50,38 +55,65 @@ type apt struct {
 	idVendor, idProduct, bcdDevice string
 }
 
-func (a apt) isJmicron() bool {
-	if a.idVendor != jmicron {
-		return false
+// quirk returns the first entry of the quirk tables matching the bridge.
+// Entries added by the admin take precedence over the built-in ones.
+func (a apt) quirk() (Quirk, bool) {
+	vendor, err := strconv.ParseUint(a.idVendor, 16, 16)
+	if err != nil {
+		return Quirk{}, false
 	}
-	switch a.idProduct {
-	case "2329", "2336", "2338", "2339":
-		return true
+	product, err := strconv.ParseUint(a.idProduct, 16, 16)
+	if err != nil {
+		return Quirk{}, false
 	}
-	return false
+	bcdDevice, err := strconv.ParseUint(a.bcdDevice, 16, 16)
+	if err != nil {
+		return Quirk{}, false
+	}
+	for _, table := range [][]Quirk{loadedQuirks(), builtinQuirks} {
+		for _, q := range table {
+			if q.matches(uint16(vendor), uint16(product), uint16(bcdDevice)) {
+				return q, true
+			}
+		}
+	}
+	return Quirk{}, false
 }
 
 func (ad AtaDevice) deviceType() int {
-	a, err := ad.identifyDevice(ad.device)
-	if err != nil {
-		if ad.debug {
-			fmt.Println("APT: Unsupported device")
-		}
-		return Unknown
+	return ad.bridge().Method
+}
+
+// bridge returns the quirk of the USB bridge the device is attached to. Disks
+// not attached through a known bridge are sent ATA PASS-THROUGH(16).
+func (ad AtaDevice) bridge() Quirk {
+	if q, ok := ad.knownBridge(); ok {
+		return q
 	}
-	if a.isJmicron() {
-		if ad.debug {
-			fmt.Println("APT: Found supported device jmicron")
+	return Quirk{Method: Unknown}
+}
+
+func (ad AtaDevice) knownBridge() (Quirk, bool) {
+	a, err := ad.identifyDevice(ad.device)
+	if err == nil {
+		if q, ok := a.quirk(); ok {
+			if ad.debug {
+				fmt.Printf("APT: Found supported device %s\n", q.Name)
+			}
+			return q, true
 		}
-		return Jmicron
 	}
-
 	if ad.debug {
 		fmt.Println("APT: Unsupported device")
 	}
-	return Unknown
+	return Quirk{}, false
 }
 
+// UsbBridge returns the quirk of the USB bridge the device is attached to, if
+// the bridge is found in the quirk tables.
+func UsbBridge(device string, debug bool) (Quirk, bool) {
+	return NewAtaDevice(device, debug).knownBridge()
+}
 func (ad AtaDevice) identifyDevice(device string) (apt, error) {
 	diskname := strings.Split(device, "/")[2]
 	sysblockdisk := filepath.Join(ad.fsRoot, diskname)
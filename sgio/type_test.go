@@ -36,6 +36,30 @@ func TestAtaDevice_deviceType(t *testing.T) {
 			},
 			want: Jmicron,
 		},
+		{
+			name: "find bridge requiring ata pass-through 12",
+			fields: fields{
+				device:    "/dev/sde",
+				debug:     true,
+				fsRoot:    filepath.Join(tmpDir, "sys", "block"),
+				idVendor:  "152d",
+				idProduct: "0578",
+				bcdDevice: "0508",
+			},
+			want: Sat12,
+		},
+		{
+			name: "bcdDevice out of range",
+			fields: fields{
+				device:    "/dev/sde",
+				debug:     true,
+				fsRoot:    filepath.Join(tmpDir, "sys", "block"),
+				idVendor:  "152d",
+				idProduct: "0539",
+				bcdDevice: "0205",
+			},
+			want: Unknown,
+		},
 		{
 			name: "unknown device",
 			fields: fields{
@@ -0,0 +1,182 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sysfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const ClassBlock = "/sys/class/block"
+
+const (
+	TransportUsb      = "usb"
+	TransportSata     = "sata"
+	TransportSas      = "sas"
+	TransportNvme     = "nvme"
+	TransportMmc      = "mmc"
+	TransportVirtio   = "virtio"
+	TransportIeee1394 = "ieee1394"
+	TransportScsi     = "scsi"
+)
+
+// Attributes describe a block device as found in /sys/class/block/<name>.
+type Attributes struct {
+	Name       string
+	Model      string
+	Vendor     string
+	Serial     string
+	WWID       string
+	Removable  bool
+	Rotational bool
+	Transport  string
+	// UsbDriver is the driver of the USB interface of usb disks, either
+	// "uas" or "usb-storage".
+	UsbDriver string
+	// UsbPort is the USB device the disk is attached to, named after its
+	// bus and the ports of the hubs on the way, e.g. "2-1.4".
+	UsbPort string
+}
+
+// ReadAttributes reads the attributes of the named block device below root,
+// which is /sys/class/block on a running system.
+func ReadAttributes(root, name string) (Attributes, error) {
+	deviceDir := filepath.Join(root, name)
+	if _, err := os.Stat(deviceDir); err != nil {
+		return Attributes{}, fmt.Errorf("cannot find block device %s: %s", name, err)
+	}
+
+	a := Attributes{
+		Name:       name,
+		Model:      readAttribute(deviceDir, "device/model"),
+		Vendor:     readAttribute(deviceDir, "device/vendor"),
+		Serial:     readSerial(deviceDir),
+		WWID:       readAttribute(deviceDir, "wwid"),
+		Removable:  readAttribute(deviceDir, "removable") == "1",
+		Rotational: readAttribute(deviceDir, "queue/rotational") == "1",
+		Transport:  transport(deviceDir),
+	}
+	if usbInterface := usbInterface(deviceDir); len(usbInterface) > 0 {
+		a.UsbDriver = readLink(usbInterface, "driver")
+		a.UsbPort = filepath.Base(filepath.Dir(usbInterface))
+	}
+	if len(a.WWID) == 0 {
+		a.WWID = readAttribute(deviceDir, "device/wwid")
+	}
+	return a, nil
+}
+
+// Identity returns a name of the disk which stays the same when the disk shows
+// up under another kernel name: its world wide name, or its model and serial
+// number. Identifiers made up of vendor and model only, like the t10 ones of
+// many USB bridges, are not unique and not used. The identity is empty if the
+// disk has none of them.
+func (a Attributes) Identity() string {
+	for _, prefix := range []string{"naa.", "eui.", "nvme."} {
+		if strings.HasPrefix(a.WWID, prefix) {
+			return a.WWID
+		}
+	}
+	if len(a.Serial) > 0 {
+		return strings.TrimSpace(a.Model + " " + a.Serial)
+	}
+	return ""
+}
+
+func readAttribute(deviceDir, attribute string) string {
+	content, err := os.ReadFile(filepath.Join(deviceDir, attribute))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// readSerial returns the serial number from the Unit Serial Number VPD page
+// of SCSI devices, or from the serial attribute NVMe and MMC devices expose.
+func readSerial(deviceDir string) string {
+	page, err := os.ReadFile(filepath.Join(deviceDir, "device", "vpd_pg80"))
+	if err == nil && len(page) > 4 {
+		length := int(page[3])
+		if 4+length > len(page) {
+			length = len(page) - 4
+		}
+		return strings.TrimSpace(string(page[4 : 4+length]))
+	}
+	if serial := readAttribute(deviceDir, "device/serial"); len(serial) > 0 {
+		return serial
+	}
+	return readAttribute(deviceDir, "serial")
+}
+
+// transport tells how the device is attached by looking at the path of the
+// device in the sysfs tree, e.g.
+// /sys/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdc
+func transport(deviceDir string) string {
+	path, err := filepath.EvalSymlinks(deviceDir)
+	if err != nil {
+		return ""
+	}
+	if i := strings.Index(path, "/devices/"); i >= 0 {
+		path = path[i:]
+	}
+	switch {
+	case strings.Contains(path, "/usb"):
+		return TransportUsb
+	case strings.Contains(path, "/fw") || strings.Contains(path, "/firewire"):
+		return TransportIeee1394
+	case strings.Contains(path, "/nvme"):
+		return TransportNvme
+	case strings.Contains(path, "/mmc"):
+		return TransportMmc
+	case strings.Contains(path, "/virtio"):
+		return TransportVirtio
+	case strings.Contains(path, "/end_device-") || strings.Contains(path, "/expander-"):
+		return TransportSas
+	case strings.Contains(path, "/ata"):
+		return TransportSata
+	case strings.Contains(path, "/host"):
+		return TransportScsi
+	}
+	return ""
+}
+
+// usbInterface returns the directory of the USB interface the device hangs
+// off, e.g. /sys/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0, or an
+// empty string for devices not attached through USB.
+func usbInterface(deviceDir string) string {
+	path, err := filepath.EvalSymlinks(filepath.Join(deviceDir, "device"))
+	if err != nil {
+		return ""
+	}
+	for dir := path; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "bInterfaceNumber")); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// readLink returns the name of the file a symlink of the directory points to.
+func readLink(dir, link string) string {
+	target, err := filepath.EvalSymlinks(filepath.Join(dir, link))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
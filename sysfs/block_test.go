@@ -0,0 +1,140 @@
+package sysfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadAttributes(t *testing.T) {
+	tests := []struct {
+		name       string
+		disk       string
+		devicePath string
+		files      map[string]string
+		// usbDriver is bound to the USB interface below devicePath
+		usbDriver string
+		want      Attributes
+	}{
+		{
+			name:       "usb disk",
+			disk:       "sdc",
+			devicePath: "devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0",
+			files: map[string]string{
+				"device/model":     "My Book 25EE    \n",
+				"device/vendor":    "WD      \n",
+				"device/wwid":      "t10.WD      My Book 25EE\n",
+				"removable":        "0\n",
+				"queue/rotational": "1\n",
+			},
+			usbDriver: "uas",
+			want: Attributes{Name: "sdc", Model: "My Book 25EE", Vendor: "WD",
+				WWID: "t10.WD      My Book 25EE", Rotational: true, Transport: TransportUsb, UsbDriver: "uas", UsbPort: "2-1"},
+		},
+		{
+			name:       "sata disk",
+			disk:       "sda",
+			devicePath: "devices/pci0000:00/0000:00:17.0/ata1/host0/target0:0:0/0:0:0:0",
+			files: map[string]string{
+				"device/model":     "ST4000DM005-2DP1\n",
+				"device/vendor":    "ATA     \n",
+				"device/vpd_pg80":  "\x00\x80\x00\x08ZGY0LBRB",
+				"device/wwid":      "naa.5000c500a3d1d419\n",
+				"removable":        "0\n",
+				"queue/rotational": "1\n",
+			},
+			want: Attributes{Name: "sda", Model: "ST4000DM005-2DP1", Vendor: "ATA", Serial: "ZGY0LBRB",
+				WWID: "naa.5000c500a3d1d419", Rotational: true, Transport: TransportSata},
+		},
+		{
+			name:       "sas disk",
+			disk:       "sdd",
+			devicePath: "devices/pci0000:00/0000:00:01.0/0000:01:00.0/host1/port-1:0/end_device-1:0/target1:0:0/1:0:0:0",
+			files: map[string]string{
+				"queue/rotational": "1\n",
+			},
+			want: Attributes{Name: "sdd", Rotational: true, Transport: TransportSas},
+		},
+		{
+			name:       "nvme disk",
+			disk:       "nvme0n1",
+			devicePath: "devices/pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0",
+			files: map[string]string{
+				"device/model":     "Samsung SSD 970 EVO Plus 1TB\n",
+				"device/serial":    "S4EWNX0R123456\n",
+				"wwid":             "eui.0025385891b0a1b2\n",
+				"queue/rotational": "0\n",
+			},
+			want: Attributes{Name: "nvme0n1", Model: "Samsung SSD 970 EVO Plus 1TB", Serial: "S4EWNX0R123456",
+				WWID: "eui.0025385891b0a1b2", Transport: TransportNvme},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			deviceDir := filepath.Join(root, tt.devicePath, "block", tt.disk)
+			if err := os.MkdirAll(filepath.Join(deviceDir, "queue"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(filepath.Join(root, tt.devicePath), filepath.Join(deviceDir, "device")); err != nil {
+				t.Fatal(err)
+			}
+			for file, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(deviceDir, file), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(tt.usbDriver) > 0 {
+				usbInterface := filepath.Join(root, tt.devicePath, "..", "..", "..")
+				driver := filepath.Join(root, "bus", "usb", "drivers", tt.usbDriver)
+				if err := os.MkdirAll(driver, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(usbInterface, "bInterfaceNumber"), []byte("00\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(driver, filepath.Join(usbInterface, "driver")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			classBlock := filepath.Join(root, "class", "block")
+			if err := os.MkdirAll(classBlock, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(deviceDir, filepath.Join(classBlock, tt.disk)); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ReadAttributes(classBlock, tt.disk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ReadAttributes() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadAttributesUnknownDevice(t *testing.T) {
+	if _, err := ReadAttributes(t.TempDir(), "sdz"); err == nil {
+		t.Fatal("Expected an error for a missing device")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	tests := []struct {
+		attributes Attributes
+		want       string
+	}{
+		{Attributes{Model: "ST4000DM005-2DP1", Serial: "ZGY0LBRB", WWID: "naa.5000c500a3d1d419"}, "naa.5000c500a3d1d419"},
+		{Attributes{Model: "My Book 25EE", Serial: "575834314435", WWID: "t10.WD      My Book 25EE"}, "My Book 25EE 575834314435"},
+		{Attributes{Model: "My Book 25EE", WWID: "t10.WD      My Book 25EE"}, ""},
+		{Attributes{}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.attributes.Identity(); got != tt.want {
+			t.Errorf("Identity() = %q, want %q", got, tt.want)
+		}
+	}
+}
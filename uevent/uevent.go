@@ -0,0 +1,122 @@
+// hd-idle - spin down idle hard disks
+// Copyright (C) 2018  Andoni del Olmo
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package uevent
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+	ActionChange = "change"
+
+	// kernelGroup is the multicast group the kernel sends its uevents to,
+	// udev re-broadcasts them to group 2 after processing
+	kernelGroup = 1
+
+	// the kernel limits the environment of a uevent to 2048 bytes
+	bufferSize = 8192
+)
+
+// Event is a uevent of the kernel, e.g. for a disk being plugged in:
+//
+//	add@/devices/.../block/sdc
+//	ACTION=add
+//	DEVPATH=/devices/.../block/sdc
+//	SUBSYSTEM=block
+//	DEVNAME=sdc
+//	DEVTYPE=disk
+type Event struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	DevName   string
+	DevType   string
+	Env       map[string]string
+}
+
+// Listener receives the uevents of the kernel over a netlink socket.
+type Listener struct {
+	fd int
+}
+
+// Listen opens a netlink socket subscribed to the uevents of the kernel.
+func Listen() (*Listener, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open netlink socket: %s", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: kernelGroup}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("cannot bind netlink socket: %s", err)
+	}
+	return &Listener{fd: fd}, nil
+}
+
+// Read blocks until the next uevent arrives. Messages not sent by the kernel
+// are skipped. syscall.ENOBUFS is returned if events were lost because they
+// were not read fast enough.
+func (l *Listener) Read() (Event, error) {
+	buf := make([]byte, bufferSize)
+	for {
+		n, from, err := syscall.Recvfrom(l.fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return Event{}, err
+		}
+		if sender, ok := from.(*syscall.SockaddrNetlink); !ok || sender.Pid != 0 {
+			continue
+		}
+		if event, ok := parse(buf[:n]); ok {
+			return event, nil
+		}
+	}
+}
+
+// Close closes the netlink socket.
+func (l *Listener) Close() error {
+	return syscall.Close(l.fd)
+}
+
+// parse decodes a kernel uevent: a header "action@devpath" followed by
+// KEY=value pairs, all terminated by NUL.
+func parse(msg []byte) (Event, bool) {
+	fields := strings.Split(strings.TrimRight(string(msg), "\x00"), "\x00")
+	if len(fields) < 2 || !strings.Contains(fields[0], "@") {
+		return Event{}, false
+	}
+	event := Event{Env: map[string]string{}}
+	for _, field := range fields[1:] {
+		if i := strings.IndexByte(field, '='); i > 0 {
+			event.Env[field[:i]] = field[i+1:]
+		}
+	}
+	event.Action = event.Env["ACTION"]
+	event.DevPath = event.Env["DEVPATH"]
+	event.Subsystem = event.Env["SUBSYSTEM"]
+	event.DevName = event.Env["DEVNAME"]
+	event.DevType = event.Env["DEVTYPE"]
+	if len(event.Action) == 0 {
+		return Event{}, false
+	}
+	return event, true
+}
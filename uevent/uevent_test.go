@@ -0,0 +1,45 @@
+package uevent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	msg := strings.Join([]string{
+		"add@/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdc",
+		"ACTION=add",
+		"DEVPATH=/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdc",
+		"SUBSYSTEM=block",
+		"MAJOR=8",
+		"MINOR=32",
+		"DEVNAME=sdc",
+		"DEVTYPE=disk",
+		"SEQNUM=4242",
+	}, "\x00") + "\x00"
+
+	event, ok := parse([]byte(msg))
+	if !ok {
+		t.Fatal("Expected an event")
+	}
+	if event.Action != ActionAdd || event.Subsystem != "block" || event.DevName != "sdc" || event.DevType != "disk" ||
+		event.DevPath != "/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdc" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	if event.Env["SEQNUM"] != "4242" {
+		t.Fatalf("Expected 4242 but found %s", event.Env["SEQNUM"])
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, msg := range []string{
+		"",
+		"libudev\x00\xfe\xed\xca\xfe",
+		"add@/devices/virtual/block/loop0\x00",
+		"ACTION=add\x00DEVNAME=sdc\x00",
+	} {
+		if event, ok := parse([]byte(msg)); ok {
+			t.Errorf("Expected no event for %q but found %+v", msg, event)
+		}
+	}
+}